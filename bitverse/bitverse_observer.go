@@ -5,5 +5,6 @@ type BitverseObserver interface {
 	OnSiblingLeft(node *EdgeNode, id string)
 	OnSiblingHeartbeat(node *EdgeNode, id string)
 	OnChildrenReply(node *EdgeNode, id string, children []string)
-	OnConnected(node *EdgeNode, superNode *RemoteNode)
+	OnConnected(node *EdgeNode, superNode *RemoteNode) // also called when reconnected
+	OnDisconnected(node *EdgeNode, superNode *RemoteNode)
 }
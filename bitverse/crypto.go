@@ -9,16 +9,17 @@ import (
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"github.com/nu7hatch/gouuid"
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 )
 
 /// PUBLIC
@@ -32,19 +33,6 @@ func GenerateAesSecret() (secret string, err error) {
 	return
 }
 
-func UniqueHashkey() string {
-	u, err := uuid.NewV4()
-	if err != nil {
-		panic(err)
-	}
-
-	// calculate sha-1 hash
-	hasher := sha1.New()
-	hasher.Write([]byte(u.String()))
-
-	return encodeHex(hasher.Sum(nil))
-}
-
 func HashkeyFromString(str string) string {
 	// calculate sha-1 hash
 	hasher := sha1.New()
@@ -62,6 +50,42 @@ func GeneratePem(filename string) (err error) {
 	return
 }
 
+// Loads a PEM encoded certificate and private key for use with
+// WSTransport.SetTLSConfig. The certificate is presented both when accepting
+// and when making connections. If caFile is set, it is used to verify the
+// certificates of super nodes we connect to, and if verifyClients is also set,
+// connecting nodes must present a certificate signed by it.
+func LoadTLSConfig(certFile string, keyFile string, caFile string, verifyClients bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		tlsConfig.RootCAs = pool
+
+		if verifyClients {
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if verifyClients {
+		return nil, errors.New("verifying client certificates requires a ca file")
+	}
+
+	return tlsConfig, nil
+}
+
 func ImportPem(filename string) (prv *rsa.PrivateKey, pub *rsa.PublicKey, err error) {
 	prv, _, err = importKeyFromFile(filename)
 	if err != nil {
@@ -102,32 +126,130 @@ func decodeBase64(s string) ([]byte, error) {
 
 // aes stuff
 
-func encryptAes(hexKey string, text string) string {
+// Ciphertexts starting with this prefix are AES-GCM encrypted, ciphertexts
+// without a prefix are AES-CFB encrypted by older versions and can only be
+// decrypted
+const AES_GCM_PREFIX = "2$"
+
+// Ciphertexts starting with this prefix are AES-GCM encrypted and carry the id
+// of their key, i.e. 3$<key id>$<base64 encoded nonce and ciphertext>
+const AES_GCM_KEY_ID_PREFIX = "3$"
+
+// Returns an id of hexKey that can be stored along with ciphertexts
+func aesKeyId(hexKey string) string {
+	hash := sha256.Sum256([]byte("bitverse-key-id:" + strings.ToLower(hexKey)))
+	return encodeHex(hash[:8])
+}
+
+// Returns the key id of a ciphertext created by encryptAesWithKeyId
+func aesCiphertextKeyId(ciphertext string) (string, bool) {
+	if !strings.HasPrefix(ciphertext, AES_GCM_KEY_ID_PREFIX) {
+		return "", false
+	}
+
+	keyId := ciphertext[len(AES_GCM_KEY_ID_PREFIX):]
+	end := strings.Index(keyId, "$")
+	if end < 0 {
+		return "", false
+	}
+	return keyId[:end], true
+}
+
+func checkAesKey(hexKey string) error {
 	key, err := hex2Bin(hexKey)
 	if err != nil {
-		panic(err)
+		return errors.New("aes key is not hex encoded")
 	}
 
-	block, err := aes.NewCipher([]byte(key))
+	_, err = aes.NewCipher(key)
+	return err
+}
+
+// Encrypts and authenticates text with AES-GCM, additionalData is not
+// encrypted but must be the same when decrypting, e.g. message header fields.
+// The key must have been checked with checkAesKey.
+func encryptAes(hexKey string, text string, additionalData string) string {
+	gcm, err := makeAesGcm(hexKey)
 	if err != nil {
 		panic(err)
 	}
 
-	b := encodeBase64([]byte(text))
-	ciphertext := make([]byte, aes.BlockSize+len(b))
-	iv := ciphertext[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(text)+gcm.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		panic(err)
 	}
-	cfb := cipher.NewCFBEncrypter(block, iv)
-	cfb.XORKeyStream(ciphertext[aes.BlockSize:], []byte(b))
-	return encodeBase64(ciphertext)
+
+	ciphertext := gcm.Seal(nonce, nonce, []byte(text), []byte(additionalData))
+	return AES_GCM_PREFIX + encodeBase64(ciphertext)
+}
+
+// Like encryptAes, but stores the id of the key in the ciphertext so that the
+// key can be picked when there are several
+func encryptAesWithKeyId(hexKey string, text string, additionalData string) string {
+	ciphertext := encryptAes(hexKey, text, additionalData)
+	return AES_GCM_KEY_ID_PREFIX + aesKeyId(hexKey) + "$" + ciphertext[len(AES_GCM_PREFIX):]
+}
+
+// Returns an error if ciphertext has been tampered with, was encrypted with
+// another key or additional data, or is malformed
+func decryptAes(hexKey string, ciphertext string, additionalData string) (string, error) {
+	if keyId, ok := aesCiphertextKeyId(ciphertext); ok {
+		ciphertext = AES_GCM_PREFIX + ciphertext[len(AES_GCM_KEY_ID_PREFIX)+len(keyId)+1:]
+	} else if strings.HasPrefix(ciphertext, AES_GCM_KEY_ID_PREFIX) {
+		return "", errors.New("ciphertext is missing key id")
+	}
+
+	if !strings.HasPrefix(ciphertext, AES_GCM_PREFIX) {
+		return "", errors.New("ciphertext is not authenticated")
+	}
+
+	gcm, err := makeAesGcm(hexKey)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := decodeBase64(ciphertext[len(AES_GCM_PREFIX):])
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+
+	text, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(additionalData))
+	if err != nil {
+		return "", errors.New("failed to decrypt, the ciphertext is not authentic")
+	}
+	return string(text), nil
 }
 
-func decryptAes(hexKey string, ciphertext string) (string, error) {
+func makeAesGcm(hexKey string) (cipher.AEAD, error) {
 	key, err := hex2Bin(hexKey)
 	if err != nil {
-		panic(err)
+		return nil, errors.New("aes key is not hex encoded")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Like decryptAes, but also accepts the unauthenticated AES-CFB format used by
+// older versions, which may have been tampered with
+func decryptAesLegacy(hexKey string, ciphertext string, additionalData string) (string, error) {
+	if !strings.HasPrefix(ciphertext, AES_GCM_PREFIX) && !strings.HasPrefix(ciphertext, AES_GCM_KEY_ID_PREFIX) {
+		return decryptAesCfb(hexKey, ciphertext)
+	}
+	return decryptAes(hexKey, ciphertext, additionalData)
+}
+
+func decryptAesCfb(hexKey string, ciphertext string) (string, error) {
+	key, err := hex2Bin(hexKey)
+	if err != nil {
+		return "", errors.New("aes key is not hex encoded")
 	}
 
 	text, err := decodeBase64(ciphertext)
@@ -135,12 +257,12 @@ func decryptAes(hexKey string, ciphertext string) (string, error) {
 		return "", err
 	}
 
-	block, err := aes.NewCipher([]byte(key))
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
 	if len(text) < aes.BlockSize {
-		panic("ciphertext too short")
+		return "", errors.New("ciphertext too short")
 	}
 	iv := text[:aes.BlockSize]
 	text = text[aes.BlockSize:]
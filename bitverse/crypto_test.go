@@ -0,0 +1,86 @@
+package bitverse
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Encrypts text in the AES-CFB format used by older versions
+func encryptAesCfb(t *testing.T, hexKey string, text string) string {
+	key, _ := hex2Bin(hexKey)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := encodeBase64([]byte(text))
+	ciphertext := make([]byte, aes.BlockSize+len(b))
+	iv := ciphertext[:aes.BlockSize]
+	io.ReadFull(rand.Reader, iv)
+	cfb := cipher.NewCFBEncrypter(block, iv)
+	cfb.XORKeyStream(ciphertext[aes.BlockSize:], []byte(b))
+	return encodeBase64(ciphertext)
+}
+
+func TestAesGcm(t *testing.T) {
+	secret, _ := GenerateAesSecret()
+	otherSecret, _ := GenerateAesSecret()
+
+	ciphertext := encryptAes(secret, "hello", "msg:a:b")
+	if !strings.HasPrefix(ciphertext, AES_GCM_PREFIX) {
+		t.Error("expected versioned ciphertext, got " + ciphertext)
+	}
+
+	text, err := decryptAes(secret, ciphertext, "msg:a:b")
+	if err != nil || text != "hello" {
+		t.Error("failed to decrypt")
+	}
+
+	if _, err := decryptAes(secret, ciphertext, "msg:a:c"); err == nil {
+		t.Error("expected decryption with other additional data to fail")
+	}
+
+	if _, err := decryptAes(otherSecret, ciphertext, "msg:a:b"); err == nil {
+		t.Error("expected decryption with other key to fail")
+	}
+
+	data, _ := decodeBase64(ciphertext[len(AES_GCM_PREFIX):])
+	data[len(data)-1] ^= 1
+	if _, err := decryptAes(secret, AES_GCM_PREFIX+encodeBase64(data), "msg:a:b"); err == nil {
+		t.Error("expected decryption of tampered ciphertext to fail")
+	}
+
+	if _, err := decryptAes(secret, AES_GCM_PREFIX+encodeBase64([]byte("short")), "msg:a:b"); err == nil {
+		t.Error("expected decryption of truncated ciphertext to fail")
+	}
+
+	if _, err := decryptAes("not hex", ciphertext, "msg:a:b"); err == nil {
+		t.Error("expected decryption with bad key to fail")
+	}
+}
+
+func TestAesLegacyCfb(t *testing.T) {
+	secret, _ := GenerateAesSecret()
+
+	ciphertext := encryptAesCfb(t, secret, "hello")
+	if _, err := decryptAes(secret, ciphertext, "ignored"); err == nil {
+		t.Error("expected unauthenticated ciphertext to be rejected")
+	}
+
+	text, err := decryptAesLegacy(secret, ciphertext, "ignored")
+	if err != nil || text != "hello" {
+		t.Error("failed to decrypt legacy ciphertext")
+	}
+
+	if _, err := decryptAesLegacy(secret, encodeBase64([]byte("short")), ""); err == nil {
+		t.Error("expected decryption of truncated legacy ciphertext to fail")
+	}
+
+	if checkAesKey(secret) != nil || checkAesKey("abcd") == nil || checkAesKey("xyz") == nil {
+		t.Error("unexpected key check result")
+	}
+}
@@ -0,0 +1,369 @@
+/*  The MIT License (MIT)
+
+Copyright (c) 2014 Luleå University of Technology, Sweden
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE. */
+
+package dht
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Vnode struct {
+	Id   []byte // Virtual ID
+	Host string // Host identifier
+}
+
+// Converts the ID to string
+func (vn *Vnode) String() string {
+	return fmt.Sprintf("%x", vn.Id)
+}
+
+// Generates an ID for the node
+func (vn *Vnode) genId(idx uint16, conf *Config) {
+	hash := conf.HashFunc()
+	hash.Write([]byte(conf.Hostname))
+	binary.Write(hash, binary.BigEndian, idx)
+
+	// Use the hash as the ID
+	vn.Id = hash.Sum(nil)
+}
+
+// Configuration for Chord nodes
+type Config struct {
+	Hostname      string           // Local host name
+	NumVnodes     int              // Number of vnodes per physical node
+	HashFunc      func() hash.Hash // Hash function to use
+	StabilizeMin  time.Duration    // Minimum stabilization time
+	StabilizeMax  time.Duration    // Maximum stabilization time
+	NumSuccessors int              // Number of successors to maintain
+	Delegate      Delegate         // Invoked to handle ring events
+	hashBits      int              // Bit size of the hash function
+}
+
+// Delegate to notify on ring events
+type Delegate interface {
+	NewPredecessor(local, remoteNew, remotePrev *Vnode)
+	Leaving(local, pred, succ *Vnode)
+	PredecessorLeaving(local, remote *Vnode)
+	SuccessorLeaving(local, remote *Vnode)
+	Shutdown()
+}
+
+// Returns the default Ring configuration
+func DefaultConfig(hostname string) *Config {
+	return &Config{
+		hostname,
+		8,        // 8 vnodes
+		sha1.New, // SHA1
+		time.Duration(15 * time.Second),
+		time.Duration(45 * time.Second),
+		8,   // 8 successors
+		nil, // No delegate
+		160, // 160bit hash function
+	}
+}
+
+// A Ring is the local view of a Chord ring, i.e. the vnodes hosted by this
+// physical node
+type Ring struct {
+	config       *Config
+	transport    Transport
+	vnodes       []*localVnode
+	delegateCh   chan func()
+	delegateDone chan bool // closed when the delegate is stopped
+	delegateOnce sync.Once
+	shutdown     chan bool
+	stopped      bool
+}
+
+// Creates a new Chord ring with this node as its only member
+func Create(conf *Config, transport Transport) (*Ring, error) {
+	ring := new(Ring)
+	if err := ring.init(conf, transport); err != nil {
+		return nil, err
+	}
+
+	ring.setLocalSuccessors()
+	ring.schedule()
+	return ring, nil
+}
+
+// Joins an existing Chord ring, existing is the host name of any node already
+// in the ring
+func Join(conf *Config, transport Transport, existing string) (*Ring, error) {
+	ring := new(Ring)
+	if err := ring.init(conf, transport); err != nil {
+		return nil, err
+	}
+
+	if err := ring.join(existing); err != nil {
+		// the vnodes have not been scheduled yet
+		ring.deregisterVnodes()
+		ring.stopDelegate()
+		return nil, err
+	}
+
+	ring.schedule()
+	return ring, nil
+}
+
+// Returns the n closest successors of the given key
+func (ring *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
+	if n > ring.config.NumSuccessors {
+		return nil, fmt.Errorf("dht: cannot ask for more successors than NumSuccessors (%d)", ring.config.NumSuccessors)
+	}
+
+	hash := ring.config.HashFunc()
+	hash.Write(key)
+	keyHash := hash.Sum(nil)
+
+	nearest := ring.nearestVnode(keyHash)
+	successors, err := nearest.FindSuccessors(n, keyHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(successors) > n {
+		successors = successors[:n]
+	}
+	return successors, nil
+}
+
+// Returns the vnode responsible for the given key
+func (ring *Ring) FindSuccessor(key []byte) (*Vnode, error) {
+	successors, err := ring.Lookup(1, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(successors) == 0 {
+		return nil, errors.New("dht: no successor found")
+	}
+	return successors[0], nil
+}
+
+// Returns the local vnodes
+func (ring *Ring) Vnodes() []*Vnode {
+	vnodes := make([]*Vnode, len(ring.vnodes))
+	for i, vn := range ring.vnodes {
+		vnodes[i] = &vn.Vnode
+	}
+	return vnodes
+}
+
+// Gracefully leaves the ring, the successors and predecessors of the local
+// vnodes are informed so that they can close the gap
+func (ring *Ring) Leave() error {
+	ring.stopVnodes()
+
+	var errs []error
+	for _, vn := range ring.vnodes {
+		if err := vn.leave(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	ring.deregisterVnodes()
+	ring.stopDelegate()
+	return mergeErrors(errs)
+}
+
+// Stops all local vnodes without notifying the rest of the ring
+func (ring *Ring) Shutdown() {
+	ring.stopVnodes()
+	ring.deregisterVnodes()
+	ring.stopDelegate()
+}
+
+/// PRIVATE
+
+func (ring *Ring) init(conf *Config, transport Transport) error {
+	if conf.NumVnodes <= 0 {
+		return errors.New("dht: NumVnodes must be positive")
+	}
+	if conf.NumSuccessors <= 0 {
+		return errors.New("dht: NumSuccessors must be positive")
+	}
+	if conf.StabilizeMin <= 0 || conf.StabilizeMax < conf.StabilizeMin {
+		return errors.New("dht: invalid stabilization interval")
+	}
+	if conf.hashBits == 0 {
+		conf.hashBits = conf.HashFunc().Size() * 8
+	}
+
+	ring.config = conf
+	ring.transport = transport
+	ring.shutdown = make(chan bool, conf.NumVnodes)
+
+	ring.vnodes = make([]*localVnode, conf.NumVnodes)
+	for i := 0; i < conf.NumVnodes; i++ {
+		vn := new(localVnode)
+		vn.ring = ring
+		vn.init(i)
+		ring.vnodes[i] = vn
+	}
+	sort.Sort(vnodesById(ring.vnodes))
+
+	if conf.Delegate != nil {
+		ring.delegateCh = make(chan func(), 32)
+		ring.delegateDone = make(chan bool)
+		go ring.delegateHandler()
+	}
+
+	return nil
+}
+
+// Asks the ring existing is in about the successors of our vnodes
+func (ring *Ring) join(existing string) error {
+	hosts, err := ring.transport.ListVnodes(existing)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return errors.New("dht: remote host has no vnodes")
+	}
+
+	// ask the closest remote vnode about the successors of each of our vnodes
+	for _, vn := range ring.vnodes {
+		nearest := nearestVnodeToKey(hosts, vn.Id)
+		successors, err := ring.transport.FindSuccessors(nearest, ring.config.NumSuccessors, vn.Id)
+		if err != nil {
+			return err
+		}
+		if len(successors) == 0 {
+			return errors.New("dht: failed to find successors for vnode " + vn.String())
+		}
+		vn.lock.Lock()
+		copy(vn.successors, successors)
+		vn.lock.Unlock()
+	}
+	return nil
+}
+
+// Initially the successor of every local vnode is the next local vnode
+func (ring *Ring) setLocalSuccessors() {
+	numV := len(ring.vnodes)
+	numSuc := min(ring.config.NumSuccessors, numV-1)
+	for idx, vn := range ring.vnodes {
+		vn.lock.Lock()
+		if numSuc == 0 {
+			vn.successors[0] = &vn.Vnode
+		}
+		for i := 0; i < numSuc; i++ {
+			vn.successors[i] = &ring.vnodes[(idx+i+1)%numV].Vnode
+		}
+		vn.lock.Unlock()
+	}
+}
+
+func (ring *Ring) schedule() {
+	for _, vn := range ring.vnodes {
+		vn.schedule()
+	}
+}
+
+func (ring *Ring) stopVnodes() {
+	if ring.stopped {
+		return
+	}
+	ring.stopped = true
+
+	for _, vn := range ring.vnodes {
+		vn.stop()
+	}
+
+	// wait for any ongoing stabilization to notice the shutdown
+	for i := 0; i < ring.config.NumVnodes; i++ {
+		<-ring.shutdown
+	}
+}
+
+func (ring *Ring) deregisterVnodes() {
+	for _, vn := range ring.vnodes {
+		ring.transport.Deregister(&vn.Vnode)
+	}
+}
+
+// Stops the delegate after the events queued so far, the delegate is told by
+// its Shutdown method. Events invoked afterwards are dropped.
+func (ring *Ring) stopDelegate() {
+	if ring.delegateCh != nil {
+		ring.delegateOnce.Do(func() { close(ring.delegateDone) })
+	}
+}
+
+// Queues an event for the delegate, must not be called while holding the lock
+// of a vnode since the queue may be full
+func (ring *Ring) invokeDelegate(f func()) {
+	if ring.delegateCh == nil {
+		return
+	}
+	select {
+	case <-ring.delegateDone:
+	default:
+		select {
+		case ring.delegateCh <- f:
+		case <-ring.delegateDone:
+		}
+	}
+}
+
+func (ring *Ring) delegateHandler() {
+	for {
+		select {
+		case f := <-ring.delegateCh:
+			f()
+		case <-ring.delegateDone:
+			for {
+				select {
+				case f := <-ring.delegateCh:
+					f()
+				default:
+					ring.config.Delegate.Shutdown()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Returns the local vnode that is closest to preceding the key
+func (ring *Ring) nearestVnode(key []byte) *localVnode {
+	for i := len(ring.vnodes) - 1; i >= 0; i-- {
+		if bytesLess(ring.vnodes[i].Id, key) {
+			return ring.vnodes[i]
+		}
+	}
+	// wrap around
+	return ring.vnodes[len(ring.vnodes)-1]
+}
+
+type vnodesById []*localVnode
+
+func (vns vnodesById) Len() int           { return len(vns) }
+func (vns vnodesById) Less(i, j int) bool { return bytesLess(vns[i].Id, vns[j].Id) }
+func (vns vnodesById) Swap(i, j int)      { vns[i], vns[j] = vns[j], vns[i] }
@@ -20,92 +20,38 @@ LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
 OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 THE SOFTWARE. */
 
-package soil
+package dht
 
 import (
-	//"bytes"
-	"crypto/sha1"
-	"encoding/binary"
+	"bytes"
 	"fmt"
-	"hash"
 	"math/big"
 	"testing"
 	"time"
 )
 
-type Vnode struct {
-	Id   []byte // Virtual ID
-	Host string // Host identifier
+func testConfig(hostname string) *Config {
+	conf := DefaultConfig(hostname)
+	conf.NumVnodes = 4
+	conf.StabilizeMin = time.Duration(10 * time.Millisecond)
+	conf.StabilizeMax = time.Duration(30 * time.Millisecond)
+	return conf
 }
 
-// Converts the ID to string
-func (vn *Vnode) String() string {
-	return fmt.Sprintf("%x", vn.Id)
-}
-
-// Generates an ID for the node
-func (vn *Vnode) genId(idx uint16, conf *Config) {
-	hash := conf.HashFunc()
-	hash.Write([]byte(conf.Hostname))
-	binary.Write(hash, binary.BigEndian, idx)
-
-	// Use the hash as the ID
-	vn.Id = hash.Sum(nil)
-}
-
-// Configuration for Chord nodes
-type Config struct {
-	Hostname      string           // Local host name
-	NumVnodes     int              // Number of vnodes per physical node
-	HashFunc      func() hash.Hash // Hash function to use
-	StabilizeMin  time.Duration    // Minimum stabilization time
-	StabilizeMax  time.Duration    // Maximum stabilization time
-	NumSuccessors int              // Number of successors to maintain
-	Delegate      Delegate         // Invoked to handle ring events
-	hashBits      int              // Bit size of the hash function
-}
-
-// Delegate to notify on ring events
-type Delegate interface {
-	/*NewPredecessor(local, remoteNew, remotePrev *Vnode)
-	Leaving(local, pred, succ *Vnode)
-	PredecessorLeaving(local, remote *Vnode)
-	SuccessorLeaving(local, remote *Vnode)
-	Shutdown() */
-}
-
-// Returns the default Ring configuration
-func DefaultConfig(hostname string) *Config {
-	return &Config{
-		hostname,
-		8,        // 8 vnodes
-		sha1.New, // SHA1
-		time.Duration(15 * time.Second),
-		time.Duration(45 * time.Second),
-		8,   // 8 successors
-		nil, // No delegate
-		160, // 160bit hash function
+// Returns the vnode that should be responsible for the hashed key
+func expectedSuccessor(rings []*Ring, key []byte) *Vnode {
+	var vnodes []*Vnode
+	for _, ring := range rings {
+		vnodes = append(vnodes, ring.Vnodes()...)
 	}
-}
-
-// Computes the forward distance from a to b modulus a ring size
-func distance(a, b []byte, bits int) *big.Int {
-	// Get the ring size
-	var ring big.Int
-	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
-
-	// Convert to int
-	var a_int, b_int big.Int
-	(&a_int).SetBytes(a)
-	(&b_int).SetBytes(b)
 
-	// Compute the distances
-	var dist big.Int
-	(&dist).Sub(&b_int, &a_int)
-
-	// Distance modulus ring size
-	(&dist).Mod(&dist, &ring)
-	return &dist
+	var closest *Vnode
+	for _, vn := range vnodes {
+		if closest == nil || distance(key, vn.Id, 160).Cmp(distance(key, closest.Id, 160)) < 0 {
+			closest = vn
+		}
+	}
+	return closest
 }
 
 func TestDistance(t *testing.T) {
@@ -139,13 +85,128 @@ func TestDistance(t *testing.T) {
 	}
 }
 
-/*func main() {
-	fmt.Println("testing")
-	conf := DefaultConfig("localhost")
-	//v := &Vnode{Id: []byte{59}, "localhost"}
-	v := &Vnode{}
+func TestCreateRing(t *testing.T) {
+	ring, err := Create(testConfig("localhost:1111"), MakeLocalTransport(nil))
+	if err != nil {
+		t.Fatalf("failed to create ring: %v", err)
+	}
+	defer ring.Shutdown()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		vn, err := ring.FindSuccessor(key)
+		if err != nil {
+			t.Fatalf("failed to find successor: %v", err)
+		}
+
+		hash := ring.config.HashFunc()
+		hash.Write(key)
+		expected := expectedSuccessor([]*Ring{ring}, hash.Sum(nil))
+		if !bytes.Equal(vn.Id, expected.Id) {
+			t.Fatalf("expected successor %s, got %s", expected, vn)
+		}
+	}
+}
+
+func TestJoinRing(t *testing.T) {
+	transport := MakeLocalTransport(nil)
 
-	idx := 10
-	v.genId(uint16(idx), conf)
-	fmt.Println(v)
-} */
+	first, err := Create(testConfig("localhost:1111"), transport)
+	if err != nil {
+		t.Fatalf("failed to create ring: %v", err)
+	}
+	defer first.Shutdown()
+
+	rings := []*Ring{first}
+	for i := 0; i < 3; i++ {
+		ring, err := Join(testConfig(fmt.Sprintf("localhost:%d", 2222+i)), transport, "localhost:1111")
+		if err != nil {
+			t.Fatalf("failed to join ring: %v", err)
+		}
+		defer ring.Shutdown()
+		rings = append(rings, ring)
+	}
+
+	// let the ring stabilize
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		hash := first.config.HashFunc()
+		hash.Write(key)
+		expected := expectedSuccessor(rings, hash.Sum(nil))
+
+		for _, ring := range rings {
+			vn, err := ring.FindSuccessor(key)
+			if err != nil {
+				t.Fatalf("failed to find successor: %v", err)
+			}
+			if !bytes.Equal(vn.Id, expected.Id) {
+				t.Fatalf("expected successor %s, got %s", expected, vn)
+			}
+		}
+	}
+}
+
+func TestLeaveRing(t *testing.T) {
+	transport := MakeLocalTransport(nil)
+
+	first, err := Create(testConfig("localhost:1111"), transport)
+	if err != nil {
+		t.Fatalf("failed to create ring: %v", err)
+	}
+	defer first.Shutdown()
+
+	second, err := Join(testConfig("localhost:2222"), transport, "localhost:1111")
+	if err != nil {
+		t.Fatalf("failed to join ring: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	if err := second.Leave(); err != nil {
+		t.Fatalf("failed to leave ring: %v", err)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		vn, err := first.FindSuccessor([]byte(fmt.Sprintf("key%d", i)))
+		if err != nil {
+			t.Fatalf("failed to find successor: %v", err)
+		}
+		if vn.Host != "localhost:1111" {
+			t.Fatalf("expected only localhost:1111 to remain, got %s", vn.Host)
+		}
+	}
+}
+
+type shutdownDelegate struct {
+	shutdown chan bool
+}
+
+func (delegate *shutdownDelegate) NewPredecessor(local, remoteNew, remotePrev *Vnode) {}
+func (delegate *shutdownDelegate) Leaving(local, pred, succ *Vnode)                   {}
+func (delegate *shutdownDelegate) PredecessorLeaving(local, remote *Vnode)            {}
+func (delegate *shutdownDelegate) SuccessorLeaving(local, remote *Vnode)              {}
+func (delegate *shutdownDelegate) Shutdown()                                          { delegate.shutdown <- true }
+
+func TestJoinFailureCleansUp(t *testing.T) {
+	transport := MakeLocalTransport(nil)
+	delegate := &shutdownDelegate{make(chan bool, 1)}
+
+	conf := testConfig("localhost:1111")
+	conf.Delegate = delegate
+	if _, err := Join(conf, transport, "localhost:2222"); err == nil {
+		t.Fatal("expected joining a missing ring to fail")
+	}
+
+	select {
+	case <-delegate.shutdown:
+	case <-time.After(time.Second):
+		t.Fatal("expected the delegate to be shut down")
+	}
+	if len(transport.local) != 0 {
+		t.Fatal("expected the vnodes to be deregistered")
+	}
+}
@@ -0,0 +1,198 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+)
+
+// Transport is used by the ring to talk to remote vnodes
+type Transport interface {
+	// Returns the vnodes hosted by a host
+	ListVnodes(host string) ([]*Vnode, error)
+
+	// Checks if a vnode is alive
+	Ping(vn *Vnode) (bool, error)
+
+	// Asks a vnode for its predecessor
+	GetPredecessor(vn *Vnode) (*Vnode, error)
+
+	// Tells a vnode that self might be its predecessor, returns its successors
+	Notify(target, self *Vnode) ([]*Vnode, error)
+
+	// Finds the n successors of a key, starting at the given vnode
+	FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error)
+
+	// Tells a vnode that its predecessor is leaving
+	ClearPredecessor(target, self *Vnode) error
+
+	// Tells a vnode that its successor is leaving
+	SkipSuccessor(target, self *Vnode) error
+
+	// Registers a local vnode so that it can receive calls
+	Register(vn *Vnode, o VnodeRPC)
+
+	// Removes a local vnode
+	Deregister(vn *Vnode)
+}
+
+// VnodeRPC is the interface implemented by local vnodes, a transport invokes
+// these when receiving calls from remote vnodes
+type VnodeRPC interface {
+	GetPredecessor() (*Vnode, error)
+	Notify(maybePredecessor *Vnode) ([]*Vnode, error)
+	FindSuccessors(n int, key []byte) ([]*Vnode, error)
+	ClearPredecessor(predecessor *Vnode) error
+	SkipSuccessor(successor *Vnode) error
+}
+
+// LocalTransport calls local vnodes directly and forwards everything else to
+// a remote transport. Several rings sharing the same LocalTransport can talk to
+// each other without any networking, which is handy for testing.
+type LocalTransport struct {
+	remote Transport
+	lock   sync.RWMutex
+	local  map[string]*localRPC
+}
+
+type localRPC struct {
+	vnode *Vnode
+	obj   VnodeRPC
+}
+
+func MakeLocalTransport(remote Transport) *LocalTransport {
+	if remote == nil {
+		remote = new(blackholeTransport)
+	}
+
+	localTransport := new(LocalTransport)
+	localTransport.remote = remote
+	localTransport.local = make(map[string]*localRPC)
+	return localTransport
+}
+
+func (localTransport *LocalTransport) ListVnodes(host string) ([]*Vnode, error) {
+	localTransport.lock.RLock()
+	var vnodes []*Vnode
+	for _, rpc := range localTransport.local {
+		if rpc.vnode.Host == host {
+			vnodes = append(vnodes, rpc.vnode)
+		}
+	}
+	localTransport.lock.RUnlock()
+
+	if len(vnodes) > 0 {
+		return vnodes, nil
+	}
+	return localTransport.remote.ListVnodes(host)
+}
+
+func (localTransport *LocalTransport) Ping(vn *Vnode) (bool, error) {
+	if _, ok := localTransport.get(vn); ok {
+		return true, nil
+	}
+	return localTransport.remote.Ping(vn)
+}
+
+func (localTransport *LocalTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	if obj, ok := localTransport.get(vn); ok {
+		return obj.GetPredecessor()
+	}
+	return localTransport.remote.GetPredecessor(vn)
+}
+
+func (localTransport *LocalTransport) Notify(target, self *Vnode) ([]*Vnode, error) {
+	if obj, ok := localTransport.get(target); ok {
+		return obj.Notify(self)
+	}
+	return localTransport.remote.Notify(target, self)
+}
+
+func (localTransport *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error) {
+	if obj, ok := localTransport.get(vn); ok {
+		return obj.FindSuccessors(n, key)
+	}
+	return localTransport.remote.FindSuccessors(vn, n, key)
+}
+
+func (localTransport *LocalTransport) ClearPredecessor(target, self *Vnode) error {
+	if obj, ok := localTransport.get(target); ok {
+		return obj.ClearPredecessor(self)
+	}
+	return localTransport.remote.ClearPredecessor(target, self)
+}
+
+func (localTransport *LocalTransport) SkipSuccessor(target, self *Vnode) error {
+	if obj, ok := localTransport.get(target); ok {
+		return obj.SkipSuccessor(self)
+	}
+	return localTransport.remote.SkipSuccessor(target, self)
+}
+
+func (localTransport *LocalTransport) Register(vn *Vnode, o VnodeRPC) {
+	localTransport.lock.Lock()
+	localTransport.local[vn.String()] = &localRPC{vn, o}
+	localTransport.lock.Unlock()
+
+	localTransport.remote.Register(vn, o)
+}
+
+func (localTransport *LocalTransport) Deregister(vn *Vnode) {
+	localTransport.lock.Lock()
+	delete(localTransport.local, vn.String())
+	localTransport.lock.Unlock()
+
+	localTransport.remote.Deregister(vn)
+}
+
+/// PRIVATE
+
+func (localTransport *LocalTransport) get(vn *Vnode) (VnodeRPC, bool) {
+	localTransport.lock.RLock()
+	defer localTransport.lock.RUnlock()
+
+	rpc, ok := localTransport.local[vn.String()]
+	if !ok {
+		return nil, false
+	}
+	return rpc.obj, true
+}
+
+// Used when there is no remote transport, every remote call fails
+type blackholeTransport struct {
+}
+
+var errBlackhole = errors.New("dht: no route to remote vnode")
+
+func (*blackholeTransport) ListVnodes(host string) ([]*Vnode, error) {
+	return nil, errBlackhole
+}
+
+func (*blackholeTransport) Ping(vn *Vnode) (bool, error) {
+	return false, nil
+}
+
+func (*blackholeTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	return nil, errBlackhole
+}
+
+func (*blackholeTransport) Notify(target, self *Vnode) ([]*Vnode, error) {
+	return nil, errBlackhole
+}
+
+func (*blackholeTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error) {
+	return nil, errBlackhole
+}
+
+func (*blackholeTransport) ClearPredecessor(target, self *Vnode) error {
+	return errBlackhole
+}
+
+func (*blackholeTransport) SkipSuccessor(target, self *Vnode) error {
+	return errBlackhole
+}
+
+func (*blackholeTransport) Register(vn *Vnode, o VnodeRPC) {
+}
+
+func (*blackholeTransport) Deregister(vn *Vnode) {
+}
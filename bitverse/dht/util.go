@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Computes the forward distance from a to b modulus a ring size
+func distance(a, b []byte, bits int) *big.Int {
+	// Get the ring size
+	var ring big.Int
+	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
+
+	// Convert to int
+	var a_int, b_int big.Int
+	(&a_int).SetBytes(a)
+	(&b_int).SetBytes(b)
+
+	// Compute the distances
+	var dist big.Int
+	(&dist).Sub(&b_int, &a_int)
+
+	// Distance modulus ring size
+	(&dist).Mod(&dist, &ring)
+	return &dist
+}
+
+// Checks if key is in the open interval (id1, id2) on the ring
+func between(id1, id2, key []byte) bool {
+	switch bytes.Compare(id1, id2) {
+	case 0: // the interval covers the whole ring
+		return !bytes.Equal(id1, key)
+	case 1: // the interval wraps around
+		return bytes.Compare(id1, key) == -1 || bytes.Compare(id2, key) == 1
+	}
+	return bytes.Compare(id1, key) == -1 && bytes.Compare(id2, key) == 1
+}
+
+// Checks if key is in the interval (id1, id2] on the ring
+func betweenRightIncl(id1, id2, key []byte) bool {
+	switch bytes.Compare(id1, id2) {
+	case 0:
+		return true
+	case 1:
+		return bytes.Compare(id1, key) == -1 || bytes.Compare(id2, key) >= 0
+	}
+	return bytes.Compare(id1, key) == -1 && bytes.Compare(id2, key) >= 0
+}
+
+// Computes (id + 2^exp) % 2^bits
+func powerOffset(id []byte, exp int, bits int) []byte {
+	var offset big.Int
+	offset.Exp(big.NewInt(2), big.NewInt(int64(exp)), nil)
+
+	var ring big.Int
+	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
+
+	var idInt big.Int
+	idInt.SetBytes(id)
+	idInt.Add(&idInt, &offset)
+	idInt.Mod(&idInt, &ring)
+
+	// pad to the same length as the id
+	result := idInt.Bytes()
+	padded := make([]byte, len(id))
+	copy(padded[len(padded)-len(result):], result)
+	return padded
+}
+
+// Returns a random stabilization interval between StabilizeMin and StabilizeMax
+func randStabilize(conf *Config) time.Duration {
+	min := conf.StabilizeMin
+	max := conf.StabilizeMax
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// Returns the vnode that is closest to preceding the key
+func nearestVnodeToKey(vnodes []*Vnode, key []byte) *Vnode {
+	var nearest *Vnode
+	for _, vn := range vnodes {
+		if nearest == nil || distance(vn.Id, key, len(key)*8).Cmp(distance(nearest.Id, key, len(key)*8)) < 0 {
+			nearest = vn
+		}
+	}
+	return nearest
+}
+
+func bytesLess(a, b []byte) bool {
+	return bytes.Compare(a, b) == -1
+}
+
+func mergeErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
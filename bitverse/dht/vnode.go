@@ -0,0 +1,414 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A vnode hosted by the local node
+type localVnode struct {
+	Vnode
+	ring        *Ring
+	lock        sync.Mutex
+	successors  []*Vnode
+	finger      []*Vnode
+	lastFinger  int
+	predecessor *Vnode
+	stabilized  time.Time
+	timer       *time.Timer
+	stopped     bool
+}
+
+func (vn *localVnode) init(idx int) {
+	vn.genId(uint16(idx), vn.ring.config)
+	vn.Host = vn.ring.config.Hostname
+	vn.successors = make([]*Vnode, vn.ring.config.NumSuccessors)
+	vn.finger = make([]*Vnode, vn.ring.config.hashBits)
+
+	vn.ring.transport.Register(&vn.Vnode, vn)
+}
+
+// Schedules the next stabilization at a random time between StabilizeMin and
+// StabilizeMax
+func (vn *localVnode) schedule() {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if !vn.stopped {
+		vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	}
+}
+
+func (vn *localVnode) stop() {
+	vn.lock.Lock()
+	vn.stopped = true
+	timer := vn.timer
+	vn.lock.Unlock()
+
+	if timer != nil && timer.Stop() {
+		vn.ring.shutdown <- true // no stabilization in progress
+	}
+}
+
+func (vn *localVnode) stabilize() {
+	if err := vn.checkNewSuccessor(); err != nil {
+		log.Println("dht: vnode " + vn.String() + " failed to check for a new successor: " + err.Error())
+	}
+
+	if err := vn.notifySuccessor(); err != nil {
+		log.Println("dht: vnode " + vn.String() + " failed to notify its successor: " + err.Error())
+	}
+
+	if err := vn.fixFingerTable(); err != nil {
+		log.Println("dht: vnode " + vn.String() + " failed to fix its finger table: " + err.Error())
+	}
+
+	if err := vn.checkPredecessor(); err != nil {
+		log.Println("dht: vnode " + vn.String() + " failed to check its predecessor: " + err.Error())
+	}
+
+	vn.lock.Lock()
+	vn.stabilized = time.Now()
+	stopped := vn.stopped
+	if !stopped {
+		vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	}
+	vn.lock.Unlock()
+
+	if stopped {
+		vn.ring.shutdown <- true
+	}
+}
+
+// Checks if the predecessor of our successor should be our new successor
+func (vn *localVnode) checkNewSuccessor() error {
+	transport := vn.ring.transport
+	for {
+		successor := vn.successor()
+		if successor == nil {
+			return errors.New("dht: vnode has no successor")
+		}
+
+		maybeSuccessor, err := transport.GetPredecessor(successor)
+		if err != nil {
+			// the successor might be gone, try the next one
+			if alive, _ := transport.Ping(successor); alive {
+				return err
+			}
+
+			vn.lock.Lock()
+			if vn.knownSuccessors() <= 1 {
+				vn.lock.Unlock()
+				return err
+			}
+			copy(vn.successors, vn.successors[1:])
+			vn.successors[len(vn.successors)-1] = nil
+			vn.lock.Unlock()
+			continue
+		}
+
+		if maybeSuccessor != nil && between(vn.Id, successor.Id, maybeSuccessor.Id) {
+			alive, err := transport.Ping(maybeSuccessor)
+			if err != nil {
+				return err
+			}
+			if alive {
+				vn.lock.Lock()
+				copy(vn.successors[1:], vn.successors[:len(vn.successors)-1])
+				vn.successors[0] = maybeSuccessor
+				vn.lock.Unlock()
+			}
+		}
+		return nil
+	}
+}
+
+// Tells our successor that we might be its predecessor and adopts its
+// successor list
+func (vn *localVnode) notifySuccessor() error {
+	successor := vn.successor()
+	if successor == nil {
+		return errors.New("dht: vnode has no successor")
+	}
+
+	successors, err := vn.ring.transport.Notify(successor, &vn.Vnode)
+	if err != nil {
+		return err
+	}
+
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+
+	max := len(vn.successors) - 1
+	if len(successors) > max {
+		successors = successors[:max]
+	}
+
+	for i := 0; i < max; i++ {
+		if i >= len(successors) || successors[i] == nil || bytes.Equal(successors[i].Id, vn.Id) {
+			// we have wrapped around the ring
+			for j := i + 1; j < len(vn.successors); j++ {
+				vn.successors[j] = nil
+			}
+			break
+		}
+		vn.successors[i+1] = successors[i]
+	}
+	return nil
+}
+
+// Refreshes the next entries of the finger table
+func (vn *localVnode) fixFingerTable() error {
+	hashBits := vn.ring.config.hashBits
+
+	vn.lock.Lock()
+	idx := vn.lastFinger
+	vn.lock.Unlock()
+
+	offset := powerOffset(vn.Id, idx, hashBits)
+	nodes, err := vn.FindSuccessors(1, offset)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 || nodes[0] == nil {
+		return errors.New("dht: no successor found for finger")
+	}
+	node := nodes[0]
+
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+
+	// the same node is likely responsible for the next fingers too
+	for {
+		vn.finger[idx] = node
+		idx++
+		if idx == hashBits {
+			break
+		}
+		offset = powerOffset(vn.Id, idx, hashBits)
+		if !betweenRightIncl(vn.Id, node.Id, offset) {
+			break
+		}
+	}
+
+	if idx == hashBits {
+		idx = 0
+	}
+	vn.lastFinger = idx
+	return nil
+}
+
+// Clears the predecessor if it no longer responds
+func (vn *localVnode) checkPredecessor() error {
+	vn.lock.Lock()
+	predecessor := vn.predecessor
+	vn.lock.Unlock()
+
+	if predecessor == nil {
+		return nil
+	}
+
+	alive, err := vn.ring.transport.Ping(predecessor)
+	if err != nil {
+		return err
+	}
+
+	if !alive {
+		vn.lock.Lock()
+		if vn.predecessor == predecessor {
+			vn.predecessor = nil
+		}
+		vn.lock.Unlock()
+	}
+	return nil
+}
+
+func (vn *localVnode) leave() error {
+	vn.lock.Lock()
+	predecessor := vn.predecessor
+	successor := vn.successors[0]
+	vn.lock.Unlock()
+
+	if vn.ring.config.Delegate != nil {
+		vn.ring.invokeDelegate(func() {
+			vn.ring.config.Delegate.Leaving(&vn.Vnode, predecessor, successor)
+		})
+	}
+
+	var errs []error
+	if successor != nil && !bytes.Equal(successor.Id, vn.Id) {
+		if err := vn.ring.transport.ClearPredecessor(successor, &vn.Vnode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if predecessor != nil && !bytes.Equal(predecessor.Id, vn.Id) {
+		if err := vn.ring.transport.SkipSuccessor(predecessor, &vn.Vnode); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return mergeErrors(errs)
+}
+
+func (vn *localVnode) successor() *Vnode {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	return vn.successors[0]
+}
+
+// Must be called with the lock held
+func (vn *localVnode) knownSuccessors() int {
+	n := 0
+	for _, successor := range vn.successors {
+		if successor != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Returns the finger table entries and successors that precede the key,
+// ordered by how close they are to it
+func (vn *localVnode) closestPreceding(key []byte) []*Vnode {
+	vn.lock.Lock()
+	candidates := make([]*Vnode, 0, len(vn.finger)+len(vn.successors))
+	seen := make(map[string]bool)
+	for _, list := range [][]*Vnode{vn.finger, vn.successors} {
+		for _, node := range list {
+			if node == nil || seen[node.String()] {
+				continue
+			}
+			if between(vn.Id, key, node.Id) {
+				seen[node.String()] = true
+				candidates = append(candidates, node)
+			}
+		}
+	}
+	vn.lock.Unlock()
+
+	bits := vn.ring.config.hashBits
+	sort.Slice(candidates, func(i, j int) bool {
+		return distance(candidates[i].Id, key, bits).Cmp(distance(candidates[j].Id, key, bits)) < 0
+	})
+	return candidates
+}
+
+/// VnodeRPC
+
+func (vn *localVnode) GetPredecessor() (*Vnode, error) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	return vn.predecessor, nil
+}
+
+func (vn *localVnode) Notify(maybePredecessor *Vnode) ([]*Vnode, error) {
+	vn.lock.Lock()
+	previous := vn.predecessor
+	changed := previous == nil || between(previous.Id, vn.Id, maybePredecessor.Id)
+	if changed {
+		vn.predecessor = maybePredecessor
+	}
+
+	successors := make([]*Vnode, 0, len(vn.successors))
+	for _, successor := range vn.successors {
+		if successor != nil {
+			successors = append(successors, successor)
+		}
+	}
+	vn.lock.Unlock()
+
+	if changed && vn.ring.config.Delegate != nil {
+		vn.ring.invokeDelegate(func() {
+			vn.ring.config.Delegate.NewPredecessor(&vn.Vnode, maybePredecessor, previous)
+		})
+	}
+	return successors, nil
+}
+
+func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, error) {
+	vn.lock.Lock()
+	successors := make([]*Vnode, 0, len(vn.successors))
+	for _, successor := range vn.successors {
+		if successor != nil {
+			successors = append(successors, successor)
+		}
+	}
+	vn.lock.Unlock()
+
+	if len(successors) == 0 {
+		return nil, errors.New("dht: vnode has no successor")
+	}
+
+	// we are the immediate predecessor of the key
+	if betweenRightIncl(vn.Id, successors[0].Id, key) {
+		if len(successors) > n {
+			successors = successors[:n]
+		}
+		return successors, nil
+	}
+
+	// ask the closest preceding nodes
+	for _, closest := range vn.closestPreceding(key) {
+		if bytes.Equal(closest.Id, vn.Id) {
+			continue
+		}
+		result, err := vn.ring.transport.FindSuccessors(closest, n, key)
+		if err == nil {
+			return result, nil
+		}
+		log.Println("dht: failed to contact " + closest.String() + ": " + err.Error())
+	}
+
+	// the key might be between two of our successors
+	for i := 1; i < len(successors); i++ {
+		if betweenRightIncl(successors[i-1].Id, successors[i].Id, key) {
+			remaining := successors[i:]
+			if len(remaining) > n {
+				remaining = remaining[:n]
+			}
+			return remaining, nil
+		}
+	}
+
+	return nil, errors.New("dht: exhausted all preceding nodes")
+}
+
+func (vn *localVnode) ClearPredecessor(predecessor *Vnode) error {
+	vn.lock.Lock()
+	var old *Vnode
+	if vn.predecessor != nil && bytes.Equal(vn.predecessor.Id, predecessor.Id) {
+		old = vn.predecessor
+		vn.predecessor = nil
+	}
+	vn.lock.Unlock()
+
+	if old != nil && vn.ring.config.Delegate != nil {
+		vn.ring.invokeDelegate(func() {
+			vn.ring.config.Delegate.PredecessorLeaving(&vn.Vnode, old)
+		})
+	}
+	return nil
+}
+
+func (vn *localVnode) SkipSuccessor(successor *Vnode) error {
+	vn.lock.Lock()
+	var old *Vnode
+	if vn.successors[0] != nil && bytes.Equal(vn.successors[0].Id, successor.Id) {
+		old = vn.successors[0]
+		copy(vn.successors, vn.successors[1:])
+		vn.successors[len(vn.successors)-1] = nil
+		if vn.successors[0] == nil {
+			vn.successors[0] = &vn.Vnode // we are alone
+		}
+	}
+	vn.lock.Unlock()
+
+	if old != nil && vn.ring.config.Delegate != nil {
+		vn.ring.invokeDelegate(func() {
+			vn.ring.config.Delegate.SuccessorLeaving(&vn.Vnode, old)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"mdc/bitverse/dht"
+	"sync"
+)
+
+// dhtTransportType implements dht.Transport on top of super node rpc calls,
+// the host of a vnode is the address of the super node hosting it
+type dhtTransportType struct {
+	rpc    *rpcType
+	lock   sync.RWMutex
+	vnodes map[string]*dhtLocalVnode // vnode id:local vnode
+}
+
+type dhtLocalVnode struct {
+	vnode *dht.Vnode
+	obj   dht.VnodeRPC
+}
+
+type dhtArgs struct {
+	Target *dht.Vnode
+	Self   *dht.Vnode
+	N      int
+	Key    []byte
+}
+
+type dhtReply struct {
+	Vnode  *dht.Vnode
+	Vnodes []*dht.Vnode
+	Alive  bool
+}
+
+func makeDhtTransport(rpc *rpcType) *dhtTransportType {
+	dhtTransport := new(dhtTransportType)
+	dhtTransport.rpc = rpc
+	dhtTransport.vnodes = make(map[string]*dhtLocalVnode)
+
+	rpc.handle("dht.ListVnodes", dhtTransport.serveListVnodes)
+	rpc.handle("dht.Ping", dhtTransport.servePing)
+	rpc.handle("dht.GetPredecessor", dhtTransport.serveGetPredecessor)
+	rpc.handle("dht.Notify", dhtTransport.serveNotify)
+	rpc.handle("dht.FindSuccessors", dhtTransport.serveFindSuccessors)
+	rpc.handle("dht.ClearPredecessor", dhtTransport.serveClearPredecessor)
+	rpc.handle("dht.SkipSuccessor", dhtTransport.serveSkipSuccessor)
+
+	return dhtTransport
+}
+
+func (dhtTransport *dhtTransportType) ListVnodes(host string) ([]*dht.Vnode, error) {
+	var reply dhtReply
+	err := dhtTransport.rpc.call(host, "dht.ListVnodes", dhtArgs{}, &reply)
+	return reply.Vnodes, err
+}
+
+func (dhtTransport *dhtTransportType) Ping(vn *dht.Vnode) (bool, error) {
+	var reply dhtReply
+	err := dhtTransport.rpc.call(vn.Host, "dht.Ping", dhtArgs{Target: vn}, &reply)
+	if err != nil {
+		debug("dht: failed to ping " + vn.Host + ": " + err.Error())
+		return false, nil // an unreachable vnode is not alive
+	}
+	return reply.Alive, nil
+}
+
+func (dhtTransport *dhtTransportType) GetPredecessor(vn *dht.Vnode) (*dht.Vnode, error) {
+	var reply dhtReply
+	err := dhtTransport.rpc.call(vn.Host, "dht.GetPredecessor", dhtArgs{Target: vn}, &reply)
+	return reply.Vnode, err
+}
+
+func (dhtTransport *dhtTransportType) Notify(target, self *dht.Vnode) ([]*dht.Vnode, error) {
+	var reply dhtReply
+	err := dhtTransport.rpc.call(target.Host, "dht.Notify", dhtArgs{Target: target, Self: self}, &reply)
+	return reply.Vnodes, err
+}
+
+func (dhtTransport *dhtTransportType) FindSuccessors(vn *dht.Vnode, n int, key []byte) ([]*dht.Vnode, error) {
+	var reply dhtReply
+	err := dhtTransport.rpc.call(vn.Host, "dht.FindSuccessors", dhtArgs{Target: vn, N: n, Key: key}, &reply)
+	return reply.Vnodes, err
+}
+
+func (dhtTransport *dhtTransportType) ClearPredecessor(target, self *dht.Vnode) error {
+	return dhtTransport.rpc.call(target.Host, "dht.ClearPredecessor", dhtArgs{Target: target, Self: self}, nil)
+}
+
+func (dhtTransport *dhtTransportType) SkipSuccessor(target, self *dht.Vnode) error {
+	return dhtTransport.rpc.call(target.Host, "dht.SkipSuccessor", dhtArgs{Target: target, Self: self}, nil)
+}
+
+func (dhtTransport *dhtTransportType) Register(vn *dht.Vnode, o dht.VnodeRPC) {
+	dhtTransport.lock.Lock()
+	dhtTransport.vnodes[vn.String()] = &dhtLocalVnode{vn, o}
+	dhtTransport.lock.Unlock()
+}
+
+func (dhtTransport *dhtTransportType) Deregister(vn *dht.Vnode) {
+	dhtTransport.lock.Lock()
+	delete(dhtTransport.vnodes, vn.String())
+	dhtTransport.lock.Unlock()
+}
+
+/// PRIVATE
+
+func (dhtTransport *dhtTransportType) get(vn *dht.Vnode) (dht.VnodeRPC, error) {
+	if vn == nil {
+		return nil, errors.New("dht: no target vnode")
+	}
+
+	dhtTransport.lock.RLock()
+	defer dhtTransport.lock.RUnlock()
+
+	local := dhtTransport.vnodes[vn.String()]
+	if local == nil {
+		return nil, errors.New("dht: no such vnode " + vn.String())
+	}
+	return local.obj, nil
+}
+
+func (dhtTransport *dhtTransportType) serveListVnodes(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	dhtTransport.lock.RLock()
+	defer dhtTransport.lock.RUnlock()
+
+	reply := dhtReply{}
+	for _, local := range dhtTransport.vnodes {
+		reply.Vnodes = append(reply.Vnodes, local.vnode)
+	}
+	return reply, nil
+}
+
+func (dhtTransport *dhtTransportType) servePing(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	_, err := dhtTransport.get(args.Target)
+	return dhtReply{Alive: err == nil}, nil
+}
+
+func (dhtTransport *dhtTransportType) serveGetPredecessor(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	obj, err := dhtTransport.get(args.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	predecessor, err := obj.GetPredecessor()
+	return dhtReply{Vnode: predecessor}, err
+}
+
+func (dhtTransport *dhtTransportType) serveNotify(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	obj, err := dhtTransport.get(args.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	successors, err := obj.Notify(args.Self)
+	return dhtReply{Vnodes: successors}, err
+}
+
+func (dhtTransport *dhtTransportType) serveFindSuccessors(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	obj, err := dhtTransport.get(args.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	successors, err := obj.FindSuccessors(args.N, args.Key)
+	return dhtReply{Vnodes: successors}, err
+}
+
+func (dhtTransport *dhtTransportType) serveClearPredecessor(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	obj, err := dhtTransport.get(args.Target)
+	if err != nil {
+		return nil, err
+	}
+	return dhtReply{}, obj.ClearPredecessor(args.Self)
+}
+
+func (dhtTransport *dhtTransportType) serveSkipSuccessor(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args dhtArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	obj, err := dhtTransport.get(args.Target)
+	if err != nil {
+		return nil, err
+	}
+	return dhtReply{}, obj.SkipSuccessor(args.Self)
+}
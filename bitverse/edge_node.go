@@ -4,15 +4,23 @@ import (
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"math/rand"
+	"sync"
 	"time"
 )
 
 const HEARTBEAT_RATE time.Duration = 10
 const MSG_SERVICE_GC_RATE time.Duration = 1
+const RECONNECT_MIN_DELAY time.Duration = 1
+const RECONNECT_MAX_DELAY time.Duration = 60
+const RECONNECT_MIN_UPTIME time.Duration = 10 // links closed sooner count as failed attempts
 
 type EdgeNode struct {
 	nodeId            NodeId
-	superNode         *RemoteNode
+	identity          *Identity
+	superNode         *RemoteNode // nil while not connected
+	superNodeLock     sync.RWMutex
+	outbox            *outboxType // messages sent while not connected
 	msgChannel        chan Msg
 	remoteNodeChannel chan *RemoteNode
 	transport         Transport
@@ -20,17 +28,22 @@ type EdgeNode struct {
 	repoServices      map[string]*RepoService
 	bitverseObserver  BitverseObserver
 	replyTable        map[string]*msgReplyType
+	replyTableLock    sync.Mutex
 }
 
-func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*EdgeNode, chan int) {
+// The node id is derived from identity, e.g. loaded by LoadOrCreateIdentity so
+// that the edge node keeps its id across restarts. If identity is nil, a new
+// random identity is used.
+func MakeEdgeNode(transport Transport, identity *Identity, bitverseObserver BitverseObserver) (*EdgeNode, chan int) {
 	edgeNode := new(EdgeNode)
 	edgeNode.transport = transport
 	edgeNode.bitverseObserver = bitverseObserver
 
-	edgeNode.nodeId = generateNodeId()
+	edgeNode.identity = identityOrGenerate(identity)
+	edgeNode.nodeId = edgeNode.identity.nodeId
 	debug("edgenode: my id is " + edgeNode.Id())
 
-	edgeNode.transport.SetLocalNodeId(edgeNode.nodeId)
+	edgeNode.transport.SetIdentity(edgeNode.identity)
 
 	done := make(chan int)
 	edgeNode.msgChannel = make(chan Msg)
@@ -38,6 +51,7 @@ func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*Edge
 	edgeNode.msgServices = make(map[string]*MsgService)
 	edgeNode.repoServices = make(map[string]*RepoService)
 	edgeNode.replyTable = make(map[string]*msgReplyType)
+	edgeNode.outbox = makeOutbox()
 
 	go func() {
 		for {
@@ -54,21 +68,23 @@ func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*Edge
 						if observer == nil {
 							debug("edgenode: failed to deliver message, no observer registered")
 						} else {
-							var err error
-							if msg.Payload != "" && msg.PayloadType != Nil {
-								if msg.Status != Error { // do not try to decrypt error response messages
-									msg.Payload, err = decryptAes(msgService.aesEncryptionKey, msg.Payload)
-								} else {
-									err = nil
-								}
-							}
+							reply := edgeNode.lookupReply(msg.Id)
+							deliver, err := msgService.open(&msg, reply)
 							if err != nil {
-								info("edgenode: failed to decrypt payload, ignoring incoming msg")
-							} else {
-								reply := edgeNode.replyTable[msg.Id]
+								info("edgenode: failed to decrypt payload, ignoring incoming msg: " + err.Error())
+							} else if deliver {
 								if reply != nil {
+									if edgeNode.removeReply(msg.Id) == nil {
+										break // timed out meanwhile
+									}
 									if msg.Status == Error {
 										reply.callback(errors.New(msg.Payload), nil)
+									} else if reply.versioned {
+										if msg.PayloadType == Nil && msg.RepoVersion == 0 {
+											reply.callback(nil, nil)
+										} else {
+											reply.callback(nil, &RepoValue{Value: msg.Payload, Version: msg.RepoVersion, TTL: time.Second * time.Duration(msg.RepoTTL)})
+										}
 									} else {
 										if msg.PayloadType == Nil {
 											reply.callback(nil, nil)
@@ -76,13 +92,27 @@ func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*Edge
 											reply.callback(nil, msg.Payload)
 										}
 									}
-									delete(edgeNode.replyTable, msg.Id)
 								} else {
 									observer.OnDeliver(msgService, &msg)
 								}
 							}
 						}
 					}
+				} else if msg.Type == Receipt && msg.Dst == edgeNode.Id() {
+					edgeNode.replyTableLock.Lock()
+					receipt := edgeNode.replyTable[msg.Id+RECEIPT_SUFFIX]
+					if receipt != nil {
+						if msg.Payload == Queued {
+							receipt.queued = true
+						} else {
+							delete(edgeNode.replyTable, msg.Id+RECEIPT_SUFFIX)
+						}
+					}
+					edgeNode.replyTableLock.Unlock()
+
+					if receipt != nil {
+						receipt.callback(nil, msg.Payload)
+					}
 				} else if msg.Type == Heartbeat {
 					debug("edgenode: got heartbeat message from <" + msg.Src + ">")
 					if bitverseObserver != nil {
@@ -115,14 +145,26 @@ func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*Edge
 				} else { // ignore
 				}
 			case remoteNode := <-edgeNode.remoteNodeChannel:
-				if remoteNode.state == Dead {
-					debug("edgenode: ERROR we just lost our connection to the super node <" + remoteNode.Id() + ">")
-					edgeNode.superNode = nil
+				if remoteNode.getState() == Dead {
+					if edgeNode.currentSuperNode() != remoteNode {
+						break // already removed
+					}
+
+					info("edgenode: lost our connection to the super node <" + remoteNode.Id() + ">")
+					edgeNode.setSuperNode(nil)
+					if bitverseObserver != nil {
+						bitverseObserver.OnDisconnected(edgeNode, remoteNode)
+					}
 				} else {
 					debug("edgenode: adding link to super node <" + remoteNode.Id() + ">")
-					edgeNode.superNode = remoteNode
+					// messages sent meanwhile wait for the lock, so they cannot overtake queued ones
+					edgeNode.outbox.lock.Lock()
+					edgeNode.setSuperNode(remoteNode)
+					edgeNode.outbox.flush(remoteNode)
+					edgeNode.outbox.lock.Unlock()
+
 					if bitverseObserver != nil {
-						bitverseObserver.OnConnected(edgeNode, edgeNode.superNode)
+						bitverseObserver.OnConnected(edgeNode, remoteNode)
 					}
 				}
 			}
@@ -140,17 +182,9 @@ func MakeEdgeNode(transport Transport, bitverseObserver BitverseObserver) (*Edge
 	msgServiceGCTicker := time.NewTicker(time.Millisecond * MSG_SERVICE_GC_RATE * 1000)
 	go func() {
 		for t := range msgServiceGCTicker.C {
-			for msgId, reply := range edgeNode.replyTable {
-				debug("edgenode: running msg service callback listener garbage collector" + t.String())
-				currentTime := int32(time.Now().Unix())
-				elapsedTime := currentTime - reply.timestamp
-				timeLeft := reply.timeout - elapsedTime
-
-				if timeLeft <= 0 {
-					reply.callback(errors.New("timeout"), nil) // notify the callback clousure about this timeout
-					delete(edgeNode.replyTable, msgId)
-				}
-
+			debug("edgenode: running msg service callback listener garbage collector" + t.String())
+			for _, reply := range edgeNode.expireReplies() {
+				reply.callback(errors.New("timeout"), nil) // notify the callback clousure about this timeout
 			}
 		}
 	}()
@@ -170,13 +204,96 @@ func (edgeNode *EdgeNode) Id() string {
 	return edgeNode.nodeId.String()
 }
 
-func (edgeNode *EdgeNode) Connect(remoteAddress string) {
-	edgeNode.transport.ConnectToNode(remoteAddress, edgeNode.remoteNodeChannel, edgeNode.msgChannel)
+// Connects to the first reachable super node in remoteAddresses and stays
+// connected, i.e. when the link dies the edge node reconnects, failing over to
+// the next address if needed. Failed attempts are retried with an exponential
+// backoff. Services and claimed repos are kept across reconnects. Never returns.
+func (edgeNode *EdgeNode) Connect(remoteAddresses ...string) {
+	if len(remoteAddresses) == 0 {
+		panic("edgenode.Connect: no super node addresses")
+	}
+
+	delay := time.Second * RECONNECT_MIN_DELAY
+	for i := 0; ; i = (i + 1) % len(remoteAddresses) {
+		remoteAddress := remoteAddresses[i]
+		connected := time.Now()
+		err := edgeNode.transport.ConnectToNode(remoteAddress, edgeNode.remoteNodeChannel, edgeNode.msgChannel)
+		if err == nil && time.Since(connected) >= time.Second*RECONNECT_MIN_UPTIME {
+			// we were connected until the link died, try the same super node again right away
+			info("edgenode: link to super node at " + remoteAddress + " closed, reconnecting")
+			delay = time.Second * RECONNECT_MIN_DELAY
+			i--
+			continue
+		}
+
+		if err == nil {
+			info("edgenode: link to super node at " + remoteAddress + " closed right after connecting")
+		} else {
+			info("edgenode: " + err.Error())
+		}
+		if err == nil || i == len(remoteAddresses)-1 {
+			// no super node reachable, or it drops us right away, back off before trying again
+			time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+			delay *= 2
+			if delay > time.Second*RECONNECT_MAX_DELAY {
+				delay = time.Second * RECONNECT_MAX_DELAY
+			}
+		}
+	}
+}
+
+// Returns true if the edge node currently has a link to a super node
+func (edgeNode *EdgeNode) IsConnected() bool {
+	return edgeNode.currentSuperNode() != nil
 }
 
 func (edgeNode *EdgeNode) SendHeartbeat() {
-	msg := composeHeartbeatMsg(edgeNode.Id(), edgeNode.superNode.Id())
-	edgeNode.superNode.deliver(msg)
+	superNode := edgeNode.currentSuperNode()
+	if superNode == nil {
+		debug("edgenode: not connected, skipping heartbeat")
+		return
+	}
+
+	msg := composeHeartbeatMsg(edgeNode.Id(), superNode.Id())
+	superNode.deliver(msg)
+}
+
+// OUTBOX MANAGEMENT
+
+// Sets how many messages are queued while not connected to a super node,
+// 0 disables queueing
+func (edgeNode *EdgeNode) SetOutboxSize(size int) {
+	if size < 0 {
+		size = 0
+	}
+
+	edgeNode.outbox.lock.Lock()
+	defer edgeNode.outbox.lock.Unlock()
+	edgeNode.outbox.size = size
+	edgeNode.outbox.truncate()
+}
+
+// Sets which message is dropped when a message is sent while the outbox is full
+func (edgeNode *EdgeNode) SetOverflowPolicy(policy OverflowPolicy) {
+	edgeNode.outbox.lock.Lock()
+	defer edgeNode.outbox.lock.Unlock()
+	edgeNode.outbox.policy = policy
+}
+
+// Sets how long a message may stay in the outbox before it is dropped. Messages
+// expecting a reply are also dropped when their reply times out
+func (edgeNode *EdgeNode) SetOutboxExpiry(expiry time.Duration) {
+	edgeNode.outbox.lock.Lock()
+	defer edgeNode.outbox.lock.Unlock()
+	edgeNode.outbox.expiry = expiry
+}
+
+// Returns the number of messages waiting to be sent
+func (edgeNode *EdgeNode) OutboxLen() int {
+	edgeNode.outbox.lock.Lock()
+	defer edgeNode.outbox.lock.Unlock()
+	edgeNode.outbox.purge()
+	return len(edgeNode.outbox.entries)
 }
 
 // MSG SERVICE MANAGEMENT
@@ -186,8 +303,13 @@ func (edgeNode *EdgeNode) CreateMsgService(aesEncryptionKey string, serviceId st
 	//	return nil, errors.New("service id <internal> reserved for internal usage")
 	//}
 
+	keyring, err := makeKeyring(aesEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
 	if edgeNode.msgServices[serviceId] == nil {
-		msgService := composeMsgService(aesEncryptionKey, serviceId, observer, edgeNode)
+		msgService := composeMsgService(keyring, serviceId, observer, edgeNode)
 		edgeNode.msgServices[serviceId] = msgService
 		return msgService, nil
 	} else {
@@ -195,6 +317,27 @@ func (edgeNode *EdgeNode) CreateMsgService(aesEncryptionKey string, serviceId st
 	}
 }
 
+// Creates a msg service where messages are encrypted with keys only shared
+// with the receiving edge node, derived from the identity keys of both nodes,
+// instead of with one AES key shared by all nodes using the service. A leaked
+// key then only exposes the messages between two nodes. Both nodes have to
+// create the service with the same id and mode.
+func (edgeNode *EdgeNode) CreatePairwiseMsgService(serviceId string, mode PairwiseMode, observer MsgServiceObserver) (*MsgService, error) {
+	if edgeNode.msgServices[serviceId] != nil {
+		return nil, errors.New("service id <" + serviceId + "> already exists")
+	}
+
+	pairwise, err := makePairwise(edgeNode.identity, serviceId, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	msgService := composeMsgService(nil, serviceId, observer, edgeNode)
+	msgService.pairwise = pairwise
+	edgeNode.msgServices[serviceId] = msgService
+	return msgService, nil
+}
+
 func (edgeNode *EdgeNode) GetMsgService(serviceId string) *MsgService {
 	return edgeNode.msgServices[serviceId]
 }
@@ -214,7 +357,7 @@ func (edgeNode *EdgeNode) ClaimOwnership(repoId string, aesEncryptionKey string,
 		return err
 	}
 
-	msg := composeRepoClaimMsg(edgeNode.Id(), edgeNode.superNode.Id(), repoId, pubPemKey)
+	msg := composeRepoClaimMsg(edgeNode.Id(), edgeNode.superNodeId(), repoId, pubPemKey)
 	repoMsgService.sendMsgAndGetReply(msg, timeout, func(err error, reply interface{}) {
 		info("got a reply")
 		if err != nil {
@@ -222,7 +365,8 @@ func (edgeNode *EdgeNode) ClaimOwnership(repoId string, aesEncryptionKey string,
 			callback(err, nil)
 		} else {
 			info("got a claim request reply back")
-			repoService := composeRepoService(aesEncryptionKey, prv, pub, repoId, edgeNode, repoMsgService)
+			repoService := composeRepoService(prv, pub, repoId, edgeNode, repoMsgService)
+			repoMsgServiceObserver.repoService = repoService
 			callback(nil, repoService)
 		}
 	})
@@ -230,16 +374,130 @@ func (edgeNode *EdgeNode) ClaimOwnership(repoId string, aesEncryptionKey string,
 	return nil // no errors
 }
 
+// Uses a repo owned by someone else, who has granted rights to pub with
+// RepoService.Grant. The values are encrypted with aesEncryptionKey, which has
+// to be shared with the owner. The rights are checked by the super node on
+// every request.
+func (edgeNode *EdgeNode) OpenRepo(repoId string, aesEncryptionKey string, prv *rsa.PrivateKey, pub *rsa.PublicKey) (*RepoService, error) {
+	repoMsgServiceObserver := new(RepoMsgServiceObserver)
+
+	repoMsgService, err := edgeNode.CreateMsgService(aesEncryptionKey, repoId, repoMsgServiceObserver)
+	if err != nil {
+		return nil, err
+	}
+
+	pubPemKey, err := generatePublicPem(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	repoService := composeRepoService(prv, pub, repoId, edgeNode, repoMsgService)
+	repoService.signer = pubPemKey
+	repoMsgServiceObserver.repoService = repoService
+	return repoService, nil
+}
+
 /// PRIVATE
 
-func (edgeNode *EdgeNode) registerReplyCallback(msgId string, timeout int32, callback func(err error, data interface{})) {
+func (edgeNode *EdgeNode) registerReplyCallback(msgId string, timeout int32, callback func(err error, data interface{})) *msgReplyType {
 	reply := new(msgReplyType)
 	reply.timeout = timeout
 	reply.callback = callback
 	reply.timestamp = int32(time.Now().Unix())
+
+	edgeNode.replyTableLock.Lock()
+	defer edgeNode.replyTableLock.Unlock()
 	edgeNode.replyTable[msgId] = reply
+	return reply
+}
+
+// Returns the reply callback registered for msgId, or nil
+func (edgeNode *EdgeNode) lookupReply(msgId string) *msgReplyType {
+	edgeNode.replyTableLock.Lock()
+	defer edgeNode.replyTableLock.Unlock()
+	return edgeNode.replyTable[msgId]
+}
+
+// Removes and returns the reply callback registered for msgId, or nil if it
+// has already been removed, e.g. because it timed out
+func (edgeNode *EdgeNode) removeReply(msgId string) *msgReplyType {
+	edgeNode.replyTableLock.Lock()
+	defer edgeNode.replyTableLock.Unlock()
+	reply := edgeNode.replyTable[msgId]
+	delete(edgeNode.replyTable, msgId)
+	return reply
+}
+
+// Removes the reply callbacks that have timed out, returns those that still
+// have to be notified
+func (edgeNode *EdgeNode) expireReplies() []*msgReplyType {
+	edgeNode.replyTableLock.Lock()
+	defer edgeNode.replyTableLock.Unlock()
+
+	var expired []*msgReplyType
+	currentTime := int32(time.Now().Unix())
+	for msgId, reply := range edgeNode.replyTable {
+		if reply.timeout-(currentTime-reply.timestamp) <= 0 {
+			if !reply.queued { // a queued message has already been reported
+				expired = append(expired, reply)
+			}
+			delete(edgeNode.replyTable, msgId)
+		}
+	}
+	return expired
+}
+
+func (edgeNode *EdgeNode) currentSuperNode() *RemoteNode {
+	edgeNode.superNodeLock.RLock()
+	defer edgeNode.superNodeLock.RUnlock()
+	return edgeNode.superNode
+}
+
+func (edgeNode *EdgeNode) setSuperNode(superNode *RemoteNode) {
+	edgeNode.superNodeLock.Lock()
+	defer edgeNode.superNodeLock.Unlock()
+	edgeNode.superNode = superNode
+}
+
+// Returns the id of the super node we are connected to, or an empty string
+func (edgeNode *EdgeNode) superNodeId() string {
+	superNode := edgeNode.currentSuperNode()
+	if superNode == nil {
+		return ""
+	}
+	return superNode.Id()
 }
 
 func (edgeNode *EdgeNode) send(msg *Msg) {
-	edgeNode.superNode.deliver(msg)
+	edgeNode.sendWithReplyTimeout(msg, 0)
+}
+
+// Sends msg, or queues it in the outbox if we are not connected. A queued
+// message expecting a reply is dropped when the reply times out after timeout
+// seconds, 0 means no reply is expected
+func (edgeNode *EdgeNode) sendWithReplyTimeout(msg *Msg, timeout int32) {
+	outbox := edgeNode.outbox
+
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+
+	expires := time.Now().Add(outbox.expiry)
+	if timeout > 0 {
+		if replyExpires := time.Now().Add(time.Second * time.Duration(timeout)); replyExpires.Before(expires) {
+			expires = replyExpires
+		}
+	}
+
+	superNode := edgeNode.currentSuperNode()
+	if superNode == nil {
+		debug("edgenode: not connected to a super node, queueing message " + msg.Id)
+		outbox.push(msg, expires)
+		return
+	}
+
+	// sending under the lock keeps messages in order with queued ones
+	if err := superNode.deliver(msg); err != nil {
+		debug("edgenode: link to super node died, queueing message " + msg.Id)
+		outbox.push(msg, expires)
+	}
 }
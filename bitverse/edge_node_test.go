@@ -0,0 +1,147 @@
+package bitverse
+
+import (
+	"testing"
+	"time"
+)
+
+type connectionObserver struct {
+	events chan string
+}
+
+func (connectionObserver *connectionObserver) OnSiblingJoined(node *EdgeNode, id string) {
+}
+
+func (connectionObserver *connectionObserver) OnSiblingLeft(node *EdgeNode, id string) {
+}
+
+func (connectionObserver *connectionObserver) OnSiblingHeartbeat(node *EdgeNode, id string) {
+}
+
+func (connectionObserver *connectionObserver) OnChildrenReply(node *EdgeNode, id string, children []string) {
+}
+
+func (connectionObserver *connectionObserver) OnConnected(node *EdgeNode, superNode *RemoteNode) {
+	connectionObserver.events <- "connected " + superNode.Id()
+}
+
+func (connectionObserver *connectionObserver) OnDisconnected(node *EdgeNode, superNode *RemoteNode) {
+	connectionObserver.events <- "disconnected " + superNode.Id()
+}
+
+func expectEvent(t *testing.T, events chan string, expected string) {
+	select {
+	case event := <-events:
+		if event != expected {
+			t.Fatalf("expected <%s>, got <%s>", expected, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for <%s>", expected)
+	}
+}
+
+func TestEdgeNodeFailover(t *testing.T) {
+	network := MakeMemNetwork()
+
+	superNode1, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super1", "1111")
+	superNode2, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super2", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	observer := &connectionObserver{make(chan string, 10)}
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, observer)
+	go edgeNode.Connect("super1:1111", "super2:1111")
+	// edge nodes know super nodes by the hash of their id, see the handshake
+	superNode1Id := makeNodeIdFromString(superNode1.Id())
+	superNode2Id := makeNodeIdFromString(superNode2.Id())
+	expectEvent(t, observer.events, "connected "+superNode1Id.String())
+
+	// super1 becomes unreachable, the edge node should fail over to super2
+	network.Partition(edgeNode.Id(), "super1:1111")
+	network.Disconnect(edgeNode.Id())
+	expectEvent(t, observer.events, "disconnected "+superNode1Id.String())
+	expectEvent(t, observer.events, "connected "+superNode2Id.String())
+
+	if !edgeNode.IsConnected() {
+		t.Fatal("expected the edge node to be connected")
+	}
+	edgeNode.SendHeartbeat()
+}
+
+func TestEdgeNodeOutbox(t *testing.T) {
+	network := MakeMemNetwork()
+	secret, _ := GenerateAesSecret()
+
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	edgeNode1, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	msgService1, _ := edgeNode1.CreateMsgService(secret, "ping", new(memPingObserver))
+	edgeNode2, _ := makeMemEdgeNode(t, network, secret, "super:1111")
+	time.Sleep(100 * time.Millisecond)
+
+	// edge node 1 is not connected yet, so the ping is queued
+	done := make(chan string, 1)
+	msgService1.SendAndGetReply(edgeNode2.Id(), "ping", 5, func(err error, reply interface{}) {
+		if err != nil {
+			done <- err.Error()
+		} else {
+			done <- reply.(string)
+		}
+	})
+	if edgeNode1.OutboxLen() != 1 {
+		t.Fatalf("expected 1 queued message, got %d", edgeNode1.OutboxLen())
+	}
+
+	go edgeNode1.Connect("super:1111")
+	if reply := <-done; reply != "pong" {
+		t.Fatalf("expected the queued ping to be delivered, got %s", reply)
+	}
+	if edgeNode1.OutboxLen() != 0 {
+		t.Fatalf("expected an empty outbox, got %d messages", edgeNode1.OutboxLen())
+	}
+}
+
+func TestEdgeNodeRejectsUnauthenticatedPayloads(t *testing.T) {
+	network := MakeMemNetwork()
+	secret, _ := GenerateAesSecret()
+
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	_, sender := makeMemEdgeNode(t, network, secret, "super:1111")
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	observer := &mailObserver{make(chan string, 10)}
+	edgeNode.CreateMsgService(secret, "ping", observer)
+	go edgeNode.Connect("super:1111")
+
+	identity, _ := GenerateIdentity()
+	transport := network.MakeTransport()
+	transport.SetIdentity(identity)
+	remoteNodeChannel := make(chan *RemoteNode, 10)
+	go transport.ConnectToNode("super:1111", remoteNodeChannel, make(chan Msg, 10))
+	attacker := <-remoteNodeChannel
+	time.Sleep(200 * time.Millisecond)
+
+	// plain payloads, passed off as an error reply, an empty reply or as is
+	for _, status := range []int{Error, Ok} {
+		msg := composeMsgServiceMsg(identity.Id(), edgeNode.Id(), "ping", "forged")
+		msg.Status = status
+		attacker.deliver(msg)
+	}
+	msg := composeMsgServiceMsg(identity.Id(), edgeNode.Id(), "ping", "forged")
+	msg.PayloadType = Nil
+	attacker.deliver(msg)
+	time.Sleep(200 * time.Millisecond)
+
+	sender.Send(edgeNode.Id(), "hello")
+	for _, expected := range []string{"", "hello"} {
+		select {
+		case payload := <-observer.delivered:
+			if payload != expected {
+				t.Fatalf("expected <%s>, got <%s>", expected, payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for <%s>", expected)
+		}
+	}
+}
@@ -77,6 +77,10 @@ func (bitverseObserver *BitverseObserver) OnChildrenReply(node *bitverse.EdgeNod
 	}
 }
 
+func (bitverseObserver *BitverseObserver) OnDisconnected(node *bitverse.EdgeNode, remoteNode *bitverse.RemoteNode) {
+	fmt.Println("-> lost connection to super node " + remoteNode.Id() + ", reconnecting")
+}
+
 func (bitverseObserver *BitverseObserver) OnConnected(node *bitverse.EdgeNode, remoteNode *bitverse.RemoteNode) {
 	fmt.Println("-> now connected to super node " + remoteNode.Id())
 
@@ -108,7 +112,7 @@ func main() {
 	secret2, _ := bitverse.GenerateAesSecret()
 	fmt.Println(secret2)
 
-	node, done := bitverse.MakeEdgeNode(bitverse.MakeWSTransport(), new(BitverseObserver))
+	node, done := bitverse.MakeEdgeNode(bitverse.MakeWSTransport(), nil, new(BitverseObserver))
 	//node.Debug()
 	fmt.Println("-> my id is " + node.Id())
 
@@ -31,6 +31,10 @@ func (bitverseObserver *BitverseObserver) OnChildrenReply(node *bitverse.EdgeNod
 	fmt.Println("-> received children list from " + id)
 }
 
+func (bitverseObserver *BitverseObserver) OnDisconnected(node *bitverse.EdgeNode, remoteNode *bitverse.RemoteNode) {
+	fmt.Println("-> lost connection to super node " + remoteNode.Id() + ", reconnecting")
+}
+
 func (bitverseObserver *BitverseObserver) OnConnected(node *bitverse.EdgeNode, remoteNode *bitverse.RemoteNode) {
 	fmt.Println("-> now connected to super node " + remoteNode.Id())
 
@@ -82,7 +86,7 @@ func (bitverseObserver *BitverseObserver) OnConnected(node *bitverse.EdgeNode, r
 func main() {
 	var done chan int
 
-	node, done := bitverse.MakeEdgeNode(bitverse.MakeWSTransport(), new(BitverseObserver))
+	node, done := bitverse.MakeEdgeNode(bitverse.MakeWSTransport(), nil, new(BitverseObserver))
 	//node.Debug()
 	fmt.Println("-> my id is " + node.Id())
 
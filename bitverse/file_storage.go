@@ -0,0 +1,312 @@
+package bitverse
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// the log is compacted when it contains more obsolete than live records
+const FILE_STORAGE_COMPACTION_THRESHOLD = 1000
+
+// log record operations
+const (
+	setOwnerOp = iota
+	putOp
+	deleteOp
+	dropRepoOp
+	setNoncesOp
+	setAclOp
+	putAllOp
+)
+
+type logRecord struct {
+	Op           int
+	RepoId       string
+	Key          string                `json:",omitempty"`
+	Owner        string                `json:",omitempty"`
+	Entry        *RepoEntry            `json:",omitempty"`
+	Nonces       []int64               `json:",omitempty"` // written by older versions, not by signer and ignored
+	SignerNonces map[string][]int64    `json:",omitempty"`
+	Acl          *RepoAcl              `json:",omitempty"`
+	Entries      map[string]*RepoEntry `json:",omitempty"` // written by one record so that they are applied together
+}
+
+// FileStorage is an append-only log of all changes, kept in a single file.
+// Everything is also kept in memory, the log is replayed when the file is
+// opened and rewritten (compacted) when it contains too many obsolete records.
+type FileStorage struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	writer   *bufio.Writer
+	mem      *MemStorage
+	records  int // number of records in the log
+}
+
+func MakeFileStorage(filename string) (*FileStorage, error) {
+	fileStorage := new(FileStorage)
+	fileStorage.filename = filename
+	fileStorage.mem = MakeMemStorage()
+
+	if err := fileStorage.replay(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fileStorage.file = file
+	fileStorage.writer = bufio.NewWriter(file)
+
+	return fileStorage, nil
+}
+
+func (fileStorage *FileStorage) Owner(repoId string) (string, error) {
+	return fileStorage.mem.Owner(repoId)
+}
+
+func (fileStorage *FileStorage) SetOwner(repoId string, owner string) error {
+	return fileStorage.append(&logRecord{Op: setOwnerOp, RepoId: repoId, Owner: owner})
+}
+
+func (fileStorage *FileStorage) Get(repoId string, key string) (*RepoEntry, error) {
+	return fileStorage.mem.Get(repoId, key)
+}
+
+func (fileStorage *FileStorage) Put(repoId string, key string, entry *RepoEntry) error {
+	return fileStorage.append(&logRecord{Op: putOp, RepoId: repoId, Key: key, Entry: entry})
+}
+
+func (fileStorage *FileStorage) PutAll(repoId string, entries map[string]*RepoEntry) error {
+	return fileStorage.append(&logRecord{Op: putAllOp, RepoId: repoId, Entries: entries})
+}
+
+func (fileStorage *FileStorage) Delete(repoId string, key string) error {
+	return fileStorage.append(&logRecord{Op: deleteOp, RepoId: repoId, Key: key})
+}
+
+func (fileStorage *FileStorage) RepoIds() ([]string, error) {
+	return fileStorage.mem.RepoIds()
+}
+
+func (fileStorage *FileStorage) Keys(repoId string) ([]string, error) {
+	return fileStorage.mem.Keys(repoId)
+}
+
+func (fileStorage *FileStorage) Nonces(repoId string) (map[string][]int64, error) {
+	return fileStorage.mem.Nonces(repoId)
+}
+
+func (fileStorage *FileStorage) SetNonces(repoId string, nonces map[string][]int64) error {
+	return fileStorage.append(&logRecord{Op: setNoncesOp, RepoId: repoId, SignerNonces: nonces})
+}
+
+func (fileStorage *FileStorage) Acl(repoId string) (*RepoAcl, error) {
+	return fileStorage.mem.Acl(repoId)
+}
+
+func (fileStorage *FileStorage) SetAcl(repoId string, acl *RepoAcl) error {
+	return fileStorage.append(&logRecord{Op: setAclOp, RepoId: repoId, Acl: acl})
+}
+
+func (fileStorage *FileStorage) DropRepo(repoId string) error {
+	return fileStorage.append(&logRecord{Op: dropRepoOp, RepoId: repoId})
+}
+
+func (fileStorage *FileStorage) Close() error {
+	fileStorage.lock.Lock()
+	defer fileStorage.lock.Unlock()
+
+	if fileStorage.file == nil {
+		return nil
+	}
+
+	err := fileStorage.writer.Flush()
+	if closeErr := fileStorage.file.Close(); err == nil {
+		err = closeErr
+	}
+	fileStorage.file = nil
+	return err
+}
+
+/// PRIVATE
+
+// Writes the record to the log before applying it to the in-memory state
+func (fileStorage *FileStorage) append(record *logRecord) error {
+	fileStorage.lock.Lock()
+	defer fileStorage.lock.Unlock()
+
+	if fileStorage.file == nil {
+		return errors.New("storage: " + fileStorage.filename + " is closed")
+	}
+
+	if err := fileStorage.write(record); err != nil {
+		return err
+	}
+	fileStorage.apply(record)
+
+	if fileStorage.records > FILE_STORAGE_COMPACTION_THRESHOLD && fileStorage.records > 2*fileStorage.liveRecords() {
+		if err := fileStorage.compact(); err != nil {
+			info("storage: failed to compact " + fileStorage.filename + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (fileStorage *FileStorage) write(record *logRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	fileStorage.writer.Write(data)
+	fileStorage.writer.WriteByte('\n')
+	if err := fileStorage.writer.Flush(); err != nil {
+		return err
+	}
+	if err := fileStorage.file.Sync(); err != nil {
+		return err
+	}
+
+	fileStorage.records++
+	return nil
+}
+
+func (fileStorage *FileStorage) apply(record *logRecord) {
+	mem := fileStorage.mem
+	switch record.Op {
+	case setOwnerOp:
+		mem.SetOwner(record.RepoId, record.Owner)
+	case putOp:
+		if record.Entry != nil {
+			mem.Put(record.RepoId, record.Key, record.Entry)
+		}
+	case deleteOp:
+		mem.Delete(record.RepoId, record.Key)
+	case dropRepoOp:
+		mem.DropRepo(record.RepoId)
+	case setNoncesOp:
+		mem.SetNonces(record.RepoId, record.SignerNonces)
+	case setAclOp:
+		mem.SetAcl(record.RepoId, record.Acl)
+	case putAllOp:
+		mem.PutAll(record.RepoId, record.Entries)
+	}
+}
+
+func (fileStorage *FileStorage) replay() error {
+	file, err := os.Open(fileStorage.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	offset := int64(0) // end of the last complete record
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// the last record was only partly written, e.g. because of a crash. Cut it
+				// off, records appended after it would be glued to it.
+				info("storage: removing truncated record at the end of " + fileStorage.filename)
+				return os.Truncate(fileStorage.filename, offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return errors.New("storage: corrupt record in " + fileStorage.filename + ": " + err.Error())
+		}
+		fileStorage.apply(&record)
+		fileStorage.records++
+		offset += int64(len(line))
+	}
+}
+
+// Returns the number of records needed to describe the current state
+func (fileStorage *FileStorage) liveRecords() int {
+	mem := fileStorage.mem
+	mem.lock.RLock()
+	defer mem.lock.RUnlock()
+
+	n := len(mem.owners) + len(mem.nonces) + len(mem.acls)
+	for _, repo := range mem.repos {
+		n += len(repo)
+	}
+	return n
+}
+
+// Rewrites the log so that it only contains the current state
+func (fileStorage *FileStorage) compact() error {
+	debug("storage: compacting " + fileStorage.filename)
+
+	tmpFilename := fileStorage.filename + ".compact"
+	tmpFile, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+	records := 0
+
+	mem := fileStorage.mem
+	mem.lock.RLock()
+	for repoId, owner := range mem.owners {
+		encoder.Encode(&logRecord{Op: setOwnerOp, RepoId: repoId, Owner: owner})
+		records++
+	}
+	for repoId, nonces := range mem.nonces {
+		encoder.Encode(&logRecord{Op: setNoncesOp, RepoId: repoId, SignerNonces: nonces})
+		records++
+	}
+	for repoId, acl := range mem.acls {
+		encoder.Encode(&logRecord{Op: setAclOp, RepoId: repoId, Acl: acl})
+		records++
+	}
+	for repoId, repo := range mem.repos {
+		for key, entry := range repo {
+			encoder.Encode(&logRecord{Op: putOp, RepoId: repoId, Key: key, Entry: entry})
+			records++
+		}
+	}
+	mem.lock.RUnlock()
+
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	if err := os.Rename(tmpFilename, fileStorage.filename); err != nil {
+		return err
+	}
+
+	// continue appending to the new file
+	file, err := os.OpenFile(fileStorage.filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fileStorage.file.Close()
+	fileStorage.file = file
+	fileStorage.writer = bufio.NewWriter(file)
+	fileStorage.records = records
+	return nil
+}
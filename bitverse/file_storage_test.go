@@ -0,0 +1,151 @@
+package bitverse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitverse")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "supernode.db")
+
+	storage, err := MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+
+	storage.SetOwner("repo", "pub")
+	storage.Put("repo", "a", &RepoEntry{Value: "1", Version: 1})
+	storage.Put("repo", "b", &RepoEntry{Value: "2", Version: 1})
+	storage.Put("repo", "a", &RepoEntry{Value: "3", Version: 2})
+	storage.Delete("repo", "b")
+	storage.Put("other", "c", &RepoEntry{Value: "4", Version: 1})
+	storage.DropRepo("other")
+	storage.SetNonces("repo", map[string][]int64{"pub": []int64{1, 2}})
+	storage.SetAcl("repo", &RepoAcl{Version: 1, Grants: map[string]RepoRight{"member": RepoWrite}})
+	storage.PutAll("repo", map[string]*RepoEntry{"c": &RepoEntry{Value: "5", Version: 1}, "d": &RepoEntry{Value: "6", Version: 1}})
+	storage.Close()
+
+	storage, err = MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	owner, _ := storage.Owner("repo")
+	if owner != "pub" {
+		t.Fatalf("expected owner pub, got %s", owner)
+	}
+
+	entry, _ := storage.Get("repo", "a")
+	if entry == nil || entry.Value != "3" || entry.Version != 2 {
+		t.Fatalf("expected value 3 version 2, got %v", entry)
+	}
+
+	if nonces, _ := storage.Nonces("repo"); len(nonces["pub"]) != 2 || nonces["pub"][1] != 2 {
+		t.Fatalf("expected nonces 1 and 2, got %v", nonces)
+	}
+
+	if acl, _ := storage.Acl("repo"); acl == nil || acl.Grants["member"] != RepoWrite {
+		t.Fatalf("expected member to have write right, got %v", acl)
+	}
+
+	if keys, _ := storage.Keys("repo"); len(keys) != 3 || keys[1] != "c" || keys[2] != "d" {
+		t.Fatalf("expected keys a, c and d, got %v", keys)
+	}
+
+	if entry, _ := storage.Get("repo", "b"); entry != nil {
+		t.Fatalf("expected key b to be deleted, got %v", entry)
+	}
+
+	repoIds, _ := storage.RepoIds()
+	if len(repoIds) != 1 || repoIds[0] != "repo" {
+		t.Fatalf("expected only repo to remain, got %v", repoIds)
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitverse")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "supernode.db")
+
+	storage, err := MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+
+	for i := 0; i < 3*FILE_STORAGE_COMPACTION_THRESHOLD; i++ {
+		storage.Put("repo", fmt.Sprintf("key%d", i%10), &RepoEntry{Value: fmt.Sprintf("%d", i), Version: int64(i + 1)})
+	}
+
+	if storage.records > FILE_STORAGE_COMPACTION_THRESHOLD+1 {
+		t.Fatalf("expected the log to be compacted, it has %d records", storage.records)
+	}
+	storage.Close()
+
+	storage, err = MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	keys, _ := storage.Keys("repo")
+	if len(keys) != 10 {
+		t.Fatalf("expected 10 keys, got %d", len(keys))
+	}
+
+	entry, _ := storage.Get("repo", "key9")
+	expected := fmt.Sprintf("%d", 3*FILE_STORAGE_COMPACTION_THRESHOLD-1)
+	if entry == nil || entry.Value != expected {
+		t.Fatalf("expected value %s, got %v", expected, entry)
+	}
+}
+
+func TestFileStorageTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitverse")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "supernode.db")
+
+	storage, err := MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	storage.Put("repo", "a", &RepoEntry{Value: "1", Version: 1})
+	storage.Close()
+
+	// a crash in the middle of writing a record
+	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"Op":1,"RepoId":"repo","Key":"b","Entry":{"Val`)
+	file.Close()
+
+	storage, err = MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen storage after torn write: %v", err)
+	}
+	storage.Put("repo", "c", &RepoEntry{Value: "3", Version: 1})
+	storage.Close()
+
+	// the record written after the torn one must not be lost
+	storage, err = MakeFileStorage(filename)
+	if err != nil {
+		t.Fatalf("failed to reopen storage a second time: %v", err)
+	}
+	defer storage.Close()
+
+	if keys, _ := storage.Keys("repo"); len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Fatalf("expected keys a and c, got %v", keys)
+	}
+}
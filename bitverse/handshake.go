@@ -0,0 +1,175 @@
+package bitverse
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+)
+
+// The handshake is a challenge-response protocol proving that both nodes own
+// the private keys of their ids:
+//
+//   1. client -> server: client id, public key and a random challenge
+//   2. server -> client: server id, public key, a random challenge and a
+//      signature of the client challenge
+//   3. client -> server: a signature of the server challenge
+//
+// The signatures also cover the id and advertised address of the signer. The
+// server only accepts other messages on the link once the client has answered
+// its challenge. The super node then only accepts messages whose source is the
+// authenticated id, unless the link comes from a super node, i.e. the node
+// reached when connecting to the address it advertises (see SuperNode.receive).
+// Super nodes are trusted to relay messages from other nodes, require client
+// certificates (see LoadTLSConfig) to restrict who may run one.
+
+const HANDSHAKE_CHALLENGE_SIZE = 32
+
+// Sent as the payload of handshake messages
+type handshakeProofType struct {
+	PublicKey string // base64 encoded PKIX public key
+	Challenge string // base64 encoded random challenge the other node has to sign
+	Signature string // base64 encoded signature of the challenge of the other node
+}
+
+// The server side of a handshake
+type serverHandshakeType struct {
+	identity      *Identity
+	localAddress  string
+	challenge     string
+	hello         *Msg // the first handshake message of the client
+	authenticated bool
+}
+
+func makeServerHandshake(identity *Identity, localAddress string) *serverHandshakeType {
+	handshake := new(serverHandshakeType)
+	handshake.identity = identity
+	handshake.localAddress = localAddress
+	return handshake
+}
+
+// Handles a handshake message from the client and returns the reply to send,
+// if any. The client is authenticated once receive returns without error and
+// the authenticated flag is set.
+func (handshake *serverHandshakeType) receive(msg *Msg) (*Msg, error) {
+	if handshake.authenticated {
+		return nil, errors.New("handshake: already authenticated")
+	}
+
+	if handshake.hello == nil {
+		proof, err := verifyHandshakeIdentity(msg)
+		if err != nil {
+			return nil, err
+		}
+		if proof.Challenge == "" {
+			return nil, errors.New("handshake: missing challenge")
+		}
+
+		hello := *msg
+		handshake.hello = &hello
+		handshake.challenge = makeChallenge()
+		return composeHandshakeMsg(handshake.identity, handshake.localAddress, handshake.challenge, proof.Challenge), nil
+	}
+
+	if msg.Src != handshake.hello.Src || msg.Origin != handshake.hello.Origin {
+		return nil, errors.New("handshake: node id changed during handshake")
+	}
+	if _, err := verifyHandshake(msg, handshake.challenge); err != nil {
+		return nil, err
+	}
+
+	handshake.authenticated = true
+	return nil, nil
+}
+
+/// PRIVATE
+
+func makeChallenge() string {
+	challenge := make([]byte, HANDSHAKE_CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		panic(err)
+	}
+	return encodeBase64(challenge)
+}
+
+// Returns the digest signed to answer a challenge
+func handshakeDigest(src string, origin string, challenge string) []byte {
+	digest := sha256.Sum256([]byte("bitverse-handshake:" + src + ":" + origin + ":" + challenge))
+	return digest[:]
+}
+
+// Composes a handshake message with our public key. If challenge is set, the
+// other node has to sign it. If peerChallenge is set, we sign it.
+func (identity *Identity) composeHandshakeProof(msg *Msg, challenge string, peerChallenge string) error {
+	der, err := x509.MarshalPKIXPublicKey(&identity.privateKey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	proof := handshakeProofType{PublicKey: encodeBase64(der), Challenge: challenge}
+	if peerChallenge != "" {
+		signature, err := ecdsa.SignASN1(rand.Reader, identity.privateKey, handshakeDigest(msg.Src, msg.Origin, peerChallenge))
+		if err != nil {
+			return err
+		}
+		proof.Signature = encodeBase64(signature)
+	}
+
+	proofJson, err := json.Marshal(proof)
+	if err != nil {
+		return err
+	}
+	msg.Payload = string(proofJson)
+	return nil
+}
+
+// Checks that the public key in a handshake message matches msg.Src
+func verifyHandshakeIdentity(msg *Msg) (*handshakeProofType, error) {
+	var proof handshakeProofType
+	if err := json.Unmarshal([]byte(msg.Payload), &proof); err != nil {
+		return nil, errors.New("handshake: missing proof of identity")
+	}
+
+	der, err := decodeBase64(proof.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeId := makeNodeIdFromPublicKey(der)
+	if nodeId.String() != msg.Src {
+		return nil, errors.New("handshake: public key does not match node id " + msg.Src)
+	}
+
+	return &proof, nil
+}
+
+// Checks that the sender of a handshake message owns the id in msg.Src by
+// verifying its signature of challenge, and returns its proof
+func verifyHandshake(msg *Msg, challenge string) (*handshakeProofType, error) {
+	proof, err := verifyHandshakeIdentity(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _ := decodeBase64(proof.PublicKey)
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaPublicKey, ok := publicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("handshake: unsupported public key")
+	}
+
+	signature, err := decodeBase64(proof.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if !ecdsa.VerifyASN1(ecdsaPublicKey, handshakeDigest(msg.Src, msg.Origin, challenge), signature) {
+		return nil, errors.New("handshake: invalid signature")
+	}
+
+	return proof, nil
+}
@@ -0,0 +1,84 @@
+package bitverse
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	client, _ := GenerateIdentity()
+	server, _ := GenerateIdentity()
+	other, _ := GenerateIdentity()
+
+	challenge := makeChallenge()
+	hello := composeHandshakeMsg(client, "", challenge, "")
+
+	handshake := makeServerHandshake(server, "localhost:1111")
+	reply, err := handshake.receive(hello)
+	if err != nil || reply == nil {
+		t.Fatalf("server rejected hello: %v", err)
+	}
+
+	proof, err := verifyHandshake(reply, challenge)
+	if err != nil {
+		t.Fatalf("client rejected server: %v", err)
+	}
+	if _, err := verifyHandshake(reply, makeChallenge()); err == nil {
+		t.Fatal("accepted a signature of another challenge")
+	}
+
+	// answering with another key must fail
+	spoofed := composeHandshakeMsg(other, "", "", proof.Challenge)
+	spoofed.Src = client.Id()
+	if _, err := makeServerHandshake(server, "").receive(spoofed); err == nil {
+		t.Fatal("accepted a hello with a public key not matching the node id")
+	}
+
+	answer := composeHandshakeMsg(client, "", "", proof.Challenge)
+	if _, err := handshake.receive(answer); err != nil || !handshake.authenticated {
+		t.Fatalf("server rejected answer: %v", err)
+	}
+}
+
+func TestRejectSpoofedSrc(t *testing.T) {
+	port := freePort(t)
+	MakeSuperNode(MakeTCPTransport(), nil, MakeMemStorage(), "localhost", port)
+	time.Sleep(100 * time.Millisecond)
+
+	// connects a node to the super node, advertising address unless empty
+	connect := func(address string) (*Identity, *RemoteNode, chan Msg) {
+		identity, _ := GenerateIdentity()
+		transport := MakeTCPTransport()
+		transport.SetIdentity(identity)
+		transport.SetLocalAddress(address)
+		remoteNodeChannel := make(chan *RemoteNode, 10)
+		msgChannel := make(chan Msg, 10)
+		go transport.ConnectToNode("localhost:"+port, remoteNodeChannel, msgChannel)
+		return identity, <-remoteNodeChannel, msgChannel
+	}
+
+	dst, _, dstChannel := connect("")
+	src, superNode, _ := connect("")
+	// nothing is listening at the address, so it cannot be a super node
+	impostor, impostorSuperNode, _ := connect("localhost:" + freePort(t))
+	time.Sleep(100 * time.Millisecond)
+
+	superNode.deliver(composeMsgServiceMsg(impostor.Id(), dst.Id(), "service", "spoofed"))
+	impostorSuperNode.deliver(composeMsgServiceMsg(src.Id(), dst.Id(), "service", "relayed"))
+	superNode.deliver(composeMsgServiceMsg(src.Id(), dst.Id(), "service", "genuine"))
+
+	for {
+		select {
+		case msg := <-dstChannel:
+			if msg.Type != Data {
+				continue // notifications about the other children
+			}
+			if msg.Payload != "genuine" {
+				t.Fatalf("expected the spoofed messages to be dropped, got %s", msg.Payload)
+			}
+			return
+		case <-time.After(10 * time.Second):
+			t.Fatal("genuine message not delivered")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package bitverse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+// An Identity is the ECDSA P-256 keypair of a node. The node id is the SHA-1
+// hash of the public key, so a node can prove that it owns its id by signing
+// with the private key.
+type Identity struct {
+	privateKey *ecdsa.PrivateKey
+	nodeId     NodeId
+}
+
+func GenerateIdentity() (*Identity, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeIdentity(privateKey)
+}
+
+// Loads a PEM encoded identity created by Save
+func LoadIdentity(filename string) (*Identity, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("no identity found in " + filename)
+	}
+
+	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return makeIdentity(privateKey)
+}
+
+// Loads the identity stored in filename, or generates a new one and stores it
+// there if the file does not exist. This gives a node the same id every time
+// it starts.
+func LoadOrCreateIdentity(filename string) (*Identity, error) {
+	identity, err := LoadIdentity(filename)
+	if !os.IsNotExist(err) {
+		return identity, err
+	}
+
+	identity, err = GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	return identity, identity.Save(filename)
+}
+
+// Stores the identity PEM encoded in filename, only readable by the owner
+func (identity *Identity) Save(filename string) error {
+	der, err := x509.MarshalECPrivateKey(identity.privateKey)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return ioutil.WriteFile(filename, data, 0600)
+}
+
+func (identity *Identity) Id() string {
+	return identity.nodeId.String()
+}
+
+/// PRIVATE
+
+func makeIdentity(privateKey *ecdsa.PrivateKey) (*Identity, error) {
+	identity := new(Identity)
+	identity.privateKey = privateKey
+
+	der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	identity.nodeId = makeNodeIdFromPublicKey(der)
+
+	return identity, nil
+}
+
+// Returns identity, or a new random identity if identity is nil
+func identityOrGenerate(identity *Identity) *Identity {
+	if identity != nil {
+		return identity
+	}
+
+	identity, err := GenerateIdentity()
+	if err != nil {
+		panic(err)
+	}
+	return identity
+}
+
+func makeNodeIdFromPublicKey(der []byte) NodeId {
+	hash := sha1.Sum(der)
+
+	nodeId := NodeId{}
+	nodeId.hashkey = encodeHex(hash[:])
+	return nodeId
+}
@@ -0,0 +1,33 @@
+package bitverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitverse")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "node.key")
+
+	identity1, err := LoadOrCreateIdentity(filename)
+	if err != nil {
+		t.Fatalf("failed to create identity: %v", err)
+	}
+	identity2, err := LoadOrCreateIdentity(filename)
+	if err != nil {
+		t.Fatalf("failed to load identity: %v", err)
+	}
+
+	if identity1.Id() != identity2.Id() {
+		t.Fatalf("expected the same id after loading, got %s and %s", identity1.Id(), identity2.Id())
+	}
+	if len(identity1.Id()) != 40 {
+		t.Fatalf("expected a SHA-1 hex id, got %s", identity1.Id())
+	}
+}
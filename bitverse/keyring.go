@@ -0,0 +1,123 @@
+package bitverse
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long messages encrypted with a rotated key are still accepted
+const KEY_GRACE_PERIOD time.Duration = 3600
+
+type keyringKeyType struct {
+	key     string    // hex encoded AES key
+	retired time.Time // when the key was rotated out, zero while it is current or if it was only added
+}
+
+// keyringType holds the current AES key of a msg service, used to encrypt,
+// and older keys still accepted when decrypting. Ciphertexts carry the id of
+// their key, see encryptAesWithKeyId
+type keyringType struct {
+	lock        sync.RWMutex
+	current     string
+	keys        map[string]*keyringKeyType // by key id
+	gracePeriod time.Duration
+	legacy      bool // set to accept the unauthenticated format of older versions, see decryptAesLegacy
+}
+
+func makeKeyring(key string) (*keyringType, error) {
+	if err := checkAesKey(key); err != nil {
+		return nil, err
+	}
+
+	keyring := new(keyringType)
+	keyring.current = key
+	keyring.keys = map[string]*keyringKeyType{aesKeyId(key): &keyringKeyType{key: key}}
+	keyring.gracePeriod = time.Second * KEY_GRACE_PERIOD
+
+	return keyring, nil
+}
+
+/// PRIVATE
+
+// Accepts ciphertexts encrypted with key
+func (keyring *keyringType) add(key string) error {
+	if err := checkAesKey(key); err != nil {
+		return err
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+	if keyring.keys[aesKeyId(key)] == nil {
+		keyring.keys[aesKeyId(key)] = &keyringKeyType{key: key}
+	}
+	return nil
+}
+
+// Makes key the current key, the previous key is retired
+func (keyring *keyringType) rotate(key string) error {
+	if err := keyring.add(key); err != nil {
+		return err
+	}
+
+	keyring.lock.Lock()
+	defer keyring.lock.Unlock()
+	if key == keyring.current {
+		return nil
+	}
+	keyring.keys[aesKeyId(keyring.current)].retired = time.Now()
+	keyring.keys[aesKeyId(key)].retired = time.Time{}
+	keyring.current = key
+	return nil
+}
+
+func (keyring *keyringType) encrypt(text string, additionalData string) string {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+	return encryptAesWithKeyId(keyring.current, text, additionalData)
+}
+
+// Decrypts ciphertext with the key it was encrypted with. If withinGrace is set,
+// keys that were retired longer than the grace period ago are not accepted.
+// Ciphertexts without a key id are tried with all keys, the current key first.
+func (keyring *keyringType) decrypt(ciphertext string, additionalData string, withinGrace bool) (string, error) {
+	keyring.lock.RLock()
+	defer keyring.lock.RUnlock()
+
+	if keyId, ok := aesCiphertextKeyId(ciphertext); ok {
+		entry := keyring.keys[keyId]
+		if entry == nil {
+			return "", errors.New("unknown key " + keyId)
+		}
+		if withinGrace && keyring.expired(entry) {
+			return "", errors.New("key " + keyId + " has been rotated out")
+		}
+		return keyring.decryptAes(entry.key, ciphertext, additionalData)
+	}
+
+	text, err := keyring.decryptAes(keyring.current, ciphertext, additionalData)
+	if err == nil {
+		return text, nil
+	}
+	for _, entry := range keyring.keys {
+		if entry.key == keyring.current || (withinGrace && keyring.expired(entry)) {
+			continue
+		}
+		if text, err := keyring.decryptAes(entry.key, ciphertext, additionalData); err == nil {
+			return text, nil
+		}
+	}
+	return "", err
+}
+
+// The caller must hold the lock
+func (keyring *keyringType) decryptAes(key string, ciphertext string, additionalData string) (string, error) {
+	if keyring.legacy {
+		return decryptAesLegacy(key, ciphertext, additionalData)
+	}
+	return decryptAes(key, ciphertext, additionalData)
+}
+
+func (keyring *keyringType) expired(entry *keyringKeyType) bool {
+	return !entry.retired.IsZero() && time.Since(entry.retired) > keyring.gracePeriod
+}
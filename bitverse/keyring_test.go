@@ -0,0 +1,136 @@
+package bitverse
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	oldKey, _ := GenerateAesSecret()
+	newKey, _ := GenerateAesSecret()
+	keyring, err := makeKeyring(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldCiphertext := keyring.encrypt("old", "data")
+	if keyId, ok := aesCiphertextKeyId(oldCiphertext); !ok || keyId != aesKeyId(oldKey) {
+		t.Error("expected key id in ciphertext " + oldCiphertext)
+	}
+	legacyCiphertext := encryptAes(oldKey, "legacy", "data")
+
+	if err := keyring.rotate(newKey); err != nil {
+		t.Fatal(err)
+	}
+	newCiphertext := keyring.encrypt("new", "data")
+	if !strings.Contains(newCiphertext, aesKeyId(newKey)) {
+		t.Error("expected new key to be used")
+	}
+
+	for ciphertext, expected := range map[string]string{oldCiphertext: "old", legacyCiphertext: "legacy", newCiphertext: "new"} {
+		if text, err := keyring.decrypt(ciphertext, "data", true); err != nil || text != expected {
+			t.Errorf("failed to decrypt %s during grace period: %v", expected, err)
+		}
+	}
+
+	keyring.gracePeriod = 0
+	time.Sleep(time.Millisecond)
+	if _, err := keyring.decrypt(oldCiphertext, "data", true); err == nil {
+		t.Error("expected rotated key to be rejected after the grace period")
+	}
+	if _, err := keyring.decrypt(legacyCiphertext, "data", true); err == nil {
+		t.Error("expected rotated key to be rejected after the grace period")
+	}
+	if text, err := keyring.decrypt(oldCiphertext, "data", false); err != nil || text != "old" {
+		t.Error("expected rotated key to be accepted outside the grace period")
+	}
+
+	otherKey, _ := GenerateAesSecret()
+	if _, err := keyring.decrypt(encryptAesWithKeyId(otherKey, "other", "data"), "data", false); err == nil {
+		t.Error("expected unknown key to be rejected")
+	}
+
+	// the unauthenticated format of older versions only if asked for
+	cfbCiphertext := encryptAesCfb(t, newKey, "cfb")
+	if _, err := keyring.decrypt(cfbCiphertext, "data", false); err == nil {
+		t.Error("expected unauthenticated ciphertext to be rejected")
+	}
+	keyring.legacy = true
+	if text, err := keyring.decrypt(cfbCiphertext, "data", false); err != nil || text != "cfb" {
+		t.Errorf("expected legacy ciphertext to be accepted: %v", err)
+	}
+}
+
+func TestRepoReEncrypt(t *testing.T) {
+	network := MakeMemNetwork()
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, _ := GenerateAesSecret()
+	newKey, _ := GenerateAesSecret()
+
+	result := make(chan interface{}, 1)
+	callback := func(err error, data interface{}) {
+		if err != nil {
+			result <- err
+		} else {
+			result <- data
+		}
+	}
+
+	edgeNode1, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode1.Connect("super:1111")
+	edgeNode2, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode2.Connect("super:1111")
+	time.Sleep(300 * time.Millisecond)
+
+	edgeNode1.ClaimOwnership("repo", oldKey, prv, pub, 5, callback)
+	repoService1, ok := (<-result).(*RepoService)
+	if !ok {
+		t.Fatal("failed to claim repo")
+	}
+	repoService1.Store("a", "value a", 5, callback)
+	<-result
+	repoService1.StoreWithTTL("b", "value b", time.Hour, 5, callback)
+	<-result
+
+	if err := repoService1.RotateKey(newKey); err != nil {
+		t.Fatal(err)
+	}
+	edgeNode2.ClaimOwnership("repo", newKey, prv, pub, 5, callback)
+	repoService2, ok := (<-result).(*RepoService)
+	if !ok {
+		t.Fatal("failed to claim repo")
+	}
+	repoService2.Lookup("a", 2, callback)
+	if value := <-result; value == "value a" {
+		t.Fatal("expected value under the old key to be unreadable with the new key only")
+	}
+
+	repoService1.ReEncrypt([]string{"a", "b", "missing"}, 5, callback)
+	if count := <-result; count != 2 {
+		t.Fatalf("expected 2 re-encrypted values, got %v", count)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		repoService2.Lookup(key, 5, callback)
+		if value := <-result; value != "value "+key {
+			t.Fatalf("failed to look up %s with the new key: %v", key, value)
+		}
+	}
+
+	// values keep their expiry
+	repoService2.LookupVersion("a", 5, callback)
+	if value, ok := (<-result).(*RepoValue); !ok || value.TTL != 0 {
+		t.Fatalf("expected a not to expire, got %v", value)
+	}
+	repoService2.LookupVersion("b", 5, callback)
+	if value, ok := (<-result).(*RepoValue); !ok || value.TTL <= 0 || value.TTL > time.Hour {
+		t.Fatalf("expected b to expire within an hour, got %v", value)
+	}
+}
@@ -0,0 +1,235 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const MAILBOX_QUOTA = 100
+const MAILBOX_TTL time.Duration = 3600
+
+// Messages to edge nodes that are not connected to any super node are held in
+// a mailbox on the super node responsible for the edge node id in the DHT, the
+// same super node that stores its location record. The mail is handed over when
+// the edge node connects again and its location is published.
+type mailType struct {
+	Msg     Msg
+	Expires int64 // unix time when the message is dropped
+}
+
+type mailboxType struct {
+	lock sync.Mutex
+	mail map[string][]*mailType // edge node id:mail
+}
+
+type publishLocationReply struct {
+	Mail []Msg // mail held for the edge node
+}
+
+// Acknowledges mail that has been handed over, so that it can be removed
+type ackMailArgs struct {
+	NodeId string
+	MsgIds []string
+}
+
+func makeMailbox() *mailboxType {
+	mailbox := new(mailboxType)
+	mailbox.mail = make(map[string][]*mailType)
+	return mailbox
+}
+
+func (mailbox *mailboxType) deposit(mail *mailType) error {
+	mailbox.lock.Lock()
+	defer mailbox.lock.Unlock()
+
+	nodeId := mail.Msg.Dst
+	if len(mailbox.mail[nodeId]) >= MAILBOX_QUOTA {
+		return errors.New("mailbox of " + nodeId + " is full")
+	}
+
+	mailbox.mail[nodeId] = append(mailbox.mail[nodeId], mail)
+	return nil
+}
+
+// Returns the mail held for nodeId, oldest first. The mail is kept until it is
+// removed, once it has been handed over.
+func (mailbox *mailboxType) peek(nodeId string) []*mailType {
+	mailbox.lock.Lock()
+	defer mailbox.lock.Unlock()
+
+	return append([]*mailType(nil), mailbox.mail[nodeId]...)
+}
+
+// Removes the mail with the given msg ids held for nodeId
+func (mailbox *mailboxType) remove(nodeId string, msgIds []string) {
+	mailbox.lock.Lock()
+	defer mailbox.lock.Unlock()
+
+	removed := make(map[string]bool)
+	for _, msgId := range msgIds {
+		removed[msgId] = true
+	}
+
+	var kept []*mailType
+	for _, m := range mailbox.mail[nodeId] {
+		if !removed[m.Msg.Id] {
+			kept = append(kept, m)
+		}
+	}
+
+	if len(kept) == 0 {
+		delete(mailbox.mail, nodeId)
+	} else {
+		mailbox.mail[nodeId] = kept
+	}
+}
+
+func (mailbox *mailboxType) recipients() []string {
+	mailbox.lock.Lock()
+	defer mailbox.lock.Unlock()
+
+	nodeIds := make([]string, 0, len(mailbox.mail))
+	for nodeId, _ := range mailbox.mail {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	return nodeIds
+}
+
+func (mailbox *mailboxType) expire() {
+	mailbox.lock.Lock()
+	defer mailbox.lock.Unlock()
+
+	now := time.Now().Unix()
+	for nodeId, mail := range mailbox.mail {
+		var kept []*mailType
+		for _, m := range mail {
+			if m.Expires >= now {
+				kept = append(kept, m)
+			} else {
+				debug("mailbox: message " + m.Msg.Id + " to " + nodeId + " expired")
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(mailbox.mail, nodeId)
+		} else {
+			mailbox.mail[nodeId] = kept
+		}
+	}
+}
+
+/// PRIVATE
+
+// Holds msg in the mailbox of its destination until the destination connects,
+// only data messages are held. Runs in a separate go routine.
+func (superNode *SuperNode) depositMail(msg Msg) {
+	if msg.Type != Data {
+		debug("supernode: failed to deliver " + msg.String() + ", dropping message")
+		return
+	}
+
+	msg.Origin = ""
+	mail := mailType{msg, time.Now().Add(time.Second * MAILBOX_TTL).Unix()}
+
+	addresses, err := superNode.lookup(msg.Dst, 1)
+	if err == nil {
+		err = superNode.rpc.call(addresses[0], "mailbox.Deposit", mail, nil)
+	}
+	if err != nil {
+		info("supernode: failed to queue message to " + msg.Dst + ": " + err.Error())
+		return
+	}
+
+	debug("supernode: queued message " + msg.Id + " to " + msg.Dst)
+	superNode.sendReceipt(msg, Queued)
+}
+
+// Delivers mail held for one of our children, called when its location has
+// been published. Returns the ids of the messages written to the child, the
+// rest stays in the mailbox until the location is renewed.
+func (superNode *SuperNode) deliverMail(mail []Msg) []string {
+	var delivered []string
+	for _, msg := range mail {
+		debug("supernode: delivering queued message " + msg.Id + " to " + msg.Dst)
+		if err := superNode.replyToChild(msg); err != nil {
+			info("supernode: failed to deliver queued message " + msg.Id + " to " + msg.Dst + ": " + err.Error())
+			continue
+		}
+		superNode.sendReceipt(msg, Delivered)
+		delivered = append(delivered, msg.Id)
+	}
+	return delivered
+}
+
+// Sends a delivery receipt to the sender of msg, if it asked for one. May be
+// called outside the main loop.
+func (superNode *SuperNode) sendReceipt(msg Msg, status string) {
+	if !msg.WantReceipt || msg.Type != Data {
+		return
+	}
+
+	receipt := composeReceiptMsg(&msg, superNode.Id(), status)
+
+	superNode.childrenLock.RLock()
+	remoteNode := superNode.children[receipt.Dst]
+	superNode.childrenLock.RUnlock()
+
+	if remoteNode != nil {
+		remoteNode.deliver(receipt)
+	} else {
+		superNode.forward(*receipt)
+	}
+}
+
+// Moves mail to the super node now responsible for the recipient, e.g. after
+// another super node joined the ring
+func (superNode *SuperNode) migrateMail() {
+	superNode.mailbox.expire()
+
+	for _, nodeId := range superNode.mailbox.recipients() {
+		addresses, err := superNode.lookup(nodeId, 1)
+		if err != nil || addresses[0] == superNode.address {
+			continue
+		}
+
+		// mail that could not be moved is kept and moved the next time
+		var moved []string
+		for _, mail := range superNode.mailbox.peek(nodeId) {
+			if err := superNode.rpc.call(addresses[0], "mailbox.Deposit", mail, nil); err != nil {
+				info("supernode: failed to move mail to " + addresses[0] + ": " + err.Error())
+				continue
+			}
+			moved = append(moved, mail.Msg.Id)
+		}
+		superNode.mailbox.remove(nodeId, moved)
+	}
+}
+
+func (superNode *SuperNode) serveDepositMail(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var mail mailType
+	if err := json.Unmarshal(argsJson, &mail); err != nil {
+		return nil, err
+	}
+
+	// if the edge node connected while the message was on its way, the mail is
+	// handed over when its location is renewed
+	return nil, superNode.mailbox.deposit(&mail)
+}
+
+func (superNode *SuperNode) serveAckMail(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args ackMailArgs
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	// only the super node hosting the edge node has been handed its mail
+	record := superNode.registry.lookup(args.NodeId)
+	if record == nil || record.Address != caller.address {
+		return nil, errors.New("mail to " + args.NodeId + " has not been handed to " + caller.address)
+	}
+
+	superNode.mailbox.remove(args.NodeId, args.MsgIds)
+	return nil, nil
+}
@@ -0,0 +1,141 @@
+package bitverse
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type mailObserver struct {
+	delivered chan string
+}
+
+func (mailObserver *mailObserver) OnDeliver(msgService *MsgService, msg *Msg) {
+	mailObserver.delivered <- msg.Payload
+}
+
+func TestMailbox(t *testing.T) {
+	network := MakeMemNetwork()
+	secret, _ := GenerateAesSecret()
+
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	_, msgService1 := makeMemEdgeNode(t, network, secret, "super:1111")
+	edgeNode2, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	observer := &mailObserver{make(chan string, 10)}
+	edgeNode2.CreateMsgService(secret, "ping", observer)
+	time.Sleep(100 * time.Millisecond)
+
+	statuses := make(chan string, 10)
+	msgService1.SendAndGetReceipt(edgeNode2.Id(), "hello", 10, func(err error, status interface{}) {
+		if err != nil {
+			statuses <- err.Error()
+		} else {
+			statuses <- status.(string)
+		}
+	})
+	if status := <-statuses; status != Queued {
+		t.Fatalf("expected the message to be queued, got %s", status)
+	}
+
+	go edgeNode2.Connect("super:1111")
+	select {
+	case payload := <-observer.delivered:
+		if payload != "hello" {
+			t.Fatalf("expected hello, got %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued message was not delivered")
+	}
+	if status := <-statuses; status != Delivered {
+		t.Fatalf("expected the message to be delivered, got %s", status)
+	}
+
+	msgService1.SendAndGetReceipt(edgeNode2.Id(), "hi", 10, func(err error, status interface{}) {
+		statuses <- status.(string)
+	})
+	if status := <-statuses; status != Delivered {
+		t.Fatalf("expected the message to be delivered directly, got %s", status)
+	}
+	<-observer.delivered
+}
+
+func TestMailboxQuota(t *testing.T) {
+	mailbox := makeMailbox()
+	for i := 0; i < MAILBOX_QUOTA; i++ {
+		if err := mailbox.deposit(&mailType{Msg: Msg{Dst: "a"}}); err != nil {
+			t.Fatalf("failed to deposit mail: %v", err)
+		}
+	}
+	if err := mailbox.deposit(&mailType{Msg: Msg{Dst: "a"}}); err == nil {
+		t.Fatal("expected the quota to be exceeded")
+	}
+
+	mailbox.expire()
+	if len(mailbox.peek("a")) != 0 {
+		t.Fatal("expected expired mail to be dropped")
+	}
+}
+
+func TestMailboxKeepsUndeliveredMail(t *testing.T) {
+	superNode, _ := MakeSuperNode(MakeMemNetwork().MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	expires := time.Now().Add(time.Minute).Unix()
+	superNode.mailbox.deposit(&mailType{Msg{Id: "1", Dst: "a", Type: Data}, expires})
+	superNode.mailbox.deposit(&mailType{Msg{Id: "2", Dst: "a", Type: Data}, expires})
+
+	// a is not connected
+	var mail []Msg
+	for _, m := range superNode.mailbox.peek("a") {
+		mail = append(mail, m.Msg)
+	}
+	if delivered := superNode.deliverMail(mail); len(delivered) != 0 {
+		t.Fatalf("expected no mail to be delivered, got %v", delivered)
+	}
+
+	superNode.mailbox.remove("a", []string{"1"})
+	if mail := superNode.mailbox.peek("a"); len(mail) != 1 || mail[0].Msg.Id != "2" {
+		t.Fatal("expected only acknowledged mail to be removed")
+	}
+}
+
+// Passes what is written to a link on to a channel
+type chanWriter struct {
+	written chan string
+}
+
+func (writer *chanWriter) Write(data []byte) (int, error) {
+	writer.written <- string(data)
+	return len(data), nil
+}
+
+func TestMailboxHoldsMessagesForDeadChildren(t *testing.T) {
+	superNode, _ := MakeSuperNode(MakeMemNetwork().MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+
+	sender := &chanWriter{make(chan string, 10)}
+	superNode.childrenLock.Lock()
+	superNode.children["sender"] = makeRemoteNode(make(chan *RemoteNode, 1), sender, "", "sender", "")
+	superNode.children["dead"] = makeRemoteNode(make(chan *RemoteNode, 1), &failingWriter{0}, "", "dead", "")
+	superNode.childrenLock.Unlock()
+
+	msg := composeMsgServiceMsg("sender", "dead", "ping", "hello")
+	msg.WantReceipt = true
+	superNode.sendToChild(*msg)
+
+	select {
+	case receipt := <-sender.written:
+		if !strings.Contains(receipt, `"Payload":"`+Queued+`"`) {
+			t.Fatalf("expected a queued receipt, got %s", receipt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a queued receipt")
+	}
+	if mail := superNode.mailbox.peek("dead"); len(mail) != 1 || mail[0].Msg.Id != msg.Id {
+		t.Fatal("expected the message to be held in the mailbox")
+	}
+	select {
+	case receipt := <-sender.written:
+		t.Fatalf("expected no other receipt, got %s", receipt)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
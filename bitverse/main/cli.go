@@ -14,6 +14,15 @@ var aesSecretFlag = flag.Bool("generate-aes-secret", false, "generate hex encode
 var certFlag = flag.String("generate-rsa-keys", "", "generate rsa public and private keys, e.g. --generate-cert mycert")
 var localFlag = flag.String("local", "", "ip address and port which this super node should bound to, e.g. --local localhost:1111")
 var joinFlag = flag.String("join", "", "ip address and port to a node to join, e.g. --join localhost:2222")
+var transportFlag = flag.String("transport", "ws", "transport used by edge nodes and super nodes to connect to this super node, ws or tcp")
+var peerPortFlag = flag.String("peer-port", "", "port where other super nodes connect using plain tcp, cannot be used with --tls-cert, e.g. --peer-port 1112 (default is to use --local and --transport)")
+var tlsCertFlag = flag.String("tls-cert", "", "PEM encoded certificate, enables wss:// when used together with --tls-key")
+var tlsKeyFlag = flag.String("tls-key", "", "PEM encoded private key of the --tls-cert certificate")
+var tlsCaFlag = flag.String("tls-ca", "", "PEM encoded CA certificate used to verify other super nodes, e.g. --tls-ca ca.pem")
+var tlsVerifyClientsFlag = flag.Bool("tls-verify-clients", false, "require connecting nodes to present a certificate signed by --tls-ca")
+var identityFlag = flag.String("identity", "", "file with the private key the node id is derived from, created if missing, e.g. --identity supernode.key (default supernode_<port>.key)")
+var dbFlag = flag.String("db", "", "file where the super node stores its repos, e.g. --db supernode.db (default supernode_<port>.db)")
+var inMemoryFlag = flag.Bool("in-memory", false, "keep all repos in memory, they will be lost when the super node is stopped")
 var testHttpServerFlag = flag.Bool("test-http-server", false, "starts a http test server at port 8080 for debuging")
 
 /// MAIN
@@ -35,19 +44,84 @@ func main() {
 		// set up super node
 		var done chan int
 
-		transport := bitverse.MakeWSTransport()
+		// super nodes would talk in plain text over the peer port
+		if *tlsCertFlag != "" && *peerPortFlag != "" {
+			log.Fatal("--peer-port uses the tcp transport, which does not support tls, and cannot be used with --tls-cert")
+		}
+
+		var transport bitverse.Transport
+		switch *transportFlag {
+		case "ws":
+			wsTransport := bitverse.MakeWSTransport()
+			if *tlsCertFlag != "" {
+				tlsConfig, err := bitverse.LoadTLSConfig(*tlsCertFlag, *tlsKeyFlag, *tlsCaFlag, *tlsVerifyClientsFlag)
+				if err != nil {
+					log.Fatal("failed to load tls certificate: " + err.Error())
+				}
+				wsTransport.SetTLSConfig(tlsConfig)
+			}
+			transport = wsTransport
+		case "tcp":
+			if *tlsCertFlag != "" {
+				log.Fatal("tls is only supported by the ws transport")
+			}
+			transport = bitverse.MakeTCPTransport()
+		default:
+			log.Fatal("unknown transport " + *transportFlag + ", must be ws or tcp")
+		}
 
 		var superNode *bitverse.SuperNode
 		temp := strings.Split(*localFlag, ":")
 		localAddr := temp[0]
 		localPort := temp[1]
 
-		superNode, done = bitverse.MakeSuperNode(transport, localAddr, localPort)
+		// without a stored identity the super node gets a new id every time it starts
+		var identity *bitverse.Identity
+		if *identityFlag != "" || !*inMemoryFlag {
+			identityFilename := *identityFlag
+			if identityFilename == "" {
+				identityFilename = "supernode_" + localPort + ".key"
+			}
+
+			var err error
+			identity, err = bitverse.LoadOrCreateIdentity(identityFilename)
+			if err != nil {
+				log.Fatal("failed to load identity from " + identityFilename + ": " + err.Error())
+			}
+		}
+
+		var storage bitverse.Storage
+		if *inMemoryFlag {
+			storage = bitverse.MakeMemStorage()
+		} else {
+			dbFilename := *dbFlag
+			if dbFilename == "" {
+				dbFilename = "supernode_" + localPort + ".db"
+			}
+
+			var err error
+			storage, err = bitverse.MakeFileStorage(dbFilename)
+			if err != nil {
+				log.Fatal("failed to open " + dbFilename + ": " + err.Error())
+			}
+		}
+
+		superNode, done = bitverse.MakeSuperNode(transport, identity, storage, localAddr, localPort)
 
 		if *debugFlag {
 			superNode.Debug()
 		}
 
+		if *peerPortFlag != "" {
+			superNode.SetPeerTransport(bitverse.MakeTCPTransport(), *peerPortFlag)
+		}
+
+		if *joinFlag != "" {
+			if err := superNode.Join(*joinFlag); err != nil {
+				log.Fatal("failed to join super node at " + *joinFlag + ": " + err.Error())
+			}
+		}
+
 		if *testHttpServerFlag {
 			fmt.Println("Starting a HTTP test server at port 8080")
 			log.Fatal(http.ListenAndServe(":8080", http.FileServer(http.Dir("./js/"))))
@@ -0,0 +1,309 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// MemNetwork connects MemTransports inside a single process, which makes it
+// possible to run many super and edge nodes in one test. Latency, message loss
+// and partitions can be injected to test failure handling.
+type MemNetwork struct {
+	lock       sync.Mutex
+	listeners  map[string]*MemTransport // keyed by address
+	links      map[*memLinkType]bool
+	partitions map[string]bool // keyed by memPartitionKey
+	latency    time.Duration
+	loss       float64
+	random     *rand.Rand
+}
+
+// MemTransport is a Transport attached to a MemNetwork, an edge or super node
+// is identified on the network by its local address if set, otherwise by its
+// node id
+type MemTransport struct {
+	network           *MemNetwork
+	identity          *Identity
+	localAddress      string
+	remoteNodeChannel chan *RemoteNode // where accepted links are announced
+	msgChannel        chan Msg         // where messages on accepted links are delivered
+}
+
+func MakeMemNetwork() *MemNetwork {
+	network := new(MemNetwork)
+	network.listeners = make(map[string]*MemTransport)
+	network.links = make(map[*memLinkType]bool)
+	network.partitions = make(map[string]bool)
+	network.random = rand.New(rand.NewSource(1))
+
+	return network
+}
+
+func (network *MemNetwork) MakeTransport() *MemTransport {
+	memTransport := new(MemTransport)
+	memTransport.network = network
+	return memTransport
+}
+
+// Delays every message by latency
+func (network *MemNetwork) SetLatency(latency time.Duration) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.latency = latency
+}
+
+// Drops messages with the given probability, between 0 and 1
+func (network *MemNetwork) SetLoss(loss float64) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.loss = loss
+}
+
+// Seeds the random source deciding which messages are lost, the network is
+// seeded with 1 when created
+func (network *MemNetwork) Seed(seed int64) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.random = rand.New(rand.NewSource(seed))
+}
+
+// Silently drops all messages between a and b, and refuses new links between
+// them, until Heal is called. a and b are addresses of super nodes or ids of
+// edge nodes
+func (network *MemNetwork) Partition(a string, b string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.partitions[memPartitionKey(a, b)] = true
+}
+
+func (network *MemNetwork) Heal(a string, b string) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	delete(network.partitions, memPartitionKey(a, b))
+}
+
+// Closes all links to and from name, as if the node had crashed. Both ends
+// are notified that the link is dead
+func (network *MemNetwork) Disconnect(name string) {
+	network.lock.Lock()
+	var links []*memLinkType
+	for link, _ := range network.links {
+		if link.client.name == name || link.server.name == name {
+			links = append(links, link)
+		}
+	}
+	network.lock.Unlock()
+
+	for _, link := range links {
+		link.close()
+	}
+}
+
+func (memTransport *MemTransport) SetIdentity(identity *Identity) {
+	memTransport.identity = identity
+}
+
+func (memTransport *MemTransport) SetLocalAddress(localAddress string) {
+	memTransport.localAddress = localAddress
+}
+
+func (memTransport *MemTransport) Listen(localAddress string, localPort string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) {
+	network := memTransport.network
+	address := localAddress + ":" + localPort
+
+	debug("memtransport: listening at " + address)
+
+	network.lock.Lock()
+	if network.listeners[address] != nil {
+		network.lock.Unlock()
+		panic("memtransport.Listen: address " + address + " already in use")
+	}
+	memTransport.remoteNodeChannel = remoteNodeChannel
+	memTransport.msgChannel = msgChannel
+	network.listeners[address] = memTransport
+	network.lock.Unlock()
+
+	select {} // like the other transports, Listen never returns
+}
+
+func (memTransport *MemTransport) ConnectToNode(remoteAddress string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) error {
+	network := memTransport.network
+
+	network.lock.Lock()
+	listener := network.listeners[remoteAddress]
+	if listener == nil {
+		network.lock.Unlock()
+		info("failed to connect to supernode at " + remoteAddress + ", connection refused")
+		return errors.New("memtransport: no node listening at " + remoteAddress)
+	}
+
+	client := &memEndType{name: memTransport.name(), remoteNodeChannel: remoteNodeChannel, msgChannel: msgChannel}
+	server := &memEndType{name: listener.name(), remoteNodeChannel: listener.remoteNodeChannel, msgChannel: listener.msgChannel}
+	if network.partitions[memPartitionKey(client.name, server.name)] {
+		network.lock.Unlock()
+		return errors.New("memtransport: " + remoteAddress + " is unreachable")
+	}
+
+	// same as the handshake of the other transports, the server link carries
+	// the address we advertise so that super nodes can tell peers from children.
+	// Both identities are known in-process, so no proof of identity is needed
+	link := makeMemLink(network, client, server)
+	remoteNodeId := makeNodeIdFromString(listener.identity.Id())
+	client.remoteNode = makeRemoteNode(remoteNodeChannel, link.writer(client), memTransport.identity.Id(), remoteNodeId.String(), listener.localAddress)
+	server.remoteNode = makeRemoteNode(server.remoteNodeChannel, link.writer(server), listener.identity.Id(), memTransport.identity.Id(), memTransport.localAddress)
+	network.links[link] = true
+	network.lock.Unlock()
+
+	client.remoteNodeChannel <- client.remoteNode
+	server.remoteNodeChannel <- server.remoteNode
+
+	go link.run(server)
+	link.run(client)
+	return nil
+}
+
+/// PRIVATE
+
+// one end of a link, the node receiving the messages sent by the other end
+type memEndType struct {
+	name              string
+	remoteNodeChannel chan *RemoteNode
+	msgChannel        chan Msg
+	remoteNode        *RemoteNode
+	inbox             chan memFrameType
+}
+
+type memFrameType struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+type memLinkType struct {
+	network *MemNetwork
+	client  *memEndType
+	server  *memEndType
+	closed  chan bool
+	once    sync.Once
+}
+
+// writes to one end of a link, each write is a json encoded message
+type memWriterType struct {
+	link *memLinkType
+	from *memEndType
+	to   *memEndType
+}
+
+func memPartitionKey(a string, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return a + "|" + b
+}
+
+func (memTransport *MemTransport) name() string {
+	if memTransport.localAddress != "" {
+		return memTransport.localAddress
+	}
+	return memTransport.identity.Id()
+}
+
+func makeMemLink(network *MemNetwork, client *memEndType, server *memEndType) *memLinkType {
+	link := new(memLinkType)
+	link.network = network
+	link.client = client
+	link.server = server
+	link.closed = make(chan bool)
+	client.inbox = make(chan memFrameType, 100)
+	server.inbox = make(chan memFrameType, 100)
+
+	return link
+}
+
+func (link *memLinkType) writer(from *memEndType) *memWriterType {
+	if from == link.client {
+		return &memWriterType{link, link.client, link.server}
+	}
+	return &memWriterType{link, link.server, link.client}
+}
+
+func (writer *memWriterType) Write(data []byte) (int, error) {
+	link := writer.link
+	network := link.network
+
+	select {
+	case <-link.closed:
+		return 0, errors.New("memtransport: link closed")
+	default:
+	}
+
+	network.lock.Lock()
+	partitioned := network.partitions[memPartitionKey(writer.from.name, writer.to.name)]
+	lost := network.loss > 0 && network.random.Float64() < network.loss
+	deliverAt := time.Now().Add(network.latency)
+	network.lock.Unlock()
+
+	if partitioned || lost {
+		return len(data), nil
+	}
+
+	frame := memFrameType{make([]byte, len(data)), deliverAt}
+	copy(frame.data, data)
+
+	select {
+	case writer.to.inbox <- frame:
+	case <-link.closed:
+		return 0, errors.New("memtransport: link closed")
+	}
+	return len(data), nil
+}
+
+// delivers messages to end until the link is closed, messages are kept in
+// order as they all have the same latency
+func (link *memLinkType) run(end *memEndType) {
+	for {
+		select {
+		case frame := <-end.inbox:
+			if delay := frame.deliverAt.Sub(time.Now()); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-link.closed:
+					return
+				}
+			}
+
+			var msg Msg
+			if err := json.Unmarshal(frame.data, &msg); err != nil {
+				info("memtransport: failed to decode message")
+				continue
+			}
+
+			msg.link = end.remoteNode
+			select {
+			case end.msgChannel <- msg:
+			case <-link.closed:
+				return
+			}
+		case <-link.closed:
+			return
+		}
+	}
+}
+
+func (link *memLinkType) close() {
+	link.once.Do(func() {
+		network := link.network
+		network.lock.Lock()
+		delete(network.links, link)
+		network.lock.Unlock()
+
+		close(link.closed)
+
+		for _, end := range []*memEndType{link.client, link.server} {
+			end.remoteNode.setState(Dead)
+			end.remoteNodeChannel <- end.remoteNode
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package bitverse
+
+import (
+	"testing"
+	"time"
+)
+
+type memPingObserver struct {
+}
+
+func (memPingObserver *memPingObserver) OnDeliver(msgService *MsgService, msg *Msg) {
+	if msg.Payload == "ping" {
+		msg.Reply("pong")
+	}
+}
+
+func makeMemEdgeNode(t *testing.T, network *MemNetwork, secret string, superNodeAddress string) (*EdgeNode, *MsgService) {
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	msgService, err := edgeNode.CreateMsgService(secret, "ping", new(memPingObserver))
+	if err != nil {
+		t.Fatalf("failed to create msg service: %v", err)
+	}
+
+	go edgeNode.Connect(superNodeAddress)
+	return edgeNode, msgService
+}
+
+func memPing(msgService *MsgService, dst string, timeout int32) string {
+	done := make(chan string, 1)
+	msgService.SendAndGetReply(dst, "ping", timeout, func(err error, reply interface{}) {
+		if err != nil {
+			done <- err.Error()
+		} else {
+			done <- reply.(string)
+		}
+	})
+	return <-done
+}
+
+func TestMemTransportRouting(t *testing.T) {
+	network := MakeMemNetwork()
+	secret, _ := GenerateAesSecret()
+
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super1", "1111")
+	superNode2, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super2", "1111")
+	time.Sleep(100 * time.Millisecond)
+	if err := superNode2.Join("super1:1111"); err != nil {
+		t.Fatalf("failed to join ring: %v", err)
+	}
+
+	var edgeNodes []*EdgeNode
+	var msgServices []*MsgService
+	for i := 0; i < 6; i++ {
+		superNodeAddress := "super1:1111"
+		if i%2 == 1 {
+			superNodeAddress = "super2:1111"
+		}
+		edgeNode, msgService := makeMemEdgeNode(t, network, secret, superNodeAddress)
+		edgeNodes = append(edgeNodes, edgeNode)
+		msgServices = append(msgServices, msgService)
+	}
+	time.Sleep(500 * time.Millisecond)
+
+	for i, msgService := range msgServices {
+		dst := edgeNodes[(i+1)%len(edgeNodes)].Id()
+		if reply := memPing(msgService, dst, 5); reply != "pong" {
+			t.Fatalf("edge node %d failed to ping %s: %s", i, dst, reply)
+		}
+	}
+}
+
+func TestMemTransportPartition(t *testing.T) {
+	network := MakeMemNetwork()
+	secret, _ := GenerateAesSecret()
+
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	edgeNode1, msgService1 := makeMemEdgeNode(t, network, secret, "super:1111")
+	edgeNode2, _ := makeMemEdgeNode(t, network, secret, "super:1111")
+	time.Sleep(200 * time.Millisecond)
+
+	network.Partition(edgeNode2.Id(), "super:1111")
+	if reply := memPing(msgService1, edgeNode2.Id(), 1); reply != "timeout" {
+		t.Fatalf("expected a timeout while partitioned, got %s", reply)
+	}
+
+	network.Heal(edgeNode2.Id(), "super:1111")
+	network.SetLatency(100 * time.Millisecond)
+	start := time.Now()
+	if reply := memPing(msgService1, edgeNode2.Id(), 5); reply != "pong" {
+		t.Fatalf("expected pong after healing, got %s", reply)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected 4 hops of latency, reply came after %v", elapsed)
+	}
+
+	network.SetLatency(0)
+	network.SetLoss(1)
+	if reply := memPing(msgService1, edgeNode1.Id(), 1); reply != "timeout" {
+		t.Fatalf("expected a timeout when all messages are lost, got %s", reply)
+	}
+}
@@ -1,6 +1,7 @@
 package bitverse
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
 )
@@ -14,6 +15,9 @@ const (
 	ChildJoined
 	ChildLeft
 	Bye
+	Rpc
+	RpcReply
+	Receipt
 )
 
 // service type definition
@@ -28,6 +32,16 @@ const (
 	Store = iota
 	Lookup
 	Claim
+	Delete
+	ListKeys
+	Scan
+	StoreIf
+	Watch  // subscribes to changes, renewed periodically
+	Change // change notification sent by the super node to watchers
+	Grant
+	Transfer
+	Release
+	Batch
 )
 
 // status
@@ -42,6 +56,12 @@ const (
 	Nil
 )
 
+// delivery receipt status
+const (
+	Delivered = "delivered" // delivered to the destination edge node
+	Queued    = "queued"    // held in a mailbox until the destination edge node connects
+)
+
 var mutex sync.Mutex
 var seqNrCounter int = 0
 
@@ -59,8 +79,47 @@ type Msg struct {
 	RepoCmd        int    // used by repo service
 	RepoKey        string // used by repo service
 	RepoValue      string // used by repo service
+	RepoNonce      int64  // used by repo service, makes every signed request unique
+	RepoAfter      string // used by repo service, listings start after this key
+	RepoLimit      int    // used by repo service, maximum number of keys in a listing
+	RepoVersion    int64  // used by repo service, the expected version in requests and the version of the value in replies
+	RepoTTL        int64  // used by repo service, seconds until a stored value expires, 0 if never
+	RepoWatchId    string // used by repo service, identifies a watch in subscriptions and change notifications
+	RepoSeq        int64  // used by repo service, the change sequence number to resume a watch after, or of a change
+	RepoSigner     string // used by repo service, pem encoded public key that signed the request, empty for the owner
+	RepoRight      int    // used by repo service, the right granted by a grant request
+	RepoWipe       bool   // used by repo service, set if releasing a repo also deletes its keys
 	Status         int    // status, e.g. Ok or Error
+	Origin         string // address of the sending super node, only set between super nodes
+	RpcMethod      string // used by super node rpc
+	WantReceipt    bool   // set if the sender wants delivery receipts
 	msgService     *MsgService
+	link           *RemoteNode // the link the message was received on, set by the transports
+}
+
+// Returns the header fields an encrypted payload is bound to, so that a super
+// node cannot move the payload to another message. Repo values are bound to
+// their repo and key, as they are returned in replies from super nodes
+func (msg *Msg) payloadAdditionalData() string {
+	if msg.ServiceType == Repo {
+		return repoValueAdditionalData(msg.RepoId, msg.RepoKey)
+	}
+	return "msg:" + msg.Src + ":" + msg.Dst + ":" + msg.MsgServiceName + ":" + msg.Id
+}
+
+func repoValueAdditionalData(repoId string, key string) string {
+	return "repo:" + repoId + ":" + key
+}
+
+// Returns the data the owner of a repo signs for a repo request, it covers
+// everything the super node acts upon so that the request cannot be altered or
+// replayed
+func (msg *Msg) repoSignatureData() string {
+	data, err := json.Marshal([]interface{}{"bitverse-repo", msg.RepoId, msg.RepoCmd, msg.RepoKey, msg.RepoValue, msg.RepoAfter, msg.RepoLimit, msg.RepoVersion, msg.RepoTTL, msg.RepoWatchId, msg.RepoSeq, msg.RepoSigner, msg.RepoRight, msg.RepoWipe, msg.RepoNonce, msg.Src})
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
 }
 
 func (msg *Msg) String() string {
@@ -76,6 +135,12 @@ func (msg *Msg) String() string {
 		return "msg[type:childleft to:" + msg.Dst + " from:" + msg.Src + " payload:" + msg.Payload + "]"
 	} else if msg.Type == Data {
 		return "msg[type:data to:" + msg.Dst + " from:" + msg.Src + " payload:" + msg.Payload + " msgchannelid:" + msg.MsgServiceName + "]"
+	} else if msg.Type == Rpc {
+		return "msg[type:rpc to:" + msg.Dst + " from:" + msg.Src + " method:" + msg.RpcMethod + " origin:" + msg.Origin + "]"
+	} else if msg.Type == RpcReply {
+		return "msg[type:rpcreply to:" + msg.Dst + " from:" + msg.Src + " method:" + msg.RpcMethod + " origin:" + msg.Origin + "]"
+	} else if msg.Type == Receipt {
+		return "msg[type:receipt to:" + msg.Dst + " from:" + msg.Src + " payload:" + msg.Payload + "]"
 	} else {
 		return "msg[type:unkown]"
 	}
@@ -123,7 +188,7 @@ func composeRepoClaimMsg(src string, superNodeId string, repoId string, publicKe
 	return msg
 }
 
-func composeRepoStoreMsg(src string, superNodeId string, repoId string, key string, value string, signature string) *Msg {
+func composeRepoStoreMsg(src string, superNodeId string, repoId string, key string, value string, nonce int64) *Msg {
 	msg := new(Msg)
 	msg.Type = Data
 	msg.Src = src
@@ -137,15 +202,23 @@ func composeRepoStoreMsg(src string, superNodeId string, repoId string, key stri
 	msg.RepoCmd = Store
 	msg.RepoKey = key
 	msg.RepoValue = value
-
-	msg.Signature = signature
+	msg.RepoNonce = nonce
 
 	msg.Status = Ok
 
 	return msg
 }
 
-func composeRepoLookupMsg(src string, superNodeId string, repoId string, key string, signature string) *Msg {
+// The value is only stored if its current version is expectedVersion, 0 if the
+// key must not exist
+func composeRepoStoreIfMsg(src string, superNodeId string, repoId string, key string, value string, expectedVersion int64, nonce int64) *Msg {
+	msg := composeRepoStoreMsg(src, superNodeId, repoId, key, value, nonce)
+	msg.RepoCmd = StoreIf
+	msg.RepoVersion = expectedVersion
+	return msg
+}
+
+func composeRepoLookupMsg(src string, superNodeId string, repoId string, key string, nonce int64) *Msg {
 	msg := new(Msg)
 	msg.Type = Data
 	msg.Src = src
@@ -158,8 +231,189 @@ func composeRepoLookupMsg(src string, superNodeId string, repoId string, key str
 	msg.RepoId = repoId
 	msg.RepoCmd = Lookup
 	msg.RepoKey = key
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+func composeRepoDeleteMsg(src string, superNodeId string, repoId string, key string, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Delete
+	msg.RepoKey = key
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// cmd is ListKeys or Scan, the key of the message is the prefix of the listed keys
+func composeRepoListMsg(src string, superNodeId string, repoId string, cmd int, prefix string, after string, limit int, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = cmd
+	msg.RepoKey = prefix
+	msg.RepoAfter = after
+	msg.RepoLimit = limit
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// Grants right to the pem encoded public key grantee, which is sent as the value
+func composeRepoGrantMsg(src string, superNodeId string, repoId string, grantee string, right RepoRight, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Grant
+	msg.RepoValue = grantee
+	msg.RepoRight = int(right)
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// Hands the repo over to the pem encoded public key newOwner, which is sent as the value
+func composeRepoTransferMsg(src string, superNodeId string, repoId string, newOwner string, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Transfer
+	msg.RepoValue = newOwner
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+func composeRepoReleaseMsg(src string, superNodeId string, repoId string, wipe bool, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Release
+	msg.RepoWipe = wipe
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// Applies a batch of writes all-or-nothing, the JSON encoded batch is sent as
+// the value so that it is covered by the signature
+func composeRepoBatchMsg(src string, superNodeId string, repoId string, batch string, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Batch
+	msg.RepoValue = batch
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// Subscribes to changes of keys starting with prefix after the change sequence
+// number since, 0 to only get new changes
+func composeRepoWatchMsg(src string, superNodeId string, repoId string, watchId string, prefix string, since int64, nonce int64) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = superNodeId
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Watch
+	msg.RepoKey = prefix
+	msg.RepoWatchId = watchId
+	msg.RepoSeq = since
+	msg.RepoNonce = nonce
+
+	msg.Status = Ok
+
+	return msg
+}
+
+// Notifies a watcher about a change of key, the payload is the aes encrypted
+// value or nil if the key was deleted or has expired
+func composeRepoChangeMsg(src string, dst string, repoId string, watchId string, key string, entry *RepoEntry) *Msg {
+	msg := new(Msg)
+	msg.Type = Data
+	msg.Src = src
+	msg.Dst = dst
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+
+	msg.MsgServiceName = repoId
+	msg.ServiceType = Repo
+
+	msg.RepoId = repoId
+	msg.RepoCmd = Change
+	msg.RepoKey = key
+	msg.RepoWatchId = watchId
+	msg.RepoSeq = entry.Seq
+	msg.RepoVersion = entry.Version
 
-	msg.Signature = signature
+	if entry.Deleted {
+		msg.PayloadType = Nil
+	} else {
+		msg.Payload = entry.Value
+	}
 
 	msg.Status = Ok
 
@@ -220,17 +474,69 @@ func composeChildLeft(src string, childId string) *Msg {
 	return msg
 }
 
-func composeHandshakeMsg(src string) *Msg {
+// Tells the sender of msg that it was delivered or queued, the receipt has the
+// same id as msg
+func composeReceiptMsg(msg *Msg, src string, status string) *Msg {
+	receipt := new(Msg)
+	receipt.Type = Receipt
+	receipt.Payload = status
+	receipt.PayloadType = String
+	receipt.Src = src
+	receipt.Dst = msg.Src
+	receipt.Id = msg.Id
+	receipt.MsgServiceName = msg.MsgServiceName
+	receipt.ServiceType = Control
+	receipt.Status = Ok
+	return receipt
+}
+
+// origin is the address of a super node, or empty if sent by an edge node. The
+// message carries our public key, a challenge for the other node to sign if
+// set, and our signature of peerChallenge if set, see handshake.go
+func composeHandshakeMsg(identity *Identity, origin string, challenge string, peerChallenge string) *Msg {
 	msg := new(Msg)
 	msg.Type = Handshake
+	msg.Src = identity.Id()
+	msg.Origin = origin
+	msg.ServiceType = Control
+	if err := identity.composeHandshakeProof(msg, challenge, peerChallenge); err != nil {
+		panic(err)
+	}
+	return msg
+}
+
+// Super node rpc messages
+
+func composeRpcMsg(src string, origin string, method string, args string) *Msg {
+	msg := new(Msg)
+	msg.Type = Rpc
+	msg.Src = src
+	msg.Id = msg.Src + ":" + fmt.Sprintf("%d", getSeqNr())
+	msg.Origin = origin
+	msg.RpcMethod = method
+	msg.Payload = args
+	msg.ServiceType = Control
+	msg.Status = Ok
+	return msg
+}
+
+func composeRpcReplyMsg(request *Msg, src string, origin string, reply string, status int) *Msg {
+	msg := new(Msg)
+	msg.Type = RpcReply
 	msg.Src = src
+	msg.Dst = request.Src
+	msg.Id = request.Id
+	msg.Origin = origin
+	msg.RpcMethod = request.RpcMethod
+	msg.Payload = reply
 	msg.ServiceType = Control
+	msg.Status = status
 	return msg
 }
 
 func getSeqNr() int {
 	mutex.Lock()
+	defer mutex.Unlock()
 	seqNrCounter++
-	mutex.Unlock()
 	return seqNrCounter
 }
@@ -1,56 +1,121 @@
 package bitverse
 
+import (
+	"errors"
+	"time"
+)
+
+// receipt callbacks are kept in the reply table under the message id plus this suffix
+const RECEIPT_SUFFIX = ":receipt"
+
 type MsgService struct {
-	id               string
-	observer         MsgServiceObserver
-	edgeNode         *EdgeNode
-	aesEncryptionKey string
+	id       string
+	observer MsgServiceObserver
+	edgeNode *EdgeNode
+	keyring  *keyringType  // nil if messages are encrypted with pairwise keys
+	pairwise *pairwiseType // set if messages are encrypted with pairwise keys
 }
 
 type msgReplyType struct {
-	callback  func(err error, data interface{})
-	timeout   int32
-	timestamp int32
+	callback       func(err error, data interface{})
+	timeout        int32
+	timestamp      int32
+	queued         bool   // set when a queued receipt has been received
+	additionalData string // expected additional data of the encrypted reply, if it cannot be derived from the reply
+	plain          bool   // set if the reply is not encrypted
+	versioned      bool   // set if the callback wants a *RepoValue
 }
 
-func composeMsgService(aesEncryptionKey string, id string, observe MsgServiceObserver, edgeNode *EdgeNode) *MsgService {
+func composeMsgService(keyring *keyringType, id string, observe MsgServiceObserver, edgeNode *EdgeNode) *MsgService {
 	service := new(MsgService)
 	service.id = id
 	service.observer = observe
 	service.edgeNode = edgeNode
-	service.aesEncryptionKey = aesEncryptionKey
+	service.keyring = keyring
 	return service
 }
 
 func (msgService *MsgService) Send(dst string, data string) {
-	encryptedData := encryptAes(msgService.aesEncryptionKey, data)
-	msg := composeMsgServiceMsg(msgService.edgeNode.Id(), dst, msgService.id, encryptedData)
-	msgService.edgeNode.send(msg)
+	msg := composeMsgServiceMsg(msgService.edgeNode.Id(), dst, msgService.id, data)
+	msgService.send(msg, 0)
 }
 
 func (msgService *MsgService) SendAndGetReply(dst string, data string, timeout int32, callback func(err error, data interface{})) {
-	encryptedData := encryptAes(msgService.aesEncryptionKey, data)
-	msg := composeMsgServiceMsg(msgService.edgeNode.Id(), dst, msgService.id, encryptedData)
+	msg := composeMsgServiceMsg(msgService.edgeNode.Id(), dst, msgService.id, data)
 	msgService.edgeNode.registerReplyCallback(msg.Id, timeout, callback)
-	msgService.edgeNode.send(msg)
+	msgService.send(msg, timeout)
+}
+
+// Sends data to dst and calls callback with the status Delivered when the
+// super node of dst has delivered it, or Queued when dst is not connected and
+// the message is held in its mailbox. In the latter case, callback is called
+// again with Delivered if dst connects before the timeout.
+func (msgService *MsgService) SendAndGetReceipt(dst string, data string, timeout int32, callback func(err error, status interface{})) {
+	msg := composeMsgServiceMsg(msgService.edgeNode.Id(), dst, msgService.id, data)
+	msg.WantReceipt = true
+	msgService.edgeNode.registerReplyCallback(msg.Id+RECEIPT_SUFFIX, timeout, callback)
+	msgService.send(msg, timeout)
+}
+
+// Accepts messages encrypted with aesEncryptionKey, without sending with it. To
+// rotate keys without losing messages, add the new key on all nodes using the
+// service first and then rotate to it.
+func (msgService *MsgService) AddKey(aesEncryptionKey string) error {
+	if msgService.keyring == nil {
+		return errors.New("pairwise msg services have no shared key")
+	}
+	return msgService.keyring.add(aesEncryptionKey)
+}
+
+// Encrypts messages sent from now on with aesEncryptionKey. Messages encrypted
+// with the previous key are still accepted during the grace period.
+func (msgService *MsgService) RotateKey(aesEncryptionKey string) error {
+	if msgService.keyring == nil {
+		return errors.New("pairwise msg services have no shared key")
+	}
+	return msgService.keyring.rotate(aesEncryptionKey)
+}
+
+// Sets how long messages encrypted with a rotated key are accepted, an hour by
+// default
+func (msgService *MsgService) SetKeyGracePeriod(gracePeriod time.Duration) {
+	if msgService.keyring != nil {
+		msgService.keyring.lock.Lock()
+		defer msgService.keyring.lock.Unlock()
+		msgService.keyring.gracePeriod = gracePeriod
+	}
+}
+
+// Accepts messages in the unauthenticated format of versions before AES-GCM,
+// off by default. Such messages may have been tampered with on the way, only
+// enable this while nodes of older versions are still around.
+func (msgService *MsgService) AcceptLegacyMessages(accept bool) {
+	if msgService.keyring != nil {
+		msgService.keyring.lock.Lock()
+		defer msgService.keyring.lock.Unlock()
+		msgService.keyring.legacy = accept
+	}
 }
 
 /// PRIVATE
 
 func (msgService *MsgService) reply(msg *Msg, data string) {
-	encryptedData := encryptAes(msgService.aesEncryptionKey, data)
-	replyMsg := composeMsgServiceMsg(msgService.edgeNode.Id(), msg.Src, msgService.id, encryptedData)
+	replyMsg := composeMsgServiceMsg(msgService.edgeNode.Id(), msg.Src, msgService.id, data)
 	replyMsg.Id = msg.Id // use the same id as the sender
-
-	msgService.edgeNode.send(replyMsg)
+	msgService.send(replyMsg, 0)
 }
 
 func (msgService *MsgService) sendMsg(msg *Msg) {
-	msg.Payload = encryptAes(msgService.aesEncryptionKey, msg.Payload)
-	msgService.edgeNode.send(msg)
+	msgService.send(msg, 0)
 }
 
 func (msgService *MsgService) sendMsgAndGetReply(msg *Msg, timeout int32, callback func(err error, data interface{})) {
+	msgService.sendMsgAndGetReplyWithVersion(msg, timeout, false, callback)
+}
+
+// If versioned is set, callback is called with a *RepoValue holding the value
+// and the version in the reply, or nil if there is neither
+func (msgService *MsgService) sendMsgAndGetReplyWithVersion(msg *Msg, timeout int32, versioned bool, callback func(err error, data interface{})) {
 	if msg == nil {
 		panic("msg is nil")
 	}
@@ -59,7 +124,65 @@ func (msgService *MsgService) sendMsgAndGetReply(msg *Msg, timeout int32, callba
 		panic("msg service is nil")
 	}
 
-	msg.Payload = encryptAes(msgService.aesEncryptionKey, msg.Payload)
-	msgService.edgeNode.registerReplyCallback(msg.Id, timeout, callback)
-	msgService.edgeNode.send(msg)
+	reply := msgService.edgeNode.registerReplyCallback(msg.Id, timeout, callback)
+	reply.versioned = versioned
+	if msg.ServiceType == Repo {
+		// do not trust the repo and key in the reply, the super node could swap values
+		reply.additionalData = msg.payloadAdditionalData()
+		// listings are composed by the super node, the repo service decrypts the values in them
+		reply.plain = msg.RepoCmd == ListKeys || msg.RepoCmd == Scan || msg.RepoCmd == Watch || msg.RepoCmd == Batch
+	}
+	msgService.send(msg, timeout)
+}
+
+// Encrypts the payload of msg, binding it to the header fields, and sends it
+func (msgService *MsgService) send(msg *Msg, timeout int32) {
+	if msgService.pairwise != nil {
+		for _, sealedMsg := range msgService.pairwise.seal(msg) {
+			msgService.edgeNode.sendWithReplyTimeout(sealedMsg, timeout)
+		}
+		return
+	}
+
+	msg.Payload = msgService.keyring.encrypt(msg.Payload, msg.payloadAdditionalData())
+	msgService.edgeNode.sendWithReplyTimeout(msg, timeout)
+}
+
+// Decrypts the payload of a received msg, reply is the pending request msg
+// replies to if any. Returns false if msg is not meant for the observer, e.g.
+// a pairwise key exchange
+func (msgService *MsgService) open(msg *Msg, reply *msgReplyType) (bool, error) {
+	// our super node composes errors, listings and empty replies to our repo
+	// requests itself, these are not encrypted
+	fromSuperNode := reply != nil && msg.ServiceType == Repo && dialedNodeId(msg.Src) == msgService.edgeNode.superNodeId()
+	if fromSuperNode && (msg.Status == Error || msg.PayloadType == Nil || reply.plain) {
+		return true, nil
+	}
+	if msg.Status == Error {
+		return false, errors.New("unexpected error reply from " + msg.Src)
+	}
+	if msg.PayloadType == Nil {
+		msg.Payload = "" // has no payload, make sure none is passed on
+		return true, nil
+	}
+
+	additionalData := msg.payloadAdditionalData()
+	if reply != nil && reply.additionalData != "" {
+		additionalData = reply.additionalData
+	}
+
+	if msgService.pairwise != nil {
+		deliver, replies, err := msgService.pairwise.open(msg)
+		for _, reply := range replies {
+			msgService.edgeNode.send(reply)
+		}
+		return deliver, err
+	}
+
+	// repo values stay readable under rotated keys until they are re-encrypted
+	withinGrace := msg.ServiceType != Repo
+
+	var err error
+	msg.Payload, err = msgService.keyring.decrypt(msg.Payload, additionalData, withinGrace)
+	return true, err
 }
@@ -11,13 +11,6 @@ func makeNodeIdFromString(id string) NodeId {
 	return nodeId
 }
 
-func generateNodeId() NodeId {
-	nodeId := NodeId{}
-	nodeId.hashkey = UniqueHashkey()
-
-	return nodeId
-}
-
 func (nodeId *NodeId) Hashkey() string {
 	return nodeId.hashkey
 }
@@ -0,0 +1,124 @@
+package bitverse
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const OUTBOX_SIZE = 100
+const OUTBOX_EXPIRY time.Duration = 60
+
+// What to do when a message is sent while the outbox is full
+type OverflowPolicy int
+
+const (
+	DropOldest OverflowPolicy = iota // make room by dropping the oldest queued message
+	DropNewest                       // drop the message being sent
+)
+
+type outboxEntryType struct {
+	msg     *Msg
+	expires time.Time
+}
+
+// outboxType buffers messages sent by an edge node while it is not connected
+// to a super node
+type outboxType struct {
+	lock    sync.Mutex
+	entries []outboxEntryType
+	size    int
+	policy  OverflowPolicy
+	expiry  time.Duration
+}
+
+func makeOutbox() *outboxType {
+	outbox := new(outboxType)
+	outbox.size = OUTBOX_SIZE
+	outbox.policy = DropOldest
+	outbox.expiry = time.Second * OUTBOX_EXPIRY
+
+	return outbox
+}
+
+/// PRIVATE
+
+// Queues msg until expires, the caller must hold the lock
+func (outbox *outboxType) push(msg *Msg, expires time.Time) {
+	outbox.purge()
+
+	if outbox.size <= 0 {
+		info("outbox: queueing disabled, dropping message " + msg.Id)
+		return
+	}
+
+	if len(outbox.entries) >= outbox.size {
+		if outbox.policy == DropNewest {
+			info("outbox: full, dropping message " + msg.Id)
+			return
+		}
+
+		info("outbox: full, dropping message " + outbox.entries[0].msg.Id)
+		outbox.entries = outbox.entries[1:]
+	}
+
+	outbox.entries = append(outbox.entries, outboxEntryType{msg, expires})
+}
+
+// Delivers the queued messages that have not expired to remoteNode in order.
+// If the link dies, the undelivered messages stay queued. The caller must hold
+// the lock
+func (outbox *outboxType) flush(remoteNode *RemoteNode) {
+	outbox.purge()
+
+	for len(outbox.entries) > 0 {
+		if err := remoteNode.deliver(outbox.entries[0].msg); err != nil {
+			info("outbox: link died, keeping " + strconv.Itoa(len(outbox.entries)) + " queued messages")
+			return
+		}
+		outbox.entries = outbox.entries[1:]
+	}
+	outbox.entries = nil
+}
+
+// Removes and returns all messages that have not expired, in the order they
+// were queued. The caller must hold the lock
+func (outbox *outboxType) drain() []*Msg {
+	outbox.purge()
+
+	msgs := make([]*Msg, len(outbox.entries))
+	for i, entry := range outbox.entries {
+		msgs[i] = entry.msg
+	}
+	outbox.entries = nil
+
+	return msgs
+}
+
+// Drops expired messages, the caller must hold the lock
+func (outbox *outboxType) purge() {
+	now := time.Now()
+	entries := outbox.entries[:0]
+	for _, entry := range outbox.entries {
+		if now.Before(entry.expires) {
+			entries = append(entries, entry)
+		} else {
+			debug("outbox: message " + entry.msg.Id + " expired")
+		}
+	}
+	outbox.entries = entries
+}
+
+// Shrinks the queue to at most size messages, dropping according to the
+// policy. The caller must hold the lock
+func (outbox *outboxType) truncate() {
+	if len(outbox.entries) <= outbox.size {
+		return
+	}
+
+	if outbox.policy == DropNewest {
+		outbox.entries = outbox.entries[:outbox.size]
+	} else {
+		outbox.entries = outbox.entries[len(outbox.entries)-outbox.size:]
+	}
+}
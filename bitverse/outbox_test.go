@@ -0,0 +1,72 @@
+package bitverse
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func outboxIds(msgs []*Msg) string {
+	ids := ""
+	for _, msg := range msgs {
+		ids += msg.Id
+	}
+	return ids
+}
+
+func TestOutboxOverflow(t *testing.T) {
+	expires := time.Now().Add(time.Minute)
+
+	outbox := makeOutbox()
+	outbox.size = 2
+	for _, id := range []string{"a", "b", "c"} {
+		outbox.push(&Msg{Id: id}, expires)
+	}
+	if ids := outboxIds(outbox.drain()); ids != "bc" {
+		t.Fatalf("expected bc when dropping the oldest message, got %s", ids)
+	}
+
+	outbox.policy = DropNewest
+	for _, id := range []string{"a", "b", "c"} {
+		outbox.push(&Msg{Id: id}, expires)
+	}
+	if ids := outboxIds(outbox.drain()); ids != "ab" {
+		t.Fatalf("expected ab when dropping the newest message, got %s", ids)
+	}
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	outbox := makeOutbox()
+	outbox.push(&Msg{Id: "a"}, time.Now().Add(-time.Second))
+	outbox.push(&Msg{Id: "b"}, time.Now().Add(time.Minute))
+
+	if ids := outboxIds(outbox.drain()); ids != "b" {
+		t.Fatalf("expected the expired message to be dropped, got %s", ids)
+	}
+}
+
+// Accepts a number of writes and then fails, like a link that dies
+type failingWriter struct {
+	writes int
+}
+
+func (writer *failingWriter) Write(data []byte) (int, error) {
+	if writer.writes == 0 {
+		return 0, errors.New("link closed")
+	}
+	writer.writes--
+	return len(data), nil
+}
+
+func TestOutboxFlushKeepsUndelivered(t *testing.T) {
+	outbox := makeOutbox()
+	for _, id := range []string{"a", "b", "c"} {
+		outbox.push(&Msg{Id: id}, time.Now().Add(time.Minute))
+	}
+
+	remoteNode := makeRemoteNode(make(chan *RemoteNode, 1), &failingWriter{1}, "", "super", "")
+	outbox.flush(remoteNode)
+	if ids := outboxIds(outbox.drain()); ids != "bc" {
+		t.Fatalf("expected bc to stay queued after the link died, got %s", ids)
+	}
+}
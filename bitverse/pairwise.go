@@ -0,0 +1,348 @@
+package bitverse
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Pairwise encryption modes of a msg service, see CreatePairwiseMsgService
+type PairwiseMode int
+
+const (
+	PairwiseStatic  PairwiseMode = iota // one key per peer, derived from the identity keys of both nodes
+	PairwiseRatchet                     // a new key per message, with forward secrecy, see ratchet.go
+)
+
+// How often we ask a peer for its public key or restart a broken session
+const PAIRWISE_RETRY_RATE time.Duration = 10
+
+// Key requests and resets older than this are not accepted, they are signed
+// and timestamped so that they cannot be forged or replayed to break sessions
+const PAIRWISE_RESET_WINDOW time.Duration = 60
+
+// Sent as the payload of pairwise encrypted messages. The public key lets the
+// receiver derive the key without knowing the sender in advance, as node ids
+// are hashes of public keys it is checked against msg.Src.
+type pairwiseEnvelopeType struct {
+	PublicKey  string             // base64 encoded PKIX public key of the sender
+	KeyRequest bool               // the sender does not know our public key, or failed to decrypt a message
+	Reset      bool               // the sender restarted the session on our key request
+	Failed     *ratchetHeaderType `json:",omitempty"` // header of the message the sender failed to decrypt
+	Time       int64              `json:",omitempty"` // unix time in nanoseconds when a control message was sent
+	Signature  string             `json:",omitempty"` // base64 encoded signature of a control message, see signatureData
+	Header     *ratchetHeaderType `json:",omitempty"`
+	Ciphertext string             `json:",omitempty"`
+}
+
+type pairwisePeerType struct {
+	publicKey *ecdh.PublicKey // nil until the peer has sent its public key
+	secret    []byte          // shared secret of both identity keys
+	ratchet   *ratchetType
+	pending   *outboxType // messages waiting for the public key of the peer
+	requested time.Time   // when we last asked for the public key
+	restarted time.Time   // when we last asked the peer to restart the session after a failure
+	resetTime int64       // time of the last key request or reset accepted from the peer
+}
+
+type pairwiseType struct {
+	lock      sync.Mutex
+	mode      PairwiseMode
+	serviceId string
+	identity  *Identity
+	publicKey string
+	peers     map[string]*pairwisePeerType
+}
+
+func makePairwise(identity *Identity, serviceId string, mode PairwiseMode) (*pairwiseType, error) {
+	der, err := x509.MarshalPKIXPublicKey(&identity.privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pairwise := new(pairwiseType)
+	pairwise.mode = mode
+	pairwise.serviceId = serviceId
+	pairwise.identity = identity
+	pairwise.publicKey = encodeBase64(der)
+	pairwise.peers = make(map[string]*pairwisePeerType)
+
+	return pairwise, nil
+}
+
+/// PRIVATE
+
+// Encrypts msg for msg.Dst and returns the messages to send. If we do not know
+// the public key of the peer yet, msg is held back and a key request is
+// returned instead.
+func (pairwise *pairwiseType) seal(msg *Msg) []*Msg {
+	pairwise.lock.Lock()
+	defer pairwise.lock.Unlock()
+
+	peer := pairwise.peer(msg.Dst)
+	if peer.publicKey != nil {
+		if err := pairwise.encrypt(peer, msg); err != nil {
+			info("pairwise: failed to encrypt message " + msg.Id + ": " + err.Error())
+			return nil
+		}
+		return []*Msg{msg}
+	}
+
+	peer.pending.lock.Lock()
+	peer.pending.push(msg, time.Now().Add(peer.pending.expiry))
+	peer.pending.lock.Unlock()
+
+	if time.Since(peer.requested) < time.Second*PAIRWISE_RETRY_RATE {
+		return nil
+	}
+	debug("pairwise: asking <" + msg.Dst + "> for its public key")
+	peer.requested = time.Now()
+	return []*Msg{pairwise.composeControlMsg(msg.Dst, pairwiseEnvelopeType{KeyRequest: true})}
+}
+
+// Handles a pairwise encrypted msg and decrypts its payload. Returns false if
+// msg only carried keys, and the messages to send in response.
+func (pairwise *pairwiseType) open(msg *Msg) (bool, []*Msg, error) {
+	var envelope pairwiseEnvelopeType
+	if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+		return false, nil, errors.New("pairwise: invalid envelope")
+	}
+
+	signingKey, err := parsePairwisePublicKey(msg.Src, envelope.PublicKey)
+	if err != nil {
+		return false, nil, err
+	}
+	publicKey, err := signingKey.ECDH()
+	if err != nil {
+		return false, nil, err
+	}
+
+	pairwise.lock.Lock()
+	defer pairwise.lock.Unlock()
+
+	var replies []*Msg
+	peer := pairwise.peer(msg.Src)
+	if peer.publicKey == nil || !peer.publicKey.Equal(publicKey) {
+		if err := pairwise.start(peer, msg.Src, publicKey); err != nil {
+			return false, nil, err
+		}
+
+		// send what we were holding back
+		peer.pending.lock.Lock()
+		pending := peer.pending.drain()
+		peer.pending.lock.Unlock()
+		for _, pendingMsg := range pending {
+			if err := pairwise.encrypt(peer, pendingMsg); err != nil {
+				info("pairwise: failed to encrypt message " + pendingMsg.Id + ": " + err.Error())
+				continue
+			}
+			replies = append(replies, pendingMsg)
+		}
+	} else if envelope.KeyRequest || envelope.Reset {
+		if err := pairwise.checkRestart(peer, msg, envelope, signingKey); err != nil {
+			info("pairwise: ignoring session restart of <" + msg.Src + ">: " + err.Error())
+			return false, nil, err
+		}
+		debug("pairwise: <" + msg.Src + "> restarted the session")
+		if err := pairwise.start(peer, msg.Src, publicKey); err != nil {
+			return false, nil, err
+		}
+	}
+
+	if envelope.KeyRequest {
+		replies = append(replies, pairwise.composeControlMsg(msg.Src, pairwiseEnvelopeType{Reset: true}))
+	}
+
+	if envelope.Ciphertext == "" {
+		return false, replies, nil
+	}
+
+	if err := pairwise.decrypt(peer, msg, envelope); err != nil {
+		if peer.ratchet != nil && envelope.Header != nil && time.Since(peer.restarted) >= time.Second*PAIRWISE_RETRY_RATE {
+			// one of us has probably lost the session, e.g. restarted. The message may
+			// as well be forged, so the peer only restarts if it has sent it, and we
+			// restart on its signed reset.
+			info("pairwise: asking <" + msg.Src + "> to restart the session")
+			peer.restarted = time.Now()
+			replies = append(replies, pairwise.composeControlMsg(msg.Src, pairwiseEnvelopeType{KeyRequest: true, Failed: envelope.Header}))
+		}
+		return false, replies, err
+	}
+
+	return true, replies, nil
+}
+
+// Returns the state of the peer with id nodeId, the caller must hold the lock
+func (pairwise *pairwiseType) peer(nodeId string) *pairwisePeerType {
+	peer := pairwise.peers[nodeId]
+	if peer == nil {
+		peer = new(pairwisePeerType)
+		peer.pending = makeOutbox()
+		pairwise.peers[nodeId] = peer
+	}
+	return peer
+}
+
+// Checks that a key request or reset has been signed by the peer recently and
+// is not a replay, and that the message a key request refers to has been sent
+// by us. The caller must hold the lock.
+func (pairwise *pairwiseType) checkRestart(peer *pairwisePeerType, msg *Msg, envelope pairwiseEnvelopeType, signingKey *ecdsa.PublicKey) error {
+	signature, err := decodeBase64(envelope.Signature)
+	if err != nil || !ecdsa.VerifyASN1(signingKey, pairwise.signatureData(msg.Src, pairwise.identity.Id(), envelope), signature) {
+		return errors.New("pairwise: invalid signature")
+	}
+
+	window := int64(time.Second * PAIRWISE_RESET_WINDOW)
+	now := time.Now().UnixNano()
+	if envelope.Time <= peer.resetTime || envelope.Time < now-window || envelope.Time > now+window {
+		return errors.New("pairwise: stale or replayed restart")
+	}
+	if envelope.Failed != nil && (peer.ratchet == nil || !peer.ratchet.sent(*envelope.Failed)) {
+		return errors.New("pairwise: restart for a message we have not sent")
+	}
+
+	peer.resetTime = envelope.Time
+	return nil
+}
+
+// Returns the hash of a control message that is signed
+func (pairwise *pairwiseType) signatureData(src string, dst string, envelope pairwiseEnvelopeType) []byte {
+	data, err := json.Marshal([]interface{}{"bitverse-pairwise", pairwise.serviceId, src, dst, envelope.PublicKey, envelope.KeyRequest, envelope.Reset, envelope.Failed, envelope.Time})
+	if err != nil {
+		panic(err)
+	}
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// Derives the shared secret with the peer and starts a new session
+func (pairwise *pairwiseType) start(peer *pairwisePeerType, peerId string, publicKey *ecdh.PublicKey) error {
+	identityKey, err := pairwise.identity.privateKey.ECDH()
+	if err != nil {
+		return err
+	}
+	secret, err := identityKey.ECDH(publicKey)
+	if err != nil {
+		return err
+	}
+
+	// bind the secret to the service and both ids, so that every service uses its own keys
+	myId := pairwise.identity.Id()
+	initiator := myId < peerId
+	ids := myId + ":" + peerId
+	if !initiator {
+		ids = peerId + ":" + myId
+	}
+	peer.secret, err = hkdf.Key(sha256.New, secret, nil, "bitverse-pairwise:"+pairwise.serviceId+":"+ids, 32)
+	if err != nil {
+		return err
+	}
+
+	peer.publicKey = publicKey
+	peer.ratchet = nil
+	if pairwise.mode == PairwiseRatchet {
+		peer.ratchet, err = makeRatchet(peer.secret, identityKey, publicKey, initiator)
+	}
+	return err
+}
+
+// Replaces the payload of msg with an envelope of the encrypted payload, the
+// caller must hold the lock
+func (pairwise *pairwiseType) encrypt(peer *pairwisePeerType, msg *Msg) error {
+	envelope := pairwiseEnvelopeType{PublicKey: pairwise.publicKey}
+	additionalData := msg.payloadAdditionalData()
+	key := peer.secret
+	if peer.ratchet != nil {
+		header, messageKey := peer.ratchet.next()
+		envelope.Header = &header
+		additionalData += ratchetAdditionalData(header)
+		key = messageKey
+	}
+	envelope.Ciphertext = encryptAes(encodeHex(key), msg.Payload, additionalData)
+
+	envelopeJson, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	msg.Payload = string(envelopeJson)
+	return nil
+}
+
+// Decrypts the ciphertext in envelope into the payload of msg, the caller must
+// hold the lock
+func (pairwise *pairwiseType) decrypt(peer *pairwisePeerType, msg *Msg, envelope pairwiseEnvelopeType) error {
+	additionalData := msg.payloadAdditionalData()
+	if peer.ratchet == nil {
+		if envelope.Header != nil {
+			return errors.New("pairwise: unexpected ratchet message")
+		}
+		payload, err := decryptAes(encodeHex(peer.secret), envelope.Ciphertext, additionalData)
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	}
+
+	if envelope.Header == nil {
+		return errors.New("pairwise: missing ratchet header")
+	}
+	return peer.ratchet.receive(*envelope.Header, func(messageKey []byte) error {
+		payload, err := decryptAes(encodeHex(messageKey), envelope.Ciphertext, additionalData+ratchetAdditionalData(*envelope.Header))
+		if err != nil {
+			return err
+		}
+		msg.Payload = payload
+		return nil
+	})
+}
+
+// Composes a signed message only carrying our public key and flags
+func (pairwise *pairwiseType) composeControlMsg(dst string, envelope pairwiseEnvelopeType) *Msg {
+	envelope.PublicKey = pairwise.publicKey
+	envelope.Time = time.Now().UnixNano()
+	signature, err := ecdsa.SignASN1(rand.Reader, pairwise.identity.privateKey, pairwise.signatureData(pairwise.identity.Id(), dst, envelope))
+	if err != nil {
+		panic(err)
+	}
+	envelope.Signature = encodeBase64(signature)
+
+	envelopeJson, err := json.Marshal(envelope)
+	if err != nil {
+		panic(err)
+	}
+	return composeMsgServiceMsg(pairwise.identity.Id(), dst, pairwise.serviceId, string(envelopeJson))
+}
+
+func ratchetAdditionalData(header ratchetHeaderType) string {
+	return ":" + header.RatchetKey + ":" + strconv.Itoa(header.N) + ":" + strconv.Itoa(header.PN)
+}
+
+// Parses a public key sent by nodeId, and checks that nodeId is derived from it
+func parsePairwisePublicKey(nodeId string, publicKey string) (*ecdsa.PublicKey, error) {
+	der, err := decodeBase64(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if peerId := makeNodeIdFromPublicKey(der); peerId.String() != nodeId {
+		return nil, errors.New("pairwise: public key does not match node id " + nodeId)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("pairwise: unsupported public key")
+	}
+	return ecdsaKey, nil
+}
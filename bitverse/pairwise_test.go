@@ -0,0 +1,205 @@
+package bitverse
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestRatchets(t *testing.T) (*ratchetType, *ratchetType) {
+	identity1, _ := GenerateIdentity()
+	identity2, _ := GenerateIdentity()
+	key1, _ := identity1.privateKey.ECDH()
+	key2, _ := identity2.privateKey.ECDH()
+	secret, _ := key1.ECDH(key2.PublicKey())
+
+	initiator, err := makeRatchet(secret, key1, key2.PublicKey(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := makeRatchet(secret, key2, key1.PublicKey(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func ratchetSend(ratchet *ratchetType, text string) (ratchetHeaderType, string) {
+	header, messageKey := ratchet.next()
+	return header, encryptAes(encodeHex(messageKey), text, "")
+}
+
+func ratchetReceive(ratchet *ratchetType, header ratchetHeaderType, ciphertext string) (string, error) {
+	var text string
+	err := ratchet.receive(header, func(messageKey []byte) error {
+		var err error
+		text, err = decryptAes(encodeHex(messageKey), ciphertext, "")
+		return err
+	})
+	return text, err
+}
+
+func TestRatchet(t *testing.T) {
+	alice, bob := makeTestRatchets(t)
+
+	// the responder may send first
+	header, ciphertext := ratchetSend(bob, "hello alice")
+	if text, err := ratchetReceive(alice, header, ciphertext); err != nil || text != "hello alice" {
+		t.Fatalf("failed to receive first message of responder: %v", err)
+	}
+
+	for round := 0; round < 3; round++ {
+		var headers []ratchetHeaderType
+		var ciphertexts []string
+		for i := 0; i < 3; i++ {
+			header, ciphertext := ratchetSend(alice, "msg "+strconv.Itoa(i))
+			headers = append(headers, header)
+			ciphertexts = append(ciphertexts, ciphertext)
+		}
+
+		// deliver out of order
+		for _, i := range []int{2, 0, 1} {
+			if text, err := ratchetReceive(bob, headers[i], ciphertexts[i]); err != nil || text != "msg "+strconv.Itoa(i) {
+				t.Fatalf("failed to receive message %d: %v", i, err)
+			}
+		}
+
+		// a replayed message can not be decrypted again
+		if _, err := ratchetReceive(bob, headers[0], ciphertexts[0]); err == nil {
+			t.Error("expected replayed message to fail")
+		}
+
+		header, ciphertext := ratchetSend(bob, "reply")
+		if text, err := ratchetReceive(alice, header, ciphertext); err != nil || text != "reply" {
+			t.Fatalf("failed to receive reply: %v", err)
+		}
+	}
+
+	// a forged message does not break the ratchet
+	header, ciphertext = ratchetSend(alice, "after forgery")
+	forged := header
+	forgedKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	forged.RatchetKey = encodeBase64(forgedKey.PublicKey().Bytes())
+	if _, err := ratchetReceive(bob, forged, ciphertext); err == nil {
+		t.Error("expected forged message to fail")
+	}
+	if text, err := ratchetReceive(bob, header, ciphertext); err != nil || text != "after forgery" {
+		t.Fatalf("failed to receive message after forgery: %v", err)
+	}
+
+	// keys of skipped messages expire
+	lateHeader, lateCiphertext := ratchetSend(alice, "late")
+	header, ciphertext = ratchetSend(alice, "on time")
+	if text, err := ratchetReceive(bob, header, ciphertext); err != nil || text != "on time" {
+		t.Fatalf("failed to receive message after a skipped one: %v", err)
+	}
+	for _, skipped := range bob.skipped {
+		skipped.expires = time.Now()
+	}
+	if _, err := ratchetReceive(bob, lateHeader, lateCiphertext); err == nil {
+		t.Error("expected the key of a skipped message to expire")
+	}
+}
+
+// Delivers msgs and the replies they cause between the pairwise states, returns
+// the payloads delivered
+func pairwiseExchange(t *testing.T, nodes map[string]*pairwiseType, msgs []*Msg) []string {
+	var delivered []string
+	for len(msgs) > 0 {
+		msg := msgs[0]
+		msgs = msgs[1:]
+		deliver, replies, _ := nodes[msg.Dst].open(msg)
+		if deliver {
+			delivered = append(delivered, msg.Payload)
+		}
+		msgs = append(msgs, replies...)
+	}
+	return delivered
+}
+
+func TestPairwiseRestart(t *testing.T) {
+	aliceIdentity, _ := GenerateIdentity()
+	bobIdentity, _ := GenerateIdentity()
+	alice, _ := makePairwise(aliceIdentity, "ping", PairwiseRatchet)
+	bob, _ := makePairwise(bobIdentity, "ping", PairwiseRatchet)
+	nodes := map[string]*pairwiseType{aliceIdentity.Id(): alice, bobIdentity.Id(): bob}
+	send := func(text string) []string {
+		return pairwiseExchange(t, nodes, alice.seal(composeMsgServiceMsg(aliceIdentity.Id(), bobIdentity.Id(), "ping", text)))
+	}
+
+	// the first message waits for the key exchange
+	var controlMsgs []*Msg
+	keyRequest := alice.seal(composeMsgServiceMsg(aliceIdentity.Id(), bobIdentity.Id(), "ping", "hello"))
+	_, replies, _ := bob.open(keyRequest[0])
+	controlMsgs = append(controlMsgs, keyRequest[0], replies[0])
+	if delivered := pairwiseExchange(t, nodes, replies); len(delivered) != 1 || delivered[0] != "hello" {
+		t.Fatalf("expected hello to be delivered, got %v", delivered)
+	}
+
+	// restarts that are not signed, or replayed, are ignored
+	forged := composeMsgServiceMsg(aliceIdentity.Id(), bobIdentity.Id(), "ping", `{"PublicKey":"`+alice.publicKey+`","Reset":true}`)
+	replayed := *controlMsgs[0]
+	pairwiseExchange(t, nodes, []*Msg{forged, &replayed})
+	if delivered := send("after forged restart"); len(delivered) != 1 {
+		t.Fatal("expected the session to survive a forged restart")
+	}
+
+	// a message that cannot be decrypted only restarts the session if it was sent
+	garbage := alice.seal(composeMsgServiceMsg(aliceIdentity.Id(), bobIdentity.Id(), "ping", "garbage"))
+	garbage[0].Payload = strings.Replace(garbage[0].Payload, `"N":`, `"N":1`, 1)
+	pairwiseExchange(t, nodes, garbage)
+	if bob.peers[aliceIdentity.Id()].restarted.IsZero() {
+		t.Fatal("expected bob to ask alice to restart")
+	}
+	if delivered := send("after garbage"); len(delivered) != 1 {
+		t.Fatal("expected the session to survive a message that was not sent")
+	}
+
+	// once both have sent, bob cannot follow alice's ratchet without the session
+	reply := bob.seal(composeMsgServiceMsg(bobIdentity.Id(), aliceIdentity.Id(), "ping", "reply"))
+	if delivered := pairwiseExchange(t, nodes, reply); len(delivered) != 1 {
+		t.Fatal("expected alice to receive the reply")
+	}
+	send("ratcheted")
+
+	// bob loses the session, e.g. because it restarted
+	bob, _ = makePairwise(bobIdentity, "ping", PairwiseRatchet)
+	nodes[bobIdentity.Id()] = bob
+	if delivered := send("lost"); len(delivered) != 0 {
+		t.Fatal("expected the message to be lost with the session")
+	}
+	if delivered := send("restarted"); len(delivered) != 1 || delivered[0] != "restarted" {
+		t.Fatalf("expected the session to be restarted, got %v", delivered)
+	}
+}
+
+func TestPairwiseMsgService(t *testing.T) {
+	for _, mode := range []PairwiseMode{PairwiseStatic, PairwiseRatchet} {
+		network := MakeMemNetwork()
+		MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+		time.Sleep(100 * time.Millisecond)
+
+		var edgeNodes []*EdgeNode
+		var msgServices []*MsgService
+		for i := 0; i < 2; i++ {
+			edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+			msgService, err := edgeNode.CreatePairwiseMsgService("ping", mode, new(memPingObserver))
+			if err != nil {
+				t.Fatalf("failed to create msg service: %v", err)
+			}
+			go edgeNode.Connect("super:1111")
+			edgeNodes = append(edgeNodes, edgeNode)
+			msgServices = append(msgServices, msgService)
+		}
+		time.Sleep(300 * time.Millisecond)
+
+		for i := 0; i < 6; i++ {
+			if reply := memPing(msgServices[i%2], edgeNodes[(i+1)%2].Id(), 5); reply != "pong" {
+				t.Fatalf("mode %d: ping %d failed: %s", mode, i, reply)
+			}
+		}
+	}
+}
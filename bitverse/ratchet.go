@@ -0,0 +1,225 @@
+package bitverse
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// The ratchet is a double ratchet as used by Signal. Every message is encrypted
+// with a new key derived from a chain key, which is then replaced by a hash of
+// itself. Every time the peer answers, both sides mix a new ECDH secret of fresh
+// ephemeral keys into the chain keys. Keys of old messages can therefore not be
+// recovered from the current state or from the identity keys.
+//
+// The node with the lower id starts the ratchet with an ephemeral key and the
+// identity key of its peer. The other node may send before it has received
+// anything on a responder chain derived from the shared secret of the identity
+// keys, until the first ratchet step.
+
+// How many message keys of skipped (lost or reordered) messages are kept, and
+// for how long
+const RATCHET_MAX_SKIP = 1000
+const RATCHET_SKIPPED_TTL time.Duration = 3600
+
+// Sent with every ratchet message
+type ratchetHeaderType struct {
+	RatchetKey string // base64 encoded ephemeral public key of the sender
+	N          int    // message number in the current sending chain
+	PN         int    // number of messages in the previous sending chain
+}
+
+type ratchetType struct {
+	rootKey      []byte
+	sendingKey   *ecdh.PrivateKey
+	receivingKey *ecdh.PublicKey // nil until the peer has sent a ratchet key
+	sendingChain []byte          // nil until we have a sending chain
+	receiving    []byte          // receiving chain key, nil until the peer has sent
+	n            int
+	pn           int
+	nr           int
+	skipped      map[string]*skippedKeyType // message keys of skipped messages, by ratchet key and number
+}
+
+type skippedKeyType struct {
+	messageKey []byte
+	expires    time.Time
+}
+
+// Creates the ratchet state with a peer. secret is the shared secret of both
+// identity keys, initiator is set for the node with the lower id.
+func makeRatchet(secret []byte, identityKey *ecdh.PrivateKey, peerIdentityKey *ecdh.PublicKey, initiator bool) (*ratchetType, error) {
+	ratchet := new(ratchetType)
+	ratchet.skipped = make(map[string]*skippedKeyType)
+	responderChain, err := hkdf.Key(sha256.New, secret, nil, "bitverse-ratchet-responder", 32)
+	if err != nil {
+		return nil, err
+	}
+
+	if initiator {
+		ratchet.sendingKey, err = ecdh.P256().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		ratchet.receivingKey = peerIdentityKey
+		ratchet.receiving = responderChain
+		ratchet.rootKey, ratchet.sendingChain, err = ratchetRootStep(secret, ratchet.sendingKey, peerIdentityKey)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ratchet.rootKey = secret
+		ratchet.sendingKey = identityKey
+		ratchet.sendingChain = responderChain
+	}
+
+	return ratchet, nil
+}
+
+/// PRIVATE
+
+// Returns the header and key of the next message to send
+func (ratchet *ratchetType) next() (ratchetHeaderType, []byte) {
+	header := ratchetHeaderType{encodeBase64(ratchet.sendingKey.PublicKey().Bytes()), ratchet.n, ratchet.pn}
+	var messageKey []byte
+	ratchet.sendingChain, messageKey = ratchetChainStep(ratchet.sendingChain)
+	ratchet.n++
+	return header, messageKey
+}
+
+// Returns the key of a received message. The state is only changed if decrypt
+// succeeds with the key, so forged messages cannot break the ratchet.
+func (ratchet *ratchetType) receive(header ratchetHeaderType, decrypt func(messageKey []byte) error) error {
+	if skipped, ok := ratchet.skipped[skippedKey(header.RatchetKey, header.N)]; ok && time.Now().Before(skipped.expires) {
+		if err := decrypt(skipped.messageKey); err != nil {
+			return err
+		}
+		delete(ratchet.skipped, skippedKey(header.RatchetKey, header.N))
+		return nil
+	}
+
+	state := *ratchet
+	state.skipped = make(map[string]*skippedKeyType)
+	for key, skipped := range ratchet.skipped {
+		state.skipped[key] = skipped
+	}
+
+	if state.receivingKey == nil || header.RatchetKey != encodeBase64(state.receivingKey.Bytes()) {
+		if err := state.skip(header.PN); err != nil {
+			return err
+		}
+		if err := state.step(header.RatchetKey); err != nil {
+			return err
+		}
+	}
+	if err := state.skip(header.N); err != nil {
+		return err
+	}
+
+	var messageKey []byte
+	state.receiving, messageKey = ratchetChainStep(state.receiving)
+	state.nr++
+	if err := decrypt(messageKey); err != nil {
+		return err
+	}
+
+	*ratchet = state
+	return nil
+}
+
+// Returns true if header is the header of a message we have sent in the
+// current sending chain
+func (ratchet *ratchetType) sent(header ratchetHeaderType) bool {
+	return header.RatchetKey == encodeBase64(ratchet.sendingKey.PublicKey().Bytes()) && header.N >= 0 && header.N < ratchet.n
+}
+
+// Stores the keys of messages in the receiving chain up to message number
+// until. Keys of messages that have not arrived in time are dropped, so that
+// they do not stay around to decrypt messages recorded earlier.
+func (ratchet *ratchetType) skip(until int) error {
+	if ratchet.receiving == nil {
+		return nil
+	}
+
+	now := time.Now()
+	for key, skipped := range ratchet.skipped {
+		if !now.Before(skipped.expires) {
+			delete(ratchet.skipped, key)
+		}
+	}
+
+	if until-ratchet.nr > RATCHET_MAX_SKIP || len(ratchet.skipped)+until-ratchet.nr > RATCHET_MAX_SKIP {
+		return errors.New("ratchet: too many skipped messages")
+	}
+
+	for ratchet.nr < until {
+		var messageKey []byte
+		ratchet.receiving, messageKey = ratchetChainStep(ratchet.receiving)
+		ratchet.skipped[skippedKey(encodeBase64(ratchet.receivingKey.Bytes()), ratchet.nr)] = &skippedKeyType{messageKey, now.Add(time.Second * RATCHET_SKIPPED_TTL)}
+		ratchet.nr++
+	}
+	return nil
+}
+
+// Performs a ratchet step with a new ratchet key of the peer
+func (ratchet *ratchetType) step(ratchetKey string) error {
+	der, err := decodeBase64(ratchetKey)
+	if err != nil {
+		return err
+	}
+	receivingKey, err := ecdh.P256().NewPublicKey(der)
+	if err != nil {
+		return err
+	}
+
+	ratchet.pn = ratchet.n
+	ratchet.n = 0
+	ratchet.nr = 0
+	ratchet.receivingKey = receivingKey
+	ratchet.rootKey, ratchet.receiving, err = ratchetRootStep(ratchet.rootKey, ratchet.sendingKey, receivingKey)
+	if err != nil {
+		return err
+	}
+
+	ratchet.sendingKey, err = ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	ratchet.rootKey, ratchet.sendingChain, err = ratchetRootStep(ratchet.rootKey, ratchet.sendingKey, receivingKey)
+	return err
+}
+
+// Mixes the ECDH secret of privateKey and publicKey into rootKey, and returns
+// the new root key and a new chain key
+func ratchetRootStep(rootKey []byte, privateKey *ecdh.PrivateKey, publicKey *ecdh.PublicKey) ([]byte, []byte, error) {
+	secret, err := privateKey.ECDH(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := hkdf.Key(sha256.New, secret, rootKey, "bitverse-ratchet-root", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys[:32], keys[32:], nil
+}
+
+// Returns the next chain key and a message key
+func ratchetChainStep(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	messageKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{2})
+	return mac.Sum(nil), messageKey
+}
+
+func skippedKey(ratchetKey string, n int) string {
+	return ratchetKey + ":" + strconv.Itoa(n)
+}
@@ -0,0 +1,199 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const REGISTRY_LEASE time.Duration = 60
+
+// A location record tells which super node an edge node is connected to. The
+// record is stored on the super node responsible for the edge node id in the
+// DHT and expires unless the hosting super node renews its lease.
+type locationRecord struct {
+	NodeId      string // edge node id
+	SuperNodeId string // id of the hosting super node
+	Address     string // address of the hosting super node
+	Expires     int64  // unix time when the lease expires
+}
+
+type registryType struct {
+	lock    sync.Mutex
+	records map[string]*locationRecord // edge node id:record
+}
+
+type lookupLocationReply struct {
+	Record *locationRecord
+}
+
+func makeRegistry() *registryType {
+	registry := new(registryType)
+	registry.records = make(map[string]*locationRecord)
+	return registry
+}
+
+func (registry *registryType) publish(record *locationRecord) {
+	registry.lock.Lock()
+	registry.records[record.NodeId] = record
+	registry.lock.Unlock()
+}
+
+// Only removes the record if it is still held by the super node at address,
+// the edge node may already have connected to another super node
+func (registry *registryType) withdraw(nodeId string, address string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	record := registry.records[nodeId]
+	if record != nil && record.Address == address {
+		delete(registry.records, nodeId)
+	}
+}
+
+func (registry *registryType) lookup(nodeId string) *locationRecord {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	record := registry.records[nodeId]
+	if record == nil || record.Expires < time.Now().Unix() {
+		return nil
+	}
+	return record
+}
+
+// Removes records whose lease has expired, e.g. because the hosting super node crashed
+func (registry *registryType) expire() {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	now := time.Now().Unix()
+	for nodeId, record := range registry.records {
+		if record.Expires < now {
+			debug("registry: lease for " + nodeId + " at " + record.Address + " expired")
+			delete(registry.records, nodeId)
+		}
+	}
+}
+
+/// PRIVATE
+
+// Publishes a location record for one of our children and delivers any mail
+// held for it. Runs in a separate go routine.
+func (superNode *SuperNode) publishLocation(nodeId string) {
+	record := new(locationRecord)
+	record.NodeId = nodeId
+	record.SuperNodeId = superNode.Id()
+	record.Address = superNode.address
+	record.Expires = time.Now().Add(time.Second * REGISTRY_LEASE).Unix()
+
+	addresses, err := superNode.lookup(nodeId, 1)
+	if err != nil {
+		info("supernode: failed to publish location of " + nodeId + ": " + err.Error())
+		return
+	}
+
+	var reply publishLocationReply
+	err = superNode.rpc.call(addresses[0], "registry.Publish", record, &reply)
+	if err != nil {
+		info("supernode: failed to publish location of " + nodeId + ": " + err.Error())
+		return
+	}
+
+	// the mail is removed once we have acknowledged that it has been delivered
+	delivered := superNode.deliverMail(reply.Mail)
+	if len(delivered) > 0 {
+		err = superNode.rpc.call(addresses[0], "mailbox.Ack", ackMailArgs{nodeId, delivered}, nil)
+		if err != nil {
+			info("supernode: failed to acknowledge mail to " + nodeId + ": " + err.Error())
+		}
+	}
+}
+
+// Withdraws the location record of a child that has left. Runs in a separate go routine.
+func (superNode *SuperNode) withdrawLocation(nodeId string) {
+	addresses, err := superNode.lookup(nodeId, 1)
+	if err != nil {
+		debug("supernode: failed to withdraw location of " + nodeId + ": " + err.Error())
+		return
+	}
+
+	record := locationRecord{NodeId: nodeId, SuperNodeId: superNode.Id(), Address: superNode.address}
+	err = superNode.rpc.call(addresses[0], "registry.Withdraw", record, nil)
+	if err != nil {
+		debug("supernode: failed to withdraw location of " + nodeId + ": " + err.Error())
+	}
+}
+
+func (superNode *SuperNode) lookupLocation(nodeId string) (*locationRecord, error) {
+	addresses, err := superNode.lookup(nodeId, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply lookupLocationReply
+	err = superNode.rpc.call(addresses[0], "registry.Lookup", locationRecord{NodeId: nodeId}, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Record, nil
+}
+
+// Renews the leases of all our children, this also moves the records to the
+// right super node when the ring changes
+func (superNode *SuperNode) renewLocations() {
+	superNode.childrenLock.RLock()
+	nodeIds := make([]string, 0, len(superNode.children))
+	for nodeId, _ := range superNode.children {
+		nodeIds = append(nodeIds, nodeId)
+	}
+	superNode.childrenLock.RUnlock()
+
+	for _, nodeId := range nodeIds {
+		superNode.publishLocation(nodeId)
+	}
+}
+
+// The record is held by the calling super node, whatever it claims, and its
+// lease starts now
+func (superNode *SuperNode) servePublishLocation(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var record locationRecord
+	if err := json.Unmarshal(argsJson, &record); err != nil {
+		return nil, err
+	}
+	record.SuperNodeId = caller.nodeId
+	record.Address = caller.address
+	record.Expires = time.Now().Add(time.Second * REGISTRY_LEASE).Unix()
+
+	debug("registry: " + record.NodeId + " is hosted by " + record.Address)
+	superNode.registry.publish(&record)
+
+	// hand over mail held for the edge node to its super node, it is removed
+	// when the super node acknowledges it
+	var reply publishLocationReply
+	for _, mail := range superNode.mailbox.peek(record.NodeId) {
+		reply.Mail = append(reply.Mail, mail.Msg)
+	}
+	return reply, nil
+}
+
+func (superNode *SuperNode) serveWithdrawLocation(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var record locationRecord
+	if err := json.Unmarshal(argsJson, &record); err != nil {
+		return nil, err
+	}
+
+	// super nodes may only withdraw their own records
+	debug("registry: " + record.NodeId + " is no longer hosted by " + caller.address)
+	superNode.registry.withdraw(record.NodeId, caller.address)
+	return nil, nil
+}
+
+func (superNode *SuperNode) serveLookupLocation(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var args locationRecord
+	if err := json.Unmarshal(argsJson, &args); err != nil {
+		return nil, err
+	}
+
+	return lookupLocationReply{superNode.registry.lookup(args.NodeId)}, nil
+}
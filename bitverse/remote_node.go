@@ -3,6 +3,7 @@ package bitverse
 import (
 	"encoding/json"
 	"io"
+	"sync"
 )
 
 type RemoteNodeState int
@@ -17,15 +18,19 @@ type RemoteNode struct {
 	writer            io.Writer
 	id                string
 	remoteId          string
+	address           string // address advertised by the remote node, set if it claims to be a super node
 	state             RemoteNodeState
+	stateLock         sync.RWMutex
+	lock              sync.Mutex
 }
 
-func makeRemoteNode(remoteNodeChannel chan *RemoteNode, writer io.Writer, remoteId string, id string) *RemoteNode {
+func makeRemoteNode(remoteNodeChannel chan *RemoteNode, writer io.Writer, remoteId string, id string, address string) *RemoteNode {
 	remoteNode := new(RemoteNode)
 	remoteNode.remoteNodeChannel = remoteNodeChannel
 	remoteNode.writer = writer
 	remoteNode.id = id
 	remoteNode.remoteId = remoteId
+	remoteNode.address = address
 	remoteNode.state = Alive
 
 	return remoteNode
@@ -44,15 +49,37 @@ func (remoteNode *RemoteNode) RemoteId() string {
 	return remoteNode.remoteId
 }
 
+// Returns the address advertised by the remote super node, or an empty string
+// if the remote node is an edge node
+func (remoteNode *RemoteNode) Address() string {
+	return remoteNode.address
+}
+
 /// PRIVATE
 
-func (remoteNode *RemoteNode) deliver(msg *Msg) {
+func (remoteNode *RemoteNode) getState() RemoteNodeState {
+	remoteNode.stateLock.RLock()
+	defer remoteNode.stateLock.RUnlock()
+	return remoteNode.state
+}
+
+func (remoteNode *RemoteNode) setState(state RemoteNodeState) {
+	remoteNode.stateLock.Lock()
+	defer remoteNode.stateLock.Unlock()
+	remoteNode.state = state
+}
+
+// Writes msg to the link, returns an error if the link is dead
+func (remoteNode *RemoteNode) deliver(msg *Msg) error {
+	remoteNode.lock.Lock()
 	enc := json.NewEncoder(remoteNode.writer)
 	err := enc.Encode(msg)
+	remoteNode.lock.Unlock()
 
 	if err != nil {
-		remoteNode.state = Dead
+		remoteNode.setState(Dead)
 		debug("link: detecting dead link")
 		remoteNode.remoteNodeChannel <- remoteNode // notify the node so it can remove it
 	}
+	return err
 }
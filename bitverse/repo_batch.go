@@ -0,0 +1,188 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// maximum number of writes in a batch
+const REPO_MAX_BATCH_SIZE = 100
+
+// RepoBatch groups writes to a repo that are signed once and applied
+// all-or-nothing by the super node, see RepoService.Batch
+type RepoBatch struct {
+	repoService *RepoService
+	batch       repoBatchType
+}
+
+// Sent as the value of a batch request
+type repoBatchType struct {
+	Ops    []repoBatchOpType
+	Checks []repoBatchCheckType `json:",omitempty"`
+}
+
+type repoBatchOpType struct {
+	Cmd   int // Store or Delete
+	Key   string
+	Value string `json:",omitempty"` // aes encrypted
+	TTL   int64  `json:",omitempty"` // seconds until the value expires, 0 if never
+}
+
+// A precondition of a batch
+type repoBatchCheckType struct {
+	Key     string
+	Version int64 // 0 if the key must not exist
+}
+
+// Returns an empty batch. Add writes and preconditions to it and call Commit to
+// apply them together with a single signature.
+func (repoService *RepoService) Batch() *RepoBatch {
+	batch := new(RepoBatch)
+	batch.repoService = repoService
+	return batch
+}
+
+func (batch *RepoBatch) Store(key string, value string) *RepoBatch {
+	return batch.StoreWithTTL(key, value, 0)
+}
+
+// Like Store, but the value expires after ttl, see RepoService.StoreWithTTL
+func (batch *RepoBatch) StoreWithTTL(key string, value string, ttl time.Duration) *RepoBatch {
+	encryptedValue := batch.repoService.msgService.keyring.encrypt(value, repoValueAdditionalData(batch.repoService.repoId, key))
+	op := repoBatchOpType{Cmd: Store, Key: key, Value: encryptedValue, TTL: int64((ttl + time.Second - 1) / time.Second)}
+	batch.batch.Ops = append(batch.batch.Ops, op)
+	return batch
+}
+
+func (batch *RepoBatch) Delete(key string) *RepoBatch {
+	batch.batch.Ops = append(batch.batch.Ops, repoBatchOpType{Cmd: Delete, Key: key})
+	return batch
+}
+
+// Makes the batch fail with ErrConflict unless the current version of key is
+// version, e.g. as returned by LookupVersion. Pass 0 if key must not exist. The
+// key does not have to be written by the batch.
+func (batch *RepoBatch) Require(key string, version int64) *RepoBatch {
+	batch.batch.Checks = append(batch.batch.Checks, repoBatchCheckType{Key: key, Version: version})
+	return batch
+}
+
+// Applies the batch and calls callback with a map[string]int64 holding the new
+// version of every written key, or with ErrConflict if a precondition did not
+// hold, in which case nothing has been written
+func (batch *RepoBatch) Commit(timeout int32, callback func(err error, versions interface{})) {
+	batchJson, err := json.Marshal(batch.batch)
+	if err != nil {
+		callback(err, nil)
+		return
+	}
+
+	repoService := batch.repoService
+	msg := composeRepoBatchMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, string(batchJson), repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, func(err error, data interface{}) {
+		if err != nil {
+			if err.Error() == ErrConflict.Error() {
+				err = ErrConflict
+			}
+			callback(err, nil)
+			return
+		}
+
+		versions := make(map[string]int64)
+		if err := json.Unmarshal([]byte(data.(string)), &versions); err != nil {
+			callback(errors.New("invalid batch reply: "+err.Error()), nil)
+			return
+		}
+		callback(nil, versions)
+	})
+}
+
+/// PRIVATE
+
+// Checks that the batch is well-formed
+func (batch *repoBatchType) validate() error {
+	if len(batch.Ops) == 0 {
+		return errors.New("empty batch")
+	}
+	if len(batch.Ops) > REPO_MAX_BATCH_SIZE {
+		return errors.New("too many writes in batch")
+	}
+
+	keys := make(map[string]bool)
+	for _, op := range batch.Ops {
+		if op.Cmd != Store && op.Cmd != Delete {
+			return errors.New("unsupported batch command")
+		}
+		if keys[op.Key] {
+			return errors.New("key " + op.Key + " is written more than once")
+		}
+		keys[op.Key] = true
+	}
+	return nil
+}
+
+// Applies a batch if all its preconditions hold, otherwise fails with
+// ErrConflict without writing anything. The entries are written by the batch
+// request. Returns the new entries, deleting a key that does not exist is not
+// a change.
+func (repoStore *repoStoreType) batch(repoId string, batch *repoBatchType, proof *repoProofType) ([]*repoChangeType, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	for _, check := range batch.Checks {
+		entry, err := repoStore.storage.Get(repoId, check.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		version := int64(0)
+		if entry != nil && !entry.Deleted && !entry.expired() {
+			version = entry.Version
+		}
+		if version != check.Version {
+			debug("supernode: batch precondition on key <" + check.Key + "> failed")
+			return nil, ErrConflict
+		}
+	}
+
+	var changes []*repoChangeType
+	entries := make(map[string]*RepoEntry)
+	for _, op := range batch.Ops {
+		oldEntry, err := repoStore.storage.Get(repoId, op.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		var newEntry *RepoEntry
+		if op.Cmd == Delete {
+			if oldEntry == nil || oldEntry.Deleted || oldEntry.expired() {
+				continue
+			}
+			if newEntry, err = repoStore.tombstone(repoId, oldEntry, proof); err != nil {
+				return nil, err
+			}
+		} else {
+			seq, err := repoStore.nextSeq(repoId)
+			if err != nil {
+				return nil, err
+			}
+			newEntry = &RepoEntry{Value: op.Value, Version: 1, Seq: seq, Proof: proof}
+			if op.TTL > 0 {
+				newEntry.Expires = time.Now().Unix() + op.TTL
+			}
+			if oldEntry != nil {
+				newEntry.Version = oldEntry.Version + 1
+			}
+		}
+
+		entries[op.Key] = newEntry
+		changes = append(changes, &repoChangeType{repoId, op.Key, newEntry})
+	}
+
+	if err := repoStore.storage.PutAll(repoId, entries); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -0,0 +1,240 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Super nodes only merge replicated data they can verify. Every entry keeps the
+// signed request that wrote it, and the acl keeps the last requests that
+// changed it, so that a super node cannot make up values or rights in the
+// repos it replicates. A replica that knows nothing about a repo takes the
+// owner and acl of the first record it gets, the same way anyone may claim a
+// repo nobody owns. Versions are assigned by the super nodes and not signed.
+
+// number of acl changes kept to bring replicas that missed some up to date
+const REPO_ACL_LOG_SIZE = 16
+
+// The request behind a change of a repo
+type repoProofType struct {
+	Src        string
+	Cmd        int
+	Key        string `json:",omitempty"`
+	Value      string `json:",omitempty"`
+	Version    int64  `json:",omitempty"`
+	TTL        int64  `json:",omitempty"`
+	Signer     string `json:",omitempty"` // as sent in the request, empty for the owner
+	Right      int    `json:",omitempty"`
+	Wipe       bool   `json:",omitempty"`
+	Nonce      int64  `json:",omitempty"`
+	Signature  string `json:",omitempty"`
+	PubKey     string // pem encoded public key that signed the request, or claimed the repo
+	AclVersion int64  `json:",omitempty"` // version of the acl after the change, set for acl changes
+}
+
+// Returns the proof of a request that has been verified with pubKey
+func makeRepoProof(msg *Msg, pubKey string) *repoProofType {
+	return &repoProofType{Src: msg.Src, Cmd: msg.RepoCmd, Key: msg.RepoKey, Value: msg.RepoValue, Version: msg.RepoVersion, TTL: msg.RepoTTL,
+		Signer: msg.RepoSigner, Right: msg.RepoRight, Wipe: msg.RepoWipe, Nonce: msg.RepoNonce, Signature: msg.Signature, PubKey: pubKey}
+}
+
+// Claims are not signed, the claim only holds if nobody owned the repo
+func makeRepoClaimProof(owner string) *repoProofType {
+	return &repoProofType{Cmd: Claim, PubKey: owner}
+}
+
+/// PRIVATE
+
+// Checks that the request has been signed with PubKey
+func (proof *repoProofType) verify(repoId string) error {
+	if proof.Cmd == Claim {
+		return nil
+	}
+	if proof.Signer != "" && proof.Signer != proof.PubKey {
+		return errors.New("request signed by another public key")
+	}
+
+	msg := &Msg{Src: proof.Src, RepoId: repoId, RepoCmd: proof.Cmd, RepoKey: proof.Key, RepoValue: proof.Value, RepoVersion: proof.Version,
+		RepoTTL: proof.TTL, RepoSigner: proof.Signer, RepoRight: proof.Right, RepoWipe: proof.Wipe, RepoNonce: proof.Nonce}
+	_, pub, err := importKeyFromString(proof.PubKey)
+	if err != nil || pub == nil {
+		return errors.New("invalid public key")
+	}
+	if err := verify(pub, msg.repoSignatureData(), proof.Signature); err != nil {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// Checks that entry has been written to key by the request, by a public key
+// that is or has been allowed to write to the repo
+func verifyRepoEntry(repoId string, key string, entry *RepoEntry, owner string, acl *RepoAcl) error {
+	proof := entry.Proof
+	if proof == nil {
+		return errors.New("unsigned entry")
+	}
+	if proof.PubKey != owner && (acl == nil || !acl.Writers[proof.PubKey]) {
+		return errors.New("entry written by a public key without write access")
+	}
+	if err := proof.verify(repoId); err != nil {
+		return err
+	}
+
+	switch proof.Cmd {
+	case Store, StoreIf:
+		if proof.Key == key {
+			return proof.verifyStore(entry, proof.Value, proof.TTL)
+		}
+	case Delete:
+		if proof.Key == key && entry.Deleted {
+			return nil
+		}
+	case Release:
+		if proof.Wipe && entry.Deleted {
+			return nil
+		}
+	case Batch:
+		batch := new(repoBatchType)
+		if err := json.Unmarshal([]byte(proof.Value), batch); err != nil {
+			return errors.New("invalid batch")
+		}
+		for _, op := range batch.Ops {
+			if op.Key == key && op.Cmd == Store {
+				return proof.verifyStore(entry, op.Value, op.TTL)
+			} else if op.Key == key && op.Cmd == Delete && entry.Deleted {
+				return nil
+			}
+		}
+	}
+	return errors.New("entry not written by the request")
+}
+
+// Checks an entry written by a store of value, which expires after ttl. The
+// nonce is the time of the request, the entry becomes a tombstone when expired.
+func (proof *repoProofType) verifyStore(entry *RepoEntry, value string, ttl int64) error {
+	requested := proof.Nonce / int64(time.Second)
+	if entry.Deleted {
+		if ttl == 0 || requested+ttl > time.Now().Unix() {
+			return errors.New("tombstone of an entry that has not expired")
+		}
+		return nil
+	}
+
+	if entry.Value != value {
+		return errors.New("entry does not hold the stored value")
+	}
+	if (ttl == 0) != (entry.Expires == 0) || entry.Expires > requested+ttl+int64(REPO_NONCE_WINDOW) {
+		return errors.New("entry expires later than requested")
+	}
+	return nil
+}
+
+// Applies an acl change to the owner and acl of a repo, acl may be nil if the
+// repo has never changed hands. Returns the new owner and a new acl.
+func applyRepoAclChange(owner string, acl *RepoAcl, proof *repoProofType) (string, *RepoAcl, error) {
+	next := acl.copy()
+	if next == nil {
+		next = &RepoAcl{Grants: make(map[string]RepoRight), Writers: make(map[string]bool)}
+		if owner != "" {
+			next.Writers[owner] = true
+		}
+	}
+
+	switch proof.Cmd {
+	case Claim:
+		if owner != "" {
+			return "", nil, errors.New("repo already claimed")
+		}
+		owner = proof.PubKey
+
+	case Grant:
+		grantee := proof.Value
+		right := RepoRight(proof.Right)
+		if owner == "" || (proof.PubKey != owner && next.Grants[proof.PubKey] < RepoAdmin) {
+			return "", nil, errors.New("access denied")
+		}
+		if grantee == owner {
+			return "", nil, errors.New("the owner has all rights")
+		}
+		if right < RepoNone || right > RepoAdmin {
+			return "", nil, errors.New("invalid right")
+		}
+		if proof.PubKey != owner && (right == RepoAdmin || next.Grants[grantee] == RepoAdmin) {
+			return "", nil, errors.New("only the owner may grant or revoke admin rights")
+		}
+
+		if right == RepoNone {
+			delete(next.Grants, grantee)
+		} else {
+			next.Grants[grantee] = right
+		}
+		if right >= RepoWrite {
+			next.Writers[grantee] = true
+		}
+
+	case Transfer, Release:
+		if owner == "" || proof.PubKey != owner {
+			return "", nil, errors.New("only the owner may transfer or release the repo")
+		}
+		if proof.Cmd == Transfer {
+			owner = proof.Value
+			delete(next.Grants, owner) // the owner has all rights anyway
+		} else {
+			owner = ""
+			next.Grants = make(map[string]RepoRight)
+		}
+
+	default:
+		return "", nil, errors.New("not an acl change")
+	}
+
+	// earlier writers are kept so that their entries can still be verified
+	if owner != "" {
+		next.Writers[owner] = true
+	}
+	next.Version++
+	proof.AclVersion = next.Version
+	next.Log = append(next.Log, proof)
+	if len(next.Log) > REPO_ACL_LOG_SIZE {
+		next.Log = next.Log[len(next.Log)-REPO_ACL_LOG_SIZE:]
+	}
+	return owner, next, nil
+}
+
+// Brings the owner and acl of a repo up to date by applying the changes in the
+// log of a newer acl, which must include all changes since acl
+func replayRepoAcl(repoId string, owner string, acl *RepoAcl, newer *RepoAcl) (string, *RepoAcl, error) {
+	log := append([]*repoProofType(nil), newer.Log...)
+	sort.Slice(log, func(i, j int) bool { return log[i].AclVersion < log[j].AclVersion })
+
+	version := int64(0)
+	if acl != nil {
+		version = acl.Version
+	}
+	for _, proof := range log {
+		if proof.AclVersion <= version {
+			continue
+		}
+		if proof.AclVersion != version+1 {
+			return "", nil, errors.New("missing acl changes after version " + strconv.FormatInt(version, 10))
+		}
+		if err := proof.verify(repoId); err != nil {
+			return "", nil, err
+		}
+
+		var err error
+		replayed := *proof
+		if owner, acl, err = applyRepoAclChange(owner, acl, &replayed); err != nil {
+			return "", nil, err
+		}
+		version = acl.Version
+	}
+
+	if version != newer.Version {
+		return "", nil, errors.New("missing acl changes after version " + strconv.FormatInt(version, 10))
+	}
+	return owner, acl, nil
+}
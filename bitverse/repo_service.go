@@ -2,54 +2,287 @@ package bitverse
 
 import (
 	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
 	//"fmt"
 )
 
 type RepoMsgServiceObserver struct {
+	repoService *RepoService // set once the repo has been claimed
 }
 
 func (repoMsgServiceObserver *RepoMsgServiceObserver) OnDeliver(msgService *MsgService, msg *Msg) {
-	// ignore, we wil only use SendAndGetReply
+	// requests use SendAndGetReply, only change notifications are delivered here
+	if msg.RepoCmd == Change && repoMsgServiceObserver.repoService != nil {
+		repoMsgServiceObserver.repoService.deliverChange(msg)
+	}
+}
+
+// Returned by StoreIf if the value has been changed since it was looked up
+var ErrConflict = errors.New("version conflict")
+
+// A value and its version, incremented every time the value is stored
+type RepoValue struct {
+	Value   string
+	Version int64
+	TTL     time.Duration // time left until the value expires, 0 if it does not
+}
+
+// A page of keys returned by ListKeys and Scan
+type RepoPage struct {
+	Keys   []string          // sorted
+	Values map[string]string `json:",omitempty"` // key:value, only set by Scan
+	Next   string            // the key to list after to get the next page, empty on the last page
 }
 
 type RepoService struct {
-	repoId           string
-	edgeNode         *EdgeNode
-	aesEncryptionKey string
-	msgService       *MsgService
-	prv              *rsa.PrivateKey
-	pub              *rsa.PublicKey
+	repoId     string
+	edgeNode   *EdgeNode
+	msgService *MsgService // its keyring encrypts the values
+	prv        *rsa.PrivateKey
+	pub        *rsa.PublicKey
+	signer     string // pem encoded pub sent with requests if we are not the owner
+	nonceLock  sync.Mutex
+	nonce      int64 // nonce of the last request
+	watchLock  sync.Mutex
+	watches    map[string]*RepoWatch // by watch id
 }
 
-func composeRepoService(aesEncryptionKey string, prv *rsa.PrivateKey, pub *rsa.PublicKey, repoId string, edgeNode *EdgeNode, msgService *MsgService) *RepoService {
+func composeRepoService(prv *rsa.PrivateKey, pub *rsa.PublicKey, repoId string, edgeNode *EdgeNode, msgService *MsgService) *RepoService {
 	service := new(RepoService)
 	service.repoId = repoId
 	service.prv = prv
 	service.pub = pub
 	service.edgeNode = edgeNode
-	service.aesEncryptionKey = aesEncryptionKey
 	service.msgService = msgService
+	service.watches = make(map[string]*RepoWatch)
 
 	return service
 }
 
 func (repoService *RepoService) Store(key string, value string, timeout int32, callback func(err error, oldValue interface{})) {
-	encryptedValue := encryptAes(repoService.aesEncryptionKey, value)
-	signature, err := sign(repoService.prv, encryptedValue)
+	encryptedValue := repoService.msgService.keyring.encrypt(value, repoValueAdditionalData(repoService.repoId, key))
+	msg := composeRepoStoreMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, encryptedValue, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
+}
+
+func (repoService *RepoService) Lookup(key string, timeout int32, callback func(err error, value interface{})) {
+	msg := composeRepoLookupMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
+}
+
+// Like Store, but the value expires after ttl, rounded up to whole seconds.
+// Expired values are no longer returned and are eventually removed by the super
+// nodes. Storing the value again, e.g. with StoreWithTTL, resets the expiry.
+func (repoService *RepoService) StoreWithTTL(key string, value string, ttl time.Duration, timeout int32, callback func(err error, oldValue interface{})) {
+	encryptedValue := repoService.msgService.keyring.encrypt(value, repoValueAdditionalData(repoService.repoId, key))
+	msg := composeRepoStoreMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, encryptedValue, repoService.nextNonce())
+	msg.RepoTTL = int64((ttl + time.Second - 1) / time.Second)
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
+}
+
+// Stores value if the current version of key is expectedVersion, i.e. if
+// no one has changed it since it was looked up with LookupVersion. Pass 0 to
+// only store the value if the key does not exist. The callback is called with
+// the new version, or with ErrConflict if the version did not match.
+func (repoService *RepoService) StoreIf(key string, value string, expectedVersion int64, timeout int32, callback func(err error, version interface{})) {
+	repoService.storeIf(key, value, expectedVersion, 0, timeout, callback)
+}
+
+// Like Lookup, but calls callback with a *RepoValue holding the value, its
+// version and the time left until it expires, or nil if key does not exist
+func (repoService *RepoService) LookupVersion(key string, timeout int32, callback func(err error, value interface{})) {
+	msg := composeRepoLookupMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReplyWithVersion(msg, timeout, true, callback)
+}
+
+// Deletes key and calls callback with the old value, or nil if key did not exist
+func (repoService *RepoService) Delete(key string, timeout int32, callback func(err error, oldValue interface{})) {
+	msg := composeRepoDeleteMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
+}
+
+// Lists the keys of the repo in sorted order and calls callback with a
+// *RepoPage of at most limit keys after the key after. Pass an empty after to
+// start from the beginning and page.Next to get the next page. A limit of 0
+// uses the default page size.
+func (repoService *RepoService) ListKeys(after string, limit int, timeout int32, callback func(err error, page interface{})) {
+	repoService.list(ListKeys, "", after, limit, timeout, callback)
+}
+
+// Like ListKeys but only lists keys starting with prefix, and also returns
+// their values in page.Values
+func (repoService *RepoService) Scan(prefix string, after string, limit int, timeout int32, callback func(err error, page interface{})) {
+	repoService.list(Scan, prefix, after, limit, timeout, callback)
+}
+
+// Grants right on the repo to the holder of the private key of pub, who can
+// then use the repo with EdgeNode.OpenRepo. Only the owner and admins may grant
+// rights, and only the owner may grant or revoke admin rights.
+func (repoService *RepoService) Grant(pub *rsa.PublicKey, right RepoRight, timeout int32, callback func(err error, data interface{})) {
+	pubPemKey, err := generatePublicPem(pub)
 	if err != nil {
-		panic(err)
+		callback(err, nil)
+		return
 	}
 
-	msg := composeRepoStoreMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNode.Id(), repoService.repoId, key, encryptedValue, signature)
+	msg := composeRepoGrantMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, pubPemKey, right, repoService.nextNonce())
+	repoService.sign(msg)
 	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
 }
 
-func (repoService *RepoService) Lookup(key string, timeout int32, callback func(err error, value interface{})) {
-	signature, err := sign(repoService.prv, key)
+// Revokes all rights of pub on the repo
+func (repoService *RepoService) Revoke(pub *rsa.PublicKey, timeout int32, callback func(err error, data interface{})) {
+	repoService.Grant(pub, RepoNone, timeout, callback)
+}
+
+// Hands the repo over to the holder of the private key of newPub, who then
+// claims it with EdgeNode.ClaimOwnership. Granted rights are kept, but this
+// service can no longer be used unless the new owner grants us rights.
+func (repoService *RepoService) TransferOwnership(newPub *rsa.PublicKey, timeout int32, callback func(err error, data interface{})) {
+	pubPemKey, err := generatePublicPem(newPub)
 	if err != nil {
-		panic(err)
+		callback(err, nil)
+		return
 	}
 
-	msg := composeRepoLookupMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNode.Id(), repoService.repoId, key, signature)
+	msg := composeRepoTransferMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, pubPemKey, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
+}
+
+// Gives up ownership so that anyone can claim the repo, and drops all granted
+// rights. If wipe is set, all keys are deleted, otherwise the next owner gets
+// the values, which it can only read with the AES key.
+func (repoService *RepoService) Release(wipe bool, timeout int32, callback func(err error, data interface{})) {
+	msg := composeRepoReleaseMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, wipe, repoService.nextNonce())
+	repoService.sign(msg)
 	repoService.msgService.sendMsgAndGetReply(msg, timeout, callback)
 }
+
+// Stores values with aesEncryptionKey from now on. Values stored with older
+// keys can still be looked up, call ReEncrypt to migrate them to the new key.
+func (repoService *RepoService) RotateKey(aesEncryptionKey string) error {
+	return repoService.msgService.keyring.rotate(aesEncryptionKey)
+}
+
+// Looks up the values of keys and stores them again with the current key, one
+// key at a time. Values keep their expiry, and values changed in between are
+// skipped since they have been stored with the current key by whoever changed
+// them. The callback is called with the number of re-encrypted values, or the
+// first error and the number of values re-encrypted until then.
+func (repoService *RepoService) ReEncrypt(keys []string, timeout int32, callback func(err error, count interface{})) {
+	go func() {
+		count := 0
+		for _, key := range keys {
+			done := make(chan error, 1)
+			repoService.LookupVersion(key, timeout, func(err error, value interface{}) {
+				if err != nil || value == nil {
+					done <- err
+					return
+				}
+
+				repoValue := value.(*RepoValue)
+				repoService.storeIf(key, repoValue.Value, repoValue.Version, repoValue.TTL, timeout, func(err error, version interface{}) {
+					if err == nil {
+						count++
+					} else if err == ErrConflict {
+						err = nil
+					}
+					done <- err
+				})
+			})
+
+			if err := <-done; err != nil {
+				callback(err, count)
+				return
+			}
+		}
+		callback(nil, count)
+	}()
+}
+
+/// PRIVATE
+
+// Returns a nonce for the next request, the current time in nanoseconds or more
+// so that it always increases
+func (repoService *RepoService) nextNonce() int64 {
+	repoService.nonceLock.Lock()
+	defer repoService.nonceLock.Unlock()
+
+	nonce := time.Now().UnixNano()
+	if nonce <= repoService.nonce {
+		nonce = repoService.nonce + 1
+	}
+	repoService.nonce = nonce
+	return nonce
+}
+
+// Stores value if the current version of key is expectedVersion, the value
+// expires after ttl unless it is 0
+func (repoService *RepoService) storeIf(key string, value string, expectedVersion int64, ttl time.Duration, timeout int32, callback func(err error, version interface{})) {
+	encryptedValue := repoService.msgService.keyring.encrypt(value, repoValueAdditionalData(repoService.repoId, key))
+	msg := composeRepoStoreIfMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, key, encryptedValue, expectedVersion, repoService.nextNonce())
+	msg.RepoTTL = int64((ttl + time.Second - 1) / time.Second)
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReplyWithVersion(msg, timeout, true, func(err error, data interface{}) {
+		if err != nil {
+			if err.Error() == ErrConflict.Error() {
+				err = ErrConflict
+			}
+			callback(err, nil)
+		} else if repoValue, ok := data.(*RepoValue); ok {
+			callback(nil, repoValue.Version)
+		} else {
+			callback(errors.New("missing version in reply"), nil)
+		}
+	})
+}
+
+func (repoService *RepoService) sign(msg *Msg) {
+	msg.RepoSigner = repoService.signer
+	signature, err := sign(repoService.prv, msg.repoSignatureData())
+	if err != nil {
+		panic(err)
+	}
+	msg.Signature = signature
+}
+
+func (repoService *RepoService) list(cmd int, prefix string, after string, limit int, timeout int32, callback func(err error, page interface{})) {
+	msg := composeRepoListMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, cmd, prefix, after, limit, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, timeout, func(err error, data interface{}) {
+		if err != nil {
+			callback(err, nil)
+			return
+		}
+
+		page := new(RepoPage)
+		if err := json.Unmarshal([]byte(data.(string)), page); err != nil {
+			callback(errors.New("invalid listing: "+err.Error()), nil)
+			return
+		}
+
+		for key, value := range page.Values {
+			if !strings.HasPrefix(key, prefix) {
+				callback(errors.New("invalid listing: unexpected key "+key), nil)
+				return
+			}
+
+			page.Values[key], err = repoService.msgService.keyring.decrypt(value, repoValueAdditionalData(repoService.repoId, key), false)
+			if err != nil {
+				callback(err, nil)
+				return
+			}
+		}
+		callback(nil, page)
+	})
+}
@@ -0,0 +1,665 @@
+package bitverse
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nonces of signed repo operations are timestamps in nanoseconds. A nonce is
+// rejected if it has been seen before, or if it is older than this window
+// compared to the newest nonce of the same signer, so that a signer whose clock
+// is ahead does not make the requests of others stale.
+const REPO_NONCE_WINDOW time.Duration = 60
+
+// passed to putIf to store regardless of the current version
+const anyVersion int64 = -1
+
+// How long tombstones of deleted keys are kept, replicas that have been away for
+// longer may bring deleted keys back
+const REPO_TOMBSTONE_TTL time.Duration = 24 * 3600
+
+type repokey_t struct {
+	repoId string
+	key    string
+}
+
+// A change of a key, reported to watchers
+type repoChangeType struct {
+	repoId string
+	key    string
+	entry  *RepoEntry // a tombstone if the key was deleted or has expired
+}
+
+// A repoRecord holds (a part of) a repo and is used when replicating or moving
+// repos between super nodes
+type repoRecord struct {
+	RepoId string
+	Owner  string                // pem encoded public key of the owner, set whenever Acl is
+	Values map[string]*RepoEntry // key:entry
+	Nonces map[string][]int64    `json:",omitempty"` // recently accepted nonces by signer
+	Acl    *RepoAcl              `json:",omitempty"`
+}
+
+// repoStoreType implements the repo operations on top of a storage backend,
+// the lock makes read-modify-write operations atomic
+type repoStoreType struct {
+	lock    sync.Mutex
+	storage Storage
+	seqs    map[string]int64 // repoid:last change sequence number, loaded on first use
+
+	// nonces of reads are only kept in memory, see useNonce
+	readNonces map[string]map[string][]int64 // repoid:signer:nonces
+}
+
+func makeRepoStore(storage Storage) *repoStoreType {
+	repoStore := new(repoStoreType)
+	repoStore.storage = storage
+	repoStore.seqs = make(map[string]int64)
+	repoStore.readNonces = make(map[string]map[string][]int64)
+	return repoStore
+}
+
+// Returns the pem encoded public key of the owner, or an empty string if the
+// repo has not been claimed
+func (repoStore *repoStoreType) owner(repoId string) (string, error) {
+	return repoStore.storage.Owner(repoId)
+}
+
+// Claims the repo unless it is already owned by someone else. If the repo has
+// been released, the new ownership is versioned with the acl, which is then
+// returned.
+func (repoStore *repoStoreType) claim(repoId string, owner string) (bool, *RepoAcl, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	current, err := repoStore.storage.Owner(repoId)
+	if err != nil {
+		return false, nil, err
+	}
+	if current != "" {
+		return current == owner, nil, nil
+	}
+
+	acl, err := repoStore.storage.Acl(repoId)
+	if err != nil {
+		return false, nil, err
+	}
+	if acl != nil {
+		if _, acl, err = applyRepoAclChange("", acl, makeRepoClaimProof(owner)); err != nil {
+			return false, nil, err
+		}
+		if err := repoStore.storage.SetAcl(repoId, acl); err != nil {
+			return false, nil, err
+		}
+	}
+	return true, acl, repoStore.storage.SetOwner(repoId, owner)
+}
+
+// Hands the repo over to the public key in the transfer request, only the
+// owner may do so. Granted rights are kept. Returns the new acl, which versions
+// the ownership.
+func (repoStore *repoStoreType) transfer(repoId string, proof *repoProofType) (*RepoAcl, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	return repoStore.changeOwner(repoId, proof)
+}
+
+// Gives up ownership so that anyone can claim the repo, only the owner may do
+// so. Granted rights are dropped, and if the release request wipes the repo all
+// values are replaced with tombstones so that replicas also drop them. Returns
+// the new acl and the tombstones.
+func (repoStore *repoStoreType) release(repoId string, proof *repoProofType) (*RepoAcl, []*repoChangeType, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	acl, err := repoStore.changeOwner(repoId, proof)
+	if err != nil || !proof.Wipe {
+		return acl, nil, err
+	}
+	tombstones, err := repoStore.wipe(repoId, proof)
+	return acl, tombstones, err
+}
+
+// Applies a transfer or release request. Ownership changes are versioned with
+// the acl, which is returned. The caller must hold the lock.
+func (repoStore *repoStoreType) changeOwner(repoId string, proof *repoProofType) (*RepoAcl, error) {
+	owner, err := repoStore.storage.Owner(repoId)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := repoStore.storage.Acl(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	newOwner, acl, err := applyRepoAclChange(owner, acl, proof)
+	if err != nil {
+		return nil, err
+	}
+	if err := repoStore.storage.SetAcl(repoId, acl); err != nil {
+		return nil, err
+	}
+	return acl, repoStore.storage.SetOwner(repoId, newOwner)
+}
+
+// Replaces all values of the repo with tombstones written by the release
+// request and returns them, the caller must hold the lock
+func (repoStore *repoStoreType) wipe(repoId string, proof *repoProofType) ([]*repoChangeType, error) {
+	keys, err := repoStore.storage.Keys(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*repoChangeType
+	for _, key := range keys {
+		entry, err := repoStore.storage.Get(repoId, key)
+		if err != nil {
+			return changes, err
+		}
+		if entry == nil || entry.Deleted {
+			continue
+		}
+
+		tombstone, err := repoStore.tombstone(repoId, entry, proof)
+		if err != nil {
+			return changes, err
+		}
+		if err := repoStore.storage.Put(repoId, key, tombstone); err != nil {
+			return changes, err
+		}
+		changes = append(changes, &repoChangeType{repoId, key, tombstone})
+	}
+	return changes, nil
+}
+
+// Returns the pem encoded public key that signs requests needing right, the
+// owner if signer is empty. Fails unless signer is the owner or has been
+// granted right.
+func (repoStore *repoStoreType) authorize(repoId string, signer string, right RepoRight) (string, error) {
+	owner, err := repoStore.storage.Owner(repoId)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" {
+		return "", errors.New("no such repo " + repoId)
+	}
+	if signer == "" || signer == owner {
+		return owner, nil
+	}
+
+	acl, err := repoStore.storage.Acl(repoId)
+	if err != nil {
+		return "", err
+	}
+	if acl == nil || acl.Grants[signer] < right {
+		return "", errors.New("access to repo <" + repoId + "> denied")
+	}
+	return signer, nil
+}
+
+// Applies a grant request, RepoNone revokes the rights of the grantee. Only
+// the owner may change the rights of admins. Returns the new acl.
+func (repoStore *repoStoreType) grant(repoId string, proof *repoProofType) (*RepoAcl, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	owner, err := repoStore.storage.Owner(repoId)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := repoStore.storage.Acl(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, acl, err = applyRepoAclChange(owner, acl, proof); err != nil {
+		return nil, err
+	}
+	return acl, repoStore.storage.SetAcl(repoId, acl)
+}
+
+// Accepts the nonce of a signed operation by signer unless it is stale or a
+// replay. Returns the nonces to replicate, nil for reads. Nonces of reads are
+// neither stored nor replicated, so a read is only protected against replays
+// on this super node while it is running. A read replayed after a restart, or
+// to a replica, only returns what the signer was allowed to read anyway.
+func (repoStore *repoStoreType) useNonce(repoId string, signer string, nonce int64, read bool) (map[string][]int64, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	var nonces map[string][]int64
+	if read {
+		nonces = repoStore.readNonces[repoId]
+		if nonces == nil {
+			nonces = make(map[string][]int64)
+			repoStore.readNonces[repoId] = nonces
+		}
+	} else {
+		var err error
+		if nonces, err = repoStore.storage.Nonces(repoId); err != nil {
+			return nil, err
+		}
+	}
+
+	used := nonces[signer]
+	if len(used) > 0 && nonce <= used[len(used)-1]-int64(time.Second*REPO_NONCE_WINDOW) {
+		return nil, errors.New("stale nonce")
+	}
+	for _, usedNonce := range used {
+		if usedNonce == nonce {
+			return nil, errors.New("duplicate nonce")
+		}
+	}
+
+	nonces[signer] = pruneNonces(append(used, nonce))
+	if read {
+		return nil, nil
+	}
+	return nonces, repoStore.storage.SetNonces(repoId, nonces)
+}
+
+// Returns nil if the key does not exist or has been deleted
+func (repoStore *repoStoreType) get(repoId string, key string) (*RepoEntry, error) {
+	entry, err := repoStore.storage.Get(repoId, key)
+	if err != nil || entry == nil || entry.Deleted || entry.expired() {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Stores the value written by the request and returns the old and the new entry
+func (repoStore *repoStoreType) put(repoId string, key string, value string, proof *repoProofType) (*RepoEntry, *RepoEntry, error) {
+	return repoStore.putIf(repoId, key, value, anyVersion, 0, proof)
+}
+
+// Like put, but fails with ErrConflict and the current entry unless the
+// version of the current value is expectedVersion. A key that does not exist
+// has version 0. If ttl is set, the value expires after ttl seconds.
+func (repoStore *repoStoreType) putIf(repoId string, key string, value string, expectedVersion int64, ttl int64, proof *repoProofType) (*RepoEntry, *RepoEntry, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	oldEntry, err := repoStore.storage.Get(repoId, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if expectedVersion != anyVersion {
+		if oldEntry == nil || oldEntry.Deleted || oldEntry.expired() {
+			if expectedVersion != 0 {
+				return nil, nil, ErrConflict
+			}
+		} else if oldEntry.Version != expectedVersion {
+			return oldEntry, nil, ErrConflict
+		}
+	}
+
+	seq, err := repoStore.nextSeq(repoId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	newEntry := &RepoEntry{Value: value, Version: 1, Seq: seq, Proof: proof}
+	if ttl > 0 {
+		newEntry.Expires = time.Now().Unix() + ttl
+	}
+	if oldEntry != nil {
+		newEntry.Version = oldEntry.Version + 1
+		if oldEntry.Deleted || oldEntry.expired() {
+			oldEntry = nil
+		}
+	}
+
+	if err := repoStore.storage.Put(repoId, key, newEntry); err != nil {
+		return nil, nil, err
+	}
+	return oldEntry, newEntry, nil
+}
+
+// Replaces the value with a tombstone written by the request and returns the
+// old entry and the tombstone, or nil if the key does not exist
+func (repoStore *repoStoreType) delete(repoId string, key string, proof *repoProofType) (*RepoEntry, *RepoEntry, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	oldEntry, err := repoStore.storage.Get(repoId, key)
+	if err != nil || oldEntry == nil || oldEntry.Deleted || oldEntry.expired() {
+		return nil, nil, err
+	}
+
+	tombstone, err := repoStore.tombstone(repoId, oldEntry, proof)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := repoStore.storage.Put(repoId, key, tombstone); err != nil {
+		return nil, nil, err
+	}
+	return oldEntry, tombstone, nil
+}
+
+// Returns the changes of keys starting with prefix after the change sequence
+// number since, ordered by their sequence numbers, and the current sequence
+// number of the repo. Deleted and expired keys are reported as tombstones.
+func (repoStore *repoStoreType) changes(repoId string, prefix string, since int64) (int64, []*repoChangeType, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	seq, err := repoStore.lastSeq(repoId)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	keys, err := repoStore.storage.Keys(repoId)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	changes := []*repoChangeType{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry, err := repoStore.storage.Get(repoId, key)
+		if err != nil {
+			return 0, nil, err
+		}
+		if entry == nil || entry.Seq <= since {
+			continue
+		}
+		if !entry.Deleted && entry.expired() {
+			entry = &RepoEntry{Version: entry.Version, Deleted: true, Seq: entry.Seq}
+		}
+		changes = append(changes, &repoChangeType{repoId, key, entry})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].entry.Seq < changes[j].entry.Seq })
+	return seq, changes, nil
+}
+
+// Returns up to limit keys starting with prefix that sort after after, with
+// their entries. next is the last returned key if there are more keys.
+func (repoStore *repoStoreType) scan(repoId string, prefix string, after string, limit int) ([]string, map[string]*RepoEntry, string, error) {
+	allKeys, err := repoStore.storage.Keys(repoId)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	keys := []string{}
+	entries := make(map[string]*RepoEntry)
+	for _, key := range allKeys {
+		if key <= after || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		entry, err := repoStore.get(repoId, key)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if entry == nil {
+			continue
+		}
+
+		if len(keys) == limit {
+			return keys, entries, keys[len(keys)-1], nil
+		}
+		keys = append(keys, key)
+		entries[key] = entry
+	}
+	return keys, entries, "", nil
+}
+
+func (repoStore *repoStoreType) repoIds() ([]string, error) {
+	return repoStore.storage.RepoIds()
+}
+
+// Returns a copy of the whole repo
+func (repoStore *repoStoreType) record(repoId string) (*repoRecord, error) {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	record := new(repoRecord)
+	record.RepoId = repoId
+	record.Values = make(map[string]*RepoEntry)
+
+	var err error
+	record.Owner, err = repoStore.storage.Owner(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Nonces, err = repoStore.storage.Nonces(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Acl, err = repoStore.storage.Acl(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := repoStore.storage.Keys(repoId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		entry, err := repoStore.storage.Get(repoId, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			record.Values[key] = entry
+		}
+	}
+	return record, nil
+}
+
+// Merges a record received from another super node, entries and acls with a
+// higher version win. Acl changes and entries that are not signed by the owner
+// or a public key with the right to make them are ignored, see repo_proof.go.
+func (repoStore *repoStoreType) merge(record *repoRecord) error {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	owner, err := repoStore.storage.Owner(record.RepoId)
+	if err != nil {
+		return err
+	}
+	acl, err := repoStore.storage.Acl(record.RepoId)
+	if err != nil {
+		return err
+	}
+
+	if record.Acl != nil && (acl == nil || acl.Version < record.Acl.Version) {
+		// a newer acl also brings the owner, which may have been transferred or released
+		newOwner, newAcl := record.Owner, record.Acl
+		if owner != "" || acl != nil {
+			newOwner, newAcl, err = replayRepoAcl(record.RepoId, owner, acl, record.Acl)
+		}
+		if err != nil {
+			info("supernode: ignoring acl of repo <" + record.RepoId + "> from replica: " + err.Error())
+		} else {
+			if err := repoStore.storage.SetAcl(record.RepoId, newAcl); err != nil {
+				return err
+			}
+			if err := repoStore.storage.SetOwner(record.RepoId, newOwner); err != nil {
+				return err
+			}
+			owner, acl = newOwner, newAcl
+		}
+	} else if record.Owner != "" && owner == "" && acl == nil {
+		// without acls on either side the repo has never changed hands
+		if err := repoStore.storage.SetOwner(record.RepoId, record.Owner); err != nil {
+			return err
+		}
+		owner = record.Owner
+	}
+
+	if len(record.Nonces) > 0 {
+		nonces, err := repoStore.storage.Nonces(record.RepoId)
+		if err != nil {
+			return err
+		}
+
+		// nonces are not signed, one from the future would make all requests of the signer stale
+		newest := time.Now().Add(time.Second * REPO_NONCE_WINDOW).UnixNano()
+		for signer, signerNonces := range record.Nonces {
+			for _, nonce := range signerNonces {
+				if nonce <= newest {
+					nonces[signer] = append(nonces[signer], nonce)
+				}
+			}
+			nonces[signer] = pruneNonces(nonces[signer])
+		}
+		if err := repoStore.storage.SetNonces(record.RepoId, nonces); err != nil {
+			return err
+		}
+	}
+
+	for key, entry := range record.Values {
+		current, err := repoStore.storage.Get(record.RepoId, key)
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Version >= entry.Version {
+			continue
+		}
+		if err := verifyRepoEntry(record.RepoId, key, entry, owner, acl); err != nil {
+			info("supernode: ignoring key <" + key + "> of repo <" + record.RepoId + "> from replica: " + err.Error())
+			continue
+		}
+
+		if err := repoStore.storage.Put(record.RepoId, key, entry); err != nil {
+			return err
+		}
+		if seq, ok := repoStore.seqs[record.RepoId]; ok && entry.Seq > seq {
+			repoStore.seqs[record.RepoId] = entry.Seq
+		}
+	}
+	return nil
+}
+
+// Replaces expired entries with tombstones, so that watchers learn about the
+// expiry, and removes old tombstones from all repos. Returns the expired
+// entries and the number of swept entries.
+func (repoStore *repoStoreType) sweep() ([]*repoChangeType, int, error) {
+	repoIds, err := repoStore.storage.RepoIds()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var changes []*repoChangeType
+	swept := 0
+	for _, repoId := range repoIds {
+		keys, err := repoStore.storage.Keys(repoId)
+		if err != nil {
+			return changes, swept, err
+		}
+
+		for _, key := range keys {
+			// lock per key so that requests are not blocked during the whole sweep
+			repoStore.lock.Lock()
+			entry, err := repoStore.storage.Get(repoId, key)
+			if err == nil && entry != nil && entry.expired() {
+				if entry.Deleted {
+					err = repoStore.storage.Delete(repoId, key)
+				} else if entry, err = repoStore.tombstone(repoId, entry, entry.Proof); err == nil {
+					err = repoStore.storage.Put(repoId, key, entry)
+					changes = append(changes, &repoChangeType{repoId, key, entry})
+				}
+				swept++
+			}
+			repoStore.lock.Unlock()
+			if err != nil {
+				return changes, swept, err
+			}
+		}
+	}
+	return changes, swept, nil
+}
+
+// Removes the repo, called when another super node has become responsible for it
+func (repoStore *repoStoreType) drop(repoId string) error {
+	repoStore.lock.Lock()
+	defer repoStore.lock.Unlock()
+
+	delete(repoStore.seqs, repoId)
+	delete(repoStore.readNonces, repoId)
+	return repoStore.storage.DropRepo(repoId)
+}
+
+// Returns a tombstone replacing entry, written by the request that deleted it or
+// by the one that stored the entry if it has expired. The caller must hold the
+// lock.
+func (repoStore *repoStoreType) tombstone(repoId string, entry *RepoEntry, proof *repoProofType) (*RepoEntry, error) {
+	seq, err := repoStore.nextSeq(repoId)
+	if err != nil {
+		return nil, err
+	}
+	return &RepoEntry{Version: entry.Version + 1, Deleted: true, Expires: time.Now().Add(time.Second * REPO_TOMBSTONE_TTL).Unix(), Seq: seq, Proof: proof}, nil
+}
+
+// Returns the sequence number of the next change of the repo, the current time
+// in nanoseconds or more so that it always increases, also across super nodes
+// taking over the repo. The caller must hold the lock.
+func (repoStore *repoStoreType) nextSeq(repoId string) (int64, error) {
+	seq, err := repoStore.lastSeq(repoId)
+	if err != nil {
+		return 0, err
+	}
+
+	next := time.Now().UnixNano()
+	if next <= seq {
+		next = seq + 1
+	}
+	repoStore.seqs[repoId] = next
+	return next, nil
+}
+
+// Returns the sequence number of the last change of the repo, the caller must
+// hold the lock
+func (repoStore *repoStoreType) lastSeq(repoId string) (int64, error) {
+	if seq, ok := repoStore.seqs[repoId]; ok {
+		return seq, nil
+	}
+
+	keys, err := repoStore.storage.Keys(repoId)
+	if err != nil {
+		return 0, err
+	}
+
+	seq := int64(0)
+	for _, key := range keys {
+		entry, err := repoStore.storage.Get(repoId, key)
+		if err != nil {
+			return 0, err
+		}
+		if entry != nil && entry.Seq > seq {
+			seq = entry.Seq
+		}
+	}
+	repoStore.seqs[repoId] = seq
+	return seq, nil
+}
+
+// Sorts nonces, removes duplicates and drops the ones outside the window
+func pruneNonces(nonces []int64) []int64 {
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	if len(nonces) == 0 {
+		return nonces
+	}
+
+	oldest := nonces[len(nonces)-1] - int64(time.Second*REPO_NONCE_WINDOW)
+	pruned := nonces[:0]
+	for _, nonce := range nonces {
+		if nonce > oldest && (len(pruned) == 0 || nonce != pruned[len(pruned)-1]) {
+			pruned = append(pruned, nonce)
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,364 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Edge nodes watching a repo subscribe at the super node responsible for it.
+// Subscriptions are leases that the edge node renews, so they move along when
+// another super node takes over the repo. Every write gets a sequence number
+// in the change sequence of the repo, the resume token of a watch is the
+// sequence number of the last change it has seen. Changes missed while the
+// edge node was disconnected are sent again when it renews the subscription
+// with its token, so changes are delivered at least once.
+const WATCH_LEASE time.Duration = 60
+const WATCH_RENEW_RATE time.Duration = WATCH_LEASE / 3
+
+// change notifications held per watch until the subscription reply tells which
+// super node sends them
+const WATCH_MAX_HELD = 100
+
+// A change of a watched key
+type RepoChange struct {
+	Key     string
+	Value   string // empty if the key was deleted
+	Version int64
+	Deleted bool // set if the key was deleted or has expired
+}
+
+// RepoWatch is a subscription to changes of the keys starting with a prefix,
+// see RepoService.Watch
+type RepoWatch struct {
+	id          string
+	prefix      string
+	repoService *RepoService
+	callback    func(err error, change *RepoChange)
+	lock        sync.Mutex
+	token       int64  // sequence number of the last change seen, 0 until the first subscription succeeds
+	superNodeId string // the super node serving the subscription, only its change notifications are accepted
+	held        []*Msg // notifications from other super nodes, until the next subscription reply
+	done        chan bool
+}
+
+// Sent as the reply to a watch request
+type repoWatchReplyType struct {
+	Seq         int64  // the current change sequence number of the repo
+	SuperNodeId string // the super node that sends the change notifications
+}
+
+type watchType struct {
+	nodeId  string
+	repoId  string
+	prefix  string
+	watchId string
+	signer  string // pem encoded public key that signed the subscription
+	expires time.Time
+}
+
+// watchesType holds the subscriptions to the repos we are responsible for
+type watchesType struct {
+	lock    sync.Mutex
+	watches map[string]*watchType // edge node id:watch id:watch
+}
+
+func makeWatches() *watchesType {
+	watches := new(watchesType)
+	watches.watches = make(map[string]*watchType)
+	return watches
+}
+
+// Calls callback with every change of a key starting with prefix. Changes of
+// the same key may arrive out of order or more than once, compare versions to
+// find the latest. resumeToken is the Token of an earlier watch, to also get
+// the changes since then, or an empty string to only get new changes.
+// Subscription errors are passed to callback, the watch keeps retrying until
+// it is stopped.
+func (repoService *RepoService) Watch(prefix string, resumeToken string, callback func(err error, change *RepoChange)) (*RepoWatch, error) {
+	watch := new(RepoWatch)
+	watch.id = fmt.Sprintf("%d", getSeqNr())
+	watch.prefix = prefix
+	watch.repoService = repoService
+	watch.callback = callback
+	watch.done = make(chan bool)
+
+	if resumeToken != "" {
+		token, err := strconv.ParseInt(resumeToken, 10, 64)
+		if err != nil || token <= 0 {
+			return nil, errors.New("invalid resume token " + resumeToken)
+		}
+		watch.token = token
+	}
+
+	repoService.watchLock.Lock()
+	repoService.watches[watch.id] = watch
+	repoService.watchLock.Unlock()
+
+	watch.subscribe()
+	go func() {
+		ticker := time.NewTicker(time.Second * WATCH_RENEW_RATE)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				watch.subscribe()
+			case <-watch.done:
+				return
+			}
+		}
+	}()
+
+	return watch, nil
+}
+
+// Returns the token to resume watching after the last change seen
+func (watch *RepoWatch) Token() string {
+	watch.lock.Lock()
+	defer watch.lock.Unlock()
+
+	if watch.token == 0 {
+		return ""
+	}
+	return strconv.FormatInt(watch.token, 10)
+}
+
+// Stops the watch, the subscription expires on the super node after the lease
+func (watch *RepoWatch) Stop() {
+	repoService := watch.repoService
+	repoService.watchLock.Lock()
+	defer repoService.watchLock.Unlock()
+
+	if repoService.watches[watch.id] == watch {
+		delete(repoService.watches, watch.id)
+		close(watch.done)
+	}
+}
+
+/// PRIVATE
+
+// Subscribes or renews the subscription, asking for the changes since the token
+func (watch *RepoWatch) subscribe() {
+	watch.lock.Lock()
+	since := watch.token
+	watch.lock.Unlock()
+
+	repoService := watch.repoService
+	msg := composeRepoWatchMsg(repoService.edgeNode.Id(), repoService.edgeNode.superNodeId(), repoService.repoId, watch.id, watch.prefix, since, repoService.nextNonce())
+	repoService.sign(msg)
+	repoService.msgService.sendMsgAndGetReply(msg, int32(WATCH_RENEW_RATE), func(err error, data interface{}) {
+		if watch.stopped() {
+			return
+		}
+		if err != nil {
+			watch.callback(err, nil)
+			return
+		}
+
+		reply := new(repoWatchReplyType)
+		if err := json.Unmarshal([]byte(data.(string)), reply); err != nil {
+			watch.callback(errors.New("invalid watch reply: "+err.Error()), nil)
+			return
+		}
+		watch.subscribed(reply)
+	})
+}
+
+// Called with the reply to a subscription, delivers the notifications held
+// from the super node serving it and drops the others
+func (watch *RepoWatch) subscribed(reply *repoWatchReplyType) {
+	watch.lock.Lock()
+	// a new watch starts at the current change of the repo
+	if watch.token == 0 {
+		watch.token = reply.Seq
+	}
+	watch.superNodeId = reply.SuperNodeId
+	held := watch.held
+	watch.held = nil
+	watch.lock.Unlock()
+
+	for _, msg := range held {
+		if msg.Src == reply.SuperNodeId {
+			watch.deliver(msg)
+		} else {
+			debug("edgenode: dropping change of key <" + msg.RepoKey + "> from " + msg.Src + ", not serving the watch")
+		}
+	}
+}
+
+func (watch *RepoWatch) stopped() bool {
+	select {
+	case <-watch.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Passes a change notification to its watch, called from the main loop of the
+// edge node with the value already decrypted
+func (repoService *RepoService) deliverChange(msg *Msg) {
+	repoService.watchLock.Lock()
+	watch := repoService.watches[msg.RepoWatchId]
+	repoService.watchLock.Unlock()
+
+	if watch == nil {
+		debug("edgenode: ignoring change of key <" + msg.RepoKey + ">, no such watch " + msg.RepoWatchId)
+		return
+	}
+	if !strings.HasPrefix(msg.RepoKey, watch.prefix) {
+		info("edgenode: ignoring change of key <" + msg.RepoKey + ">, not watched by " + msg.RepoWatchId)
+		return
+	}
+	watch.deliver(msg)
+}
+
+// Passes a change notification to the callback if it has been sent by the
+// super node serving the subscription. Notifications from other super nodes
+// are held until the next subscription reply, as the notifications missed
+// since the token may arrive before it.
+func (watch *RepoWatch) deliver(msg *Msg) {
+	watch.lock.Lock()
+	if msg.Src != watch.superNodeId {
+		if len(watch.held) < WATCH_MAX_HELD {
+			watch.held = append(watch.held, msg)
+		} else {
+			debug("edgenode: ignoring change of key <" + msg.RepoKey + "> from " + msg.Src + ", too many changes held")
+		}
+		watch.lock.Unlock()
+		return
+	}
+	if msg.RepoSeq > watch.token {
+		watch.token = msg.RepoSeq
+	}
+	watch.lock.Unlock()
+
+	change := &RepoChange{Key: msg.RepoKey, Version: msg.RepoVersion, Deleted: msg.PayloadType == Nil}
+	if !change.Deleted {
+		change.Value = msg.Payload
+	}
+	watch.callback(nil, change)
+}
+
+// Adds the watch, or renews its lease
+func (watches *watchesType) add(watch *watchType) {
+	watches.lock.Lock()
+	defer watches.lock.Unlock()
+
+	watch.expires = time.Now().Add(time.Second * WATCH_LEASE)
+	watches.watches[watch.nodeId+":"+watch.watchId] = watch
+}
+
+// Returns the watches of the key
+func (watches *watchesType) matching(repoId string, key string) []*watchType {
+	watches.lock.Lock()
+	defer watches.lock.Unlock()
+
+	var matching []*watchType
+	for _, watch := range watches.watches {
+		if watch.repoId == repoId && strings.HasPrefix(key, watch.prefix) {
+			matching = append(matching, watch)
+		}
+	}
+	return matching
+}
+
+func (watches *watchesType) expire() {
+	watches.lock.Lock()
+	defer watches.lock.Unlock()
+
+	now := time.Now()
+	for id, watch := range watches.watches {
+		if now.After(watch.expires) {
+			delete(watches.watches, id)
+		}
+	}
+}
+
+// Notifies the watchers of changes
+func (superNode *SuperNode) notifyWatchers(changes []*repoChangeType) {
+	var msgs []*Msg
+	for _, change := range changes {
+		for _, watch := range superNode.watches.matching(change.repoId, change.key) {
+			if _, err := superNode.repoStore.authorize(watch.repoId, watch.signer, RepoRead); err != nil {
+				continue // the right has been revoked since the watch was renewed
+			}
+			msgs = append(msgs, composeRepoChangeMsg(superNode.Id(), watch.nodeId, change.repoId, watch.watchId, change.key, change.entry))
+		}
+	}
+	superNode.sendChanges(msgs)
+}
+
+// Sends change notifications in the background, in order
+func (superNode *SuperNode) sendChanges(msgs []*Msg) {
+	if len(msgs) > 0 {
+		go func() {
+			for _, msg := range msgs {
+				superNode.sendChange(*msg)
+			}
+		}()
+	}
+}
+
+// Passes a change notification from another super node on to the child
+// watching, if the super node is responsible for the repo. Runs in a separate
+// go routine.
+func (superNode *SuperNode) relayChange(msg Msg) {
+	if msg.link.address == "" || msg.Src != msg.link.Id() || msg.Origin != msg.link.address {
+		info("supernode: dropping change notification from " + msg.Src + " relayed by " + msg.link.Id())
+		return
+	}
+
+	addresses, err := superNode.lookup(msg.RepoId, REPO_REPLICAS+1)
+	responsible := false
+	for _, address := range addresses {
+		if address == msg.Origin {
+			responsible = true
+		}
+	}
+	if err != nil || !responsible {
+		info("supernode: dropping change notification from " + msg.Src + ", not responsible for repo <" + msg.RepoId + ">")
+		return
+	}
+
+	superNode.childrenLock.RLock()
+	remoteNode := superNode.children[msg.Dst]
+	superNode.childrenLock.RUnlock()
+	if remoteNode == nil {
+		debug("supernode: dropping change notification from " + msg.Src + " to " + msg.Dst)
+		return
+	}
+	remoteNode.deliver(&msg)
+}
+
+// Delivers a change notification to a child, or to the super node it is
+// connected to. Unlike messages, notifications are dropped if the watcher is
+// not connected, it gets them when it renews its subscription.
+func (superNode *SuperNode) sendChange(msg Msg) {
+	superNode.childrenLock.RLock()
+	remoteNode := superNode.children[msg.Dst]
+	superNode.childrenLock.RUnlock()
+	if remoteNode != nil {
+		remoteNode.deliver(&msg)
+		return
+	}
+
+	address, err := superNode.locate(msg.Dst)
+	if err != nil || address == superNode.address {
+		debug("supernode: dropping change notification, failed to locate " + msg.Dst)
+		return
+	}
+
+	remoteNode, err = superNode.rpc.link(address)
+	if err != nil {
+		debug("supernode: dropping change notification to " + msg.Dst + ": " + err.Error())
+		superNode.locations.remove(msg.Dst)
+		return
+	}
+	msg.Origin = superNode.address
+	remoteNode.deliver(&msg)
+}
@@ -0,0 +1,115 @@
+package bitverse
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const LOCATION_CACHE_TTL time.Duration = 10
+
+type locationType struct {
+	address   string
+	timestamp int64
+}
+
+// locationCacheType remembers which super node (address) edge nodes on
+// foreign super nodes are connected to
+type locationCacheType struct {
+	lock      sync.Mutex
+	locations map[string]*locationType // edge node id:location
+}
+
+func makeLocationCache() *locationCacheType {
+	locationCache := new(locationCacheType)
+	locationCache.locations = make(map[string]*locationType)
+	return locationCache
+}
+
+func (locationCache *locationCacheType) add(nodeId string, address string) {
+	locationCache.lock.Lock()
+	defer locationCache.lock.Unlock()
+
+	location := new(locationType)
+	location.address = address
+	location.timestamp = time.Now().Unix()
+	locationCache.locations[nodeId] = location
+}
+
+func (locationCache *locationCacheType) get(nodeId string) string {
+	locationCache.lock.Lock()
+	defer locationCache.lock.Unlock()
+
+	location := locationCache.locations[nodeId]
+	if location == nil {
+		return ""
+	}
+
+	if time.Now().Unix()-location.timestamp > int64(LOCATION_CACHE_TTL) {
+		delete(locationCache.locations, nodeId)
+		return ""
+	}
+	return location.address
+}
+
+func (locationCache *locationCacheType) remove(nodeId string) {
+	locationCache.lock.Lock()
+	delete(locationCache.locations, nodeId)
+	locationCache.lock.Unlock()
+}
+
+/// PRIVATE
+
+// Forwards a message to the super node hosting msg.Dst, the receiving super
+// node will only deliver it to its own children so that the message is at most
+// three hops away from its destination. If msg.Dst is not connected to any
+// super node, the message is queued in its mailbox. Runs in a separate go routine.
+func (superNode *SuperNode) forward(msg Msg) {
+	address, err := superNode.locate(msg.Dst)
+	if err != nil {
+		debug("supernode: failed to locate " + msg.Dst + ": " + err.Error())
+		superNode.depositMail(msg)
+		return
+	}
+	if address == superNode.address {
+		debug("supernode: stale location record for " + msg.Dst)
+		superNode.locations.remove(msg.Dst)
+		superNode.depositMail(msg)
+		return
+	}
+
+	remoteNode, err := superNode.rpc.link(address)
+	if err != nil {
+		debug("supernode: failed to forward message to " + address + ": " + err.Error())
+		superNode.locations.remove(msg.Dst)
+		superNode.depositMail(msg)
+		return
+	}
+
+	debug("supernode: forwarding " + msg.String() + " to super node at " + address)
+	msg.Origin = superNode.address
+	if err := remoteNode.deliver(&msg); err != nil {
+		debug("supernode: failed to forward message to " + address + ": " + err.Error())
+		superNode.locations.remove(msg.Dst)
+		superNode.depositMail(msg)
+	}
+}
+
+// Returns the address of the super node the edge node is connected to
+func (superNode *SuperNode) locate(nodeId string) (string, error) {
+	address := superNode.locations.get(nodeId)
+	if address != "" {
+		return address, nil
+	}
+
+	record, err := superNode.lookupLocation(nodeId)
+	if err != nil {
+		return "", err
+	}
+	if record == nil {
+		return "", errors.New("no super node is hosting " + nodeId)
+	}
+
+	superNode.locations.add(nodeId, record.Address)
+	return record.Address, nil
+}
@@ -0,0 +1,294 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+const RPC_TIMEOUT time.Duration = 5
+
+// rpcType implements request/reply calls between super nodes. Links to other
+// super nodes are set up on demand and identified by the address the remote
+// super node is listening on. Only links we have dialed are used for calls, so
+// the node at the other end is known to be listening at the address.
+type rpcType struct {
+	superNode *SuperNode
+	lock      sync.Mutex
+	links     map[string]*RemoteNode // address:link we have dialed
+	dialLocks map[string]*sync.Mutex
+	pending   map[string]*rpcCallType // msg id:call
+	handlers  map[string]func(caller rpcCallerType, args []byte) (interface{}, error)
+}
+
+// The super node calling an rpc method, authenticated by the link the call came
+// on, see serve
+type rpcCallerType struct {
+	nodeId  string
+	address string
+}
+
+// A call waiting for its reply
+type rpcCallType struct {
+	nodeId       string // id of the called super node, as known by the link
+	replyChannel chan Msg
+}
+
+func makeRpc(superNode *SuperNode) *rpcType {
+	rpc := new(rpcType)
+	rpc.superNode = superNode
+	rpc.links = make(map[string]*RemoteNode)
+	rpc.dialLocks = make(map[string]*sync.Mutex)
+	rpc.pending = make(map[string]*rpcCallType)
+	rpc.handlers = make(map[string]func(caller rpcCallerType, args []byte) (interface{}, error))
+
+	return rpc
+}
+
+// Registers a function that will be called when receiving calls to method
+func (rpc *rpcType) handle(method string, handler func(caller rpcCallerType, args []byte) (interface{}, error)) {
+	rpc.lock.Lock()
+	rpc.handlers[method] = handler
+	rpc.lock.Unlock()
+}
+
+// Calls method on the super node at address, the reply is json decoded into
+// reply unless it is nil. Must never be called from the super node main loop
+// since the reply is delivered by it.
+func (rpc *rpcType) call(address string, method string, args interface{}, reply interface{}) error {
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	var replyJson []byte
+	if address == rpc.superNode.address {
+		// no need to go through the network to call ourselves
+		replyJson, err = rpc.invoke(method, rpcCallerType{rpc.superNode.Id(), rpc.superNode.address}, argsJson)
+		if err != nil {
+			return err
+		}
+	} else {
+		remoteNode, err := rpc.link(address)
+		if err != nil {
+			return err
+		}
+
+		msg := composeRpcMsg(rpc.superNode.Id(), rpc.superNode.address, method, string(argsJson))
+		msg.Dst = remoteNode.Id()
+
+		replyChannel := make(chan Msg, 1)
+		rpc.lock.Lock()
+		rpc.pending[msg.Id] = &rpcCallType{remoteNode.Id(), replyChannel}
+		rpc.lock.Unlock()
+
+		defer func() {
+			rpc.lock.Lock()
+			delete(rpc.pending, msg.Id)
+			rpc.lock.Unlock()
+		}()
+
+		remoteNode.deliver(msg)
+
+		select {
+		case replyMsg := <-replyChannel:
+			if replyMsg.Status == Error {
+				return errors.New(replyMsg.Payload)
+			}
+			replyJson = []byte(replyMsg.Payload)
+		case <-time.After(time.Second * RPC_TIMEOUT):
+			return errors.New("rpc: " + method + " call to " + address + " timed out")
+		}
+	}
+
+	if reply != nil {
+		return json.Unmarshal(replyJson, reply)
+	}
+	return nil
+}
+
+// Called in a separate go routine when receiving an rpc message on a link from
+// a super node, calls are never relayed so the caller must be at the other end
+func (rpc *rpcType) serve(msg Msg) {
+	if msg.Src != msg.link.Id() || msg.Origin != msg.link.address {
+		info("rpc: dropping " + msg.RpcMethod + " call from " + msg.Src + " relayed by " + msg.link.Id())
+		return
+	}
+
+	var reply *Msg
+	replyJson, err := rpc.invoke(msg.RpcMethod, rpcCallerType{msg.Src, msg.Origin}, []byte(msg.Payload))
+	if err != nil {
+		reply = composeRpcReplyMsg(&msg, rpc.superNode.Id(), rpc.superNode.address, err.Error(), Error)
+	} else {
+		reply = composeRpcReplyMsg(&msg, rpc.superNode.Id(), rpc.superNode.address, string(replyJson), Ok)
+	}
+
+	remoteNode, err := rpc.link(msg.Origin)
+	if err != nil {
+		info("rpc: failed to send reply to " + msg.Origin + ": " + err.Error())
+		return
+	}
+	remoteNode.deliver(reply)
+}
+
+// Called when receiving an rpc reply message on a link from a super node, only
+// the called super node may reply
+func (rpc *rpcType) deliverReply(msg Msg) {
+	rpc.lock.Lock()
+	call := rpc.pending[msg.Id]
+	rpc.lock.Unlock()
+
+	if call == nil {
+		debug("rpc: ignoring reply to unknown call " + msg.Id)
+		return
+	}
+	if msg.Src != msg.link.Id() || dialedNodeId(msg.Src) != call.nodeId {
+		info("rpc: dropping reply to " + msg.Id + " from " + msg.Src + ", not the called super node")
+		return
+	}
+
+	select {
+	case call.replyChannel <- msg:
+	default: // already got a reply
+	}
+}
+
+func (rpc *rpcType) addLink(address string, remoteNode *RemoteNode) {
+	rpc.lock.Lock()
+	rpc.links[address] = remoteNode
+	rpc.lock.Unlock()
+}
+
+// Returns true if remoteNode is a link to or from a super node, i.e. the node
+// at the other end is the node we reach when connecting to the address it
+// advertises. The handshake only proves the node id, anyone may advertise an
+// address.
+func (rpc *rpcType) authenticated(remoteNode *RemoteNode) bool {
+	if remoteNode.address == "" {
+		return false
+	}
+
+	rpc.lock.Lock()
+	link := rpc.links[remoteNode.address]
+	rpc.lock.Unlock()
+	return link != nil && link.getState() == Alive && (link == remoteNode || link.Id() == dialedNodeId(remoteNode.Id()))
+}
+
+// Connects to the address advertised by the node at the other end of
+// remoteNode, after which the link is authenticated if the same node answers
+func (rpc *rpcType) verify(remoteNode *RemoteNode) error {
+	link, err := rpc.link(remoteNode.address)
+	if err != nil {
+		return err
+	}
+	if link.Id() != dialedNodeId(remoteNode.Id()) {
+		return errors.New("rpc: " + remoteNode.Id() + " is not the super node at " + remoteNode.address)
+	}
+	return nil
+}
+
+func (rpc *rpcType) removeLink(remoteNode *RemoteNode) {
+	rpc.lock.Lock()
+	for address, link := range rpc.links {
+		if link == remoteNode {
+			delete(rpc.links, address)
+		}
+	}
+	rpc.lock.Unlock()
+}
+
+/// PRIVATE
+
+// Returns the id links we dial know the node by, the transports hash the id
+// of the node they connect to
+func dialedNodeId(nodeId string) string {
+	dialedId := makeNodeIdFromString(nodeId)
+	return dialedId.String()
+}
+
+func (rpc *rpcType) invoke(method string, caller rpcCallerType, args []byte) ([]byte, error) {
+	rpc.lock.Lock()
+	handler := rpc.handlers[method]
+	rpc.lock.Unlock()
+
+	if handler == nil {
+		return nil, errors.New("rpc: no such method " + method)
+	}
+
+	reply, err := handler(caller, args)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reply)
+}
+
+// Returns a link to the super node at address, connecting to it if needed
+func (rpc *rpcType) link(address string) (*RemoteNode, error) {
+	rpc.lock.Lock()
+	remoteNode := rpc.links[address]
+	dialLock := rpc.dialLocks[address]
+	if dialLock == nil {
+		dialLock = new(sync.Mutex)
+		rpc.dialLocks[address] = dialLock
+	}
+	rpc.lock.Unlock()
+
+	if remoteNode != nil && remoteNode.getState() == Alive {
+		return remoteNode, nil
+	}
+
+	// only one go routine at a time should connect to the same address
+	dialLock.Lock()
+	defer dialLock.Unlock()
+
+	rpc.lock.Lock()
+	remoteNode = rpc.links[address]
+	rpc.lock.Unlock()
+	if remoteNode != nil && remoteNode.getState() == Alive {
+		return remoteNode, nil
+	}
+
+	remoteNode, err := rpc.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	rpc.addLink(address, remoteNode)
+	return remoteNode, nil
+}
+
+func (rpc *rpcType) dial(address string) (*RemoteNode, error) {
+	debug("rpc: connecting to super node at " + address)
+
+	superNode := rpc.superNode
+	remoteNodeChannel := make(chan *RemoteNode, 10)
+	errChannel := make(chan error, 1)
+
+	go func() {
+		err := superNode.peerTransport.ConnectToNode(address, remoteNodeChannel, superNode.msgChannel)
+		if err == nil {
+			err = errors.New("rpc: link to " + address + " closed")
+		}
+		errChannel <- err
+	}()
+
+	select {
+	case remoteNode := <-remoteNodeChannel:
+		if remoteNode.address == "" {
+			return nil, errors.New("rpc: node at " + address + " is not a super node")
+		}
+
+		// let the super node know about the new link and when it dies
+		superNode.remoteNodeChannel <- remoteNode
+		go func() {
+			for remoteNode := range remoteNodeChannel {
+				superNode.remoteNodeChannel <- remoteNode
+			}
+		}()
+		return remoteNode, nil
+	case err := <-errChannel:
+		return nil, err
+	case <-time.After(time.Second * RPC_TIMEOUT):
+		return nil, errors.New("rpc: connecting to " + address + " timed out")
+	}
+}
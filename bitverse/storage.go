@@ -0,0 +1,262 @@
+package bitverse
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RepoEntry is a value stored in a repo
+type RepoEntry struct {
+	Value   string
+	Version int64          // incremented on every write, used to resolve conflicts between replicas
+	Deleted bool           `json:",omitempty"` // set on tombstones, which are kept so that deletes replicate
+	Expires int64          `json:",omitempty"` // unix time when the entry expires, 0 if never
+	Seq     int64          `json:",omitempty"` // position of the write in the change sequence of the repo, see Watch
+	Proof   *repoProofType `json:",omitempty"` // the signed request that wrote the entry, verified by replicas
+}
+
+// Rights on a repo granted to public keys other than the owner, every right
+// includes the ones before it
+type RepoRight int
+
+const (
+	RepoNone  RepoRight = iota
+	RepoRead            // Lookup, ListKeys, Scan and Watch
+	RepoWrite           // Store, StoreIf and Delete
+	RepoAdmin           // Grant and Revoke, except for admin rights which only the owner may grant
+)
+
+// RepoAcl holds the rights the owner and admins of a repo have granted
+type RepoAcl struct {
+	Version int64                // incremented on every change, used to resolve conflicts between replicas
+	Grants  map[string]RepoRight // pem encoded public key:right
+	Writers map[string]bool      `json:",omitempty"` // pem encoded public keys that are or have been allowed to write
+	Log     []*repoProofType     `json:",omitempty"` // the last changes, verified by replicas
+}
+
+// Returns true if the entry has expired and is only waiting to be swept
+func (entry *RepoEntry) expired() bool {
+	return entry.Expires != 0 && time.Now().Unix() >= entry.Expires
+}
+
+// Storage is the backend used by super nodes to store repo ownership and
+// key-value data. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Returns the pem encoded public key of the owner, or an empty string if the repo is unknown
+	Owner(repoId string) (string, error)
+	SetOwner(repoId string, owner string) error
+
+	// Returns nil if the key does not exist
+	Get(repoId string, key string) (*RepoEntry, error)
+	Put(repoId string, key string, entry *RepoEntry) error
+	PutAll(repoId string, entries map[string]*RepoEntry) error // all or nothing, key:entry
+	Delete(repoId string, key string) error
+
+	RepoIds() ([]string, error)
+	Keys(repoId string) ([]string, error) // sorted
+
+	// Returns the nonces of recently accepted repo operations by signer, used to
+	// detect replays
+	Nonces(repoId string) (map[string][]int64, error)
+	SetNonces(repoId string, nonces map[string][]int64) error
+
+	// Returns nil if no rights have been granted
+	Acl(repoId string) (*RepoAcl, error)
+	SetAcl(repoId string, acl *RepoAcl) error
+
+	// Removes the repo, including its owner, nonces, acl and all its keys
+	DropRepo(repoId string) error
+
+	Close() error
+}
+
+// MemStorage keeps everything in memory, mostly useful for testing
+type MemStorage struct {
+	lock   sync.RWMutex
+	owners map[string]string                // repoid:public key
+	repos  map[string]map[string]*RepoEntry // repoid:key:entry
+	nonces map[string]map[string][]int64    // repoid:signer:nonces
+	acls   map[string]*RepoAcl              // repoid:acl
+}
+
+func MakeMemStorage() *MemStorage {
+	memStorage := new(MemStorage)
+	memStorage.owners = make(map[string]string)
+	memStorage.repos = make(map[string]map[string]*RepoEntry)
+	memStorage.nonces = make(map[string]map[string][]int64)
+	memStorage.acls = make(map[string]*RepoAcl)
+	return memStorage
+}
+
+func (memStorage *MemStorage) Owner(repoId string) (string, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+	return memStorage.owners[repoId], nil
+}
+
+func (memStorage *MemStorage) SetOwner(repoId string, owner string) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+	if owner == "" {
+		delete(memStorage.owners, repoId)
+	} else {
+		memStorage.owners[repoId] = owner
+	}
+	return nil
+}
+
+func (memStorage *MemStorage) Get(repoId string, key string) (*RepoEntry, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+
+	entry := memStorage.repos[repoId][key]
+	if entry == nil {
+		return nil, nil
+	}
+	entryCopy := *entry
+	return &entryCopy, nil
+}
+
+func (memStorage *MemStorage) Put(repoId string, key string, entry *RepoEntry) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+
+	repo := memStorage.repos[repoId]
+	if repo == nil {
+		repo = make(map[string]*RepoEntry)
+		memStorage.repos[repoId] = repo
+	}
+	entryCopy := *entry
+	repo[key] = &entryCopy
+	return nil
+}
+
+func (memStorage *MemStorage) PutAll(repoId string, entries map[string]*RepoEntry) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+
+	repo := memStorage.repos[repoId]
+	if repo == nil {
+		repo = make(map[string]*RepoEntry)
+		memStorage.repos[repoId] = repo
+	}
+	for key, entry := range entries {
+		entryCopy := *entry
+		repo[key] = &entryCopy
+	}
+	return nil
+}
+
+func (memStorage *MemStorage) Delete(repoId string, key string) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+
+	repo := memStorage.repos[repoId]
+	if repo != nil {
+		delete(repo, key)
+		if len(repo) == 0 {
+			delete(memStorage.repos, repoId)
+		}
+	}
+	return nil
+}
+
+func (memStorage *MemStorage) RepoIds() ([]string, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	var repoIds []string
+	for repoId, _ := range memStorage.owners {
+		seen[repoId] = true
+		repoIds = append(repoIds, repoId)
+	}
+	for repoId, _ := range memStorage.repos {
+		if !seen[repoId] {
+			repoIds = append(repoIds, repoId)
+		}
+	}
+	sort.Strings(repoIds)
+	return repoIds, nil
+}
+
+func (memStorage *MemStorage) Keys(repoId string) ([]string, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+
+	keys := make([]string, 0, len(memStorage.repos[repoId]))
+	for key, _ := range memStorage.repos[repoId] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (memStorage *MemStorage) Nonces(repoId string) (map[string][]int64, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+	return copyNonces(memStorage.nonces[repoId]), nil
+}
+
+func (memStorage *MemStorage) SetNonces(repoId string, nonces map[string][]int64) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+	memStorage.nonces[repoId] = copyNonces(nonces)
+	return nil
+}
+
+func copyNonces(nonces map[string][]int64) map[string][]int64 {
+	copied := make(map[string][]int64, len(nonces))
+	for signer, signerNonces := range nonces {
+		copied[signer] = append([]int64(nil), signerNonces...)
+	}
+	return copied
+}
+
+func (memStorage *MemStorage) Acl(repoId string) (*RepoAcl, error) {
+	memStorage.lock.RLock()
+	defer memStorage.lock.RUnlock()
+	return memStorage.acls[repoId].copy(), nil
+}
+
+func (memStorage *MemStorage) SetAcl(repoId string, acl *RepoAcl) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+	memStorage.acls[repoId] = acl.copy()
+	return nil
+}
+
+func (memStorage *MemStorage) DropRepo(repoId string) error {
+	memStorage.lock.Lock()
+	defer memStorage.lock.Unlock()
+
+	delete(memStorage.owners, repoId)
+	delete(memStorage.repos, repoId)
+	delete(memStorage.nonces, repoId)
+	delete(memStorage.acls, repoId)
+	return nil
+}
+
+func (memStorage *MemStorage) Close() error {
+	return nil
+}
+
+/// PRIVATE
+
+// Returns a deep copy, or nil if acl is nil
+func (acl *RepoAcl) copy() *RepoAcl {
+	if acl == nil {
+		return nil
+	}
+
+	aclCopy := &RepoAcl{Version: acl.Version, Grants: make(map[string]RepoRight), Writers: make(map[string]bool)}
+	for key, right := range acl.Grants {
+		aclCopy.Grants[key] = right
+	}
+	for key := range acl.Writers {
+		aclCopy.Writers[key] = true
+	}
+	aclCopy.Log = append(aclCopy.Log, acl.Log...)
+	return aclCopy
+}
@@ -2,204 +2,149 @@ package bitverse
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mdc/bitverse/dht"
+	"sync"
+	"time"
 )
 
-type repokey_t struct {
-	repoId string
-	key    string
-}
+const DHT_STABILIZE_MIN time.Duration = 2
+const DHT_STABILIZE_MAX time.Duration = 6
+
+// maximum number of messages held per link while verifying that it comes from
+// a super node
+const PEER_MAX_HELD = 100
 
 type SuperNode struct {
-	nodeId                 NodeId
-	children               map[string]*RemoteNode
-	msgChannel             chan Msg
-	remoteNodeChannel      chan *RemoteNode
-	seqNumberCounter       int
-	localAddr              string
-	localPort              string
-	transport              Transport
-	repoAutenticationTable map[string]*string    // repoid:public key
-	repositories           map[repokey_t]*string // global key-value store
+	nodeId            NodeId
+	identity          *Identity
+	children          map[string]*RemoteNode
+	childrenLock      sync.RWMutex // only needed when accessing children outside the main loop
+	locations         *locationCacheType
+	registry          *registryType
+	mailbox           *mailboxType // messages held for edge nodes that are not connected
+	msgChannel        chan Msg
+	remoteNodeChannel chan *RemoteNode
+	peerChannel       chan *peerCheckType
+	peerChecks        map[*RemoteNode]*peerCheckType // links being verified, only accessed by the main loop
+	seqNumberCounter  int
+	localAddr         string
+	localPort         string
+	address           string // address advertised to other super nodes
+	transport         Transport
+	peerTransport     Transport // used for links to other super nodes, same as transport unless set
+	rpc               *rpcType
+	dhtTransport      *dht.LocalTransport
+	ring              *dht.Ring
+	ringLock          sync.RWMutex
+	repoStore         *repoStoreType // the part of the global key-value store we are responsible for
+	watches           *watchesType   // subscriptions of edge nodes to changes of our repos
 }
 
-func MakeSuperNode(transport Transport, localAddress string, localPort string) (*SuperNode, chan int) {
+// Storage is where the super node keeps its repos, e.g. a FileStorage or a
+// MemStorage. The node id is derived from identity, a new random identity is
+// used if identity is nil.
+func MakeSuperNode(transport Transport, identity *Identity, storage Storage, localAddress string, localPort string) (*SuperNode, chan int) {
 	superNode := new(SuperNode)
 
+	superNode.localAddr = localAddress
 	superNode.localPort = localPort
+	superNode.address = localAddress + ":" + localPort
 	superNode.children = make(map[string]*RemoteNode)
 	superNode.transport = transport
+	superNode.peerTransport = transport
 
-	superNode.repoAutenticationTable = make(map[string]*string)
-	superNode.repositories = make(map[repokey_t]*string)
+	superNode.repoStore = makeRepoStore(storage)
 
-	superNode.nodeId = generateNodeId()
+	superNode.identity = identityOrGenerate(identity)
+	superNode.nodeId = superNode.identity.nodeId
 	debug("supernode: my id is " + superNode.Id())
 
-	superNode.transport.SetLocalNodeId(superNode.nodeId)
+	superNode.transport.SetIdentity(superNode.identity)
+	superNode.transport.SetLocalAddress(superNode.address)
 
 	done := make(chan int)
 	superNode.msgChannel = make(chan Msg)
 	superNode.remoteNodeChannel = make(chan *RemoteNode, 10)
+	superNode.peerChannel = make(chan *peerCheckType)
+	superNode.peerChecks = make(map[*RemoteNode]*peerCheckType)
+
+	superNode.rpc = makeRpc(superNode)
+	superNode.locations = makeLocationCache()
+	superNode.registry = makeRegistry()
+	superNode.mailbox = makeMailbox()
+	superNode.watches = makeWatches()
+	superNode.rpc.handle("registry.Publish", superNode.servePublishLocation)
+	superNode.rpc.handle("registry.Withdraw", superNode.serveWithdrawLocation)
+	superNode.rpc.handle("registry.Lookup", superNode.serveLookupLocation)
+	superNode.rpc.handle("mailbox.Deposit", superNode.serveDepositMail)
+	superNode.rpc.handle("mailbox.Ack", superNode.serveAckMail)
+	superNode.rpc.handle("repo.Exec", superNode.serveRepoExec)
+	superNode.rpc.handle("repo.Replicate", superNode.serveRepoReplicate)
+	superNode.dhtTransport = dht.MakeLocalTransport(makeDhtTransport(superNode.rpc))
+
+	// until we join another super node we form a ring of our own
+	var err error
+	superNode.ring, err = dht.Create(superNode.dhtConfig(), superNode.dhtTransport)
+	if err != nil {
+		panic(err)
+	}
 
 	go superNode.transport.Listen(localAddress, localPort, superNode.remoteNodeChannel, superNode.msgChannel)
 
+	registryTicker := time.NewTicker(time.Second * REGISTRY_LEASE / 3)
+	go func() {
+		for _ = range registryTicker.C {
+			superNode.registry.expire()
+			superNode.watches.expire()
+			superNode.renewLocations()
+			superNode.migrateMail()
+		}
+	}()
+
+	repoMigrationTicker := time.NewTicker(time.Second * REPO_MIGRATION_RATE)
+	go func() {
+		for _ = range repoMigrationTicker.C {
+			superNode.migrateRepos()
+		}
+	}()
+
+	repoSweepTicker := time.NewTicker(time.Second * REPO_SWEEP_RATE)
+	go func() {
+		for _ = range repoSweepTicker.C {
+			superNode.sweepRepos()
+		}
+	}()
+
 	go func() {
 		for {
 			select {
 			case msg := <-superNode.msgChannel:
 				//debug("supernode: received " + msg.String())
-				if msg.Dst == superNode.Id() && msg.Type == Data {
-					// ignore, not supported
-
-				} else if msg.Type == Data && msg.ServiceType == Repo && msg.RepoCmd == Claim { // repo claim request
-					// REPO CLAIM REQUEST
-					repoId := msg.RepoId
-					pubKeyPem := msg.Signature
-					debug("supernode: got a repo claim request for repo " + repoId + " with public key <" + pubKeyPem + ">")
-
-					if superNode.repoAutenticationTable[repoId] == nil {
-						// it is free, claim it!
-						superNode.repoAutenticationTable[repoId] = &pubKeyPem // XXX is this safe?
-						msg.Status = Ok
-
+				superNode.receive(msg)
+			case check := <-superNode.peerChannel:
+				superNode.peerChecked(check)
+			case remoteNode := <-superNode.remoteNodeChannel:
+				if remoteNode.address != "" {
+					// links to and from other super nodes are not children, the
+					// links we dial are added to rpc when connecting
+					if remoteNode.getState() == Dead {
+						debug("supernode: lost link to super node at " + remoteNode.address)
+						superNode.rpc.removeLink(remoteNode)
+						delete(superNode.peerChecks, remoteNode)
 					} else {
-						// already claimed
-						if pubKeyPem == *superNode.repoAutenticationTable[repoId] {
-							// but, it the same owner
-							msg.Status = Ok
-						} else {
-							msg.Status = Error
-							msg.Payload = "repo already claimed"
-						}
+						debug("supernode: got link to super node at " + remoteNode.address)
 					}
-
-					childId := msg.Src
-					msg.Dst = childId
-					msg.Src = superNode.Id()
-					superNode.sendToChild(msg)
-
-				} else if msg.Type == Data && msg.ServiceType == Repo && msg.RepoCmd == Store {
-					// REPO STORE REQUEST
-					debug("supernode: got a repo store request repo <" + msg.RepoId + "> with key <" + msg.RepoKey + "> value <" + msg.RepoValue + "> with signature <" + msg.Signature + ">")
-
-					repoId := msg.RepoId
-
-					if superNode.repoAutenticationTable[repoId] == nil {
-						msg.Status = Error
-						msg.Payload = "no such repo " + repoId
-					} else {
-						key := msg.RepoKey
-						value := msg.RepoValue
-						signature := msg.Signature
-
-						pubPemKey := superNode.repoAutenticationTable[repoId]
-						if pubPemKey == nil {
-							errMsg := "failed to receive public key for repo <" + repoId + ">"
-							info("supernode: ERROR " + errMsg)
-							msg.Status = Error
-							msg.Payload = errMsg
-						} else {
-							//_, pub, importErr := ImportPem("cert2")
-							_, pub, importErr := importKeyFromString(*pubPemKey)
-							if importErr != nil {
-								errMsg := "failed to convert pem public key for repo <" + repoId + ">"
-								info("supernode: ERROR " + errMsg)
-								msg.Status = Error
-								msg.Payload = errMsg
-							} else {
-								verfErr := verify(pub, value, signature) // the key and value are aes encrypted
-								if verfErr != nil {
-									errMsg := "failed to verify signature for repo <" + repoId + ">"
-									info("supernode: ERROR " + errMsg)
-									msg.Status = Error
-									msg.Payload = errMsg
-								} else {
-									oldValue := superNode.repositories[repokey_t{repoId, key}]
-									superNode.repositories[repokey_t{repoId, key}] = &value
-									if oldValue == nil {
-										info("supernode: setting key <" + key + "> to value <" + value + ">")
-										msg.Status = Ok
-										msg.PayloadType = Nil
-									} else {
-										info("supernode: replacing key <" + key + "> with value <" + value + ">, old value was <" + *oldValue + ">")
-										msg.Status = Ok
-										msg.Payload = *oldValue
-									}
-								}
-							}
-						}
+				} else if remoteNode.getState() == Dead {
+					if superNode.children[remoteNode.Id()] != remoteNode {
+						break // already removed, or the child has reconnected on a new link
 					}
 
-					// now it is time to send a reply back depending of the outcome
-					childId := msg.Src
-					msg.Dst = childId
-					msg.Src = superNode.Id()
-					superNode.sendToChild(msg)
-				} else if msg.Type == Data && msg.ServiceType == Repo && msg.RepoCmd == Lookup {
-					// REPO LOOKUP REQUEST
-					debug("supernode: got a repo look request repo <" + msg.RepoId + "> with key <" + msg.RepoKey + "> with signature <" + msg.Signature + ">")
-
-					repoId := msg.RepoId
-					if superNode.repoAutenticationTable[repoId] == nil {
-						msg.Status = Error
-						msg.Payload = "no such repo " + repoId
-					} else {
-						key := msg.RepoKey
-						signature := msg.Signature
-
-						pubPemKey := superNode.repoAutenticationTable[repoId]
-						if pubPemKey == nil {
-							errMsg := "failed to receive public key for repo <" + repoId + ">"
-							info("supernode: ERROR " + errMsg)
-							msg.Status = Error
-							msg.Payload = errMsg
-						} else {
-							_, pub, importErr := importKeyFromString(*pubPemKey)
-							if importErr != nil {
-								errMsg := "failed to convert pem public key for repo <" + repoId + ">"
-								info("supernode: ERROR " + errMsg)
-								msg.Status = Error
-								msg.Payload = errMsg
-							} else {
-								verfErr := verify(pub, key, signature) // the key is aes encrypted
-								if verfErr != nil {
-									errMsg := "failed to verify signature for repo <" + repoId + ">"
-									info("supernode: ERROR " + errMsg)
-									msg.Status = Error
-									msg.Payload = errMsg
-								} else {
-									value := superNode.repositories[repokey_t{repoId, key}]
-									if value == nil {
-										msg.Status = Ok
-										msg.PayloadType = Nil
-									} else {
-										msg.Status = Ok
-										msg.Payload = *value
-									}
-								}
-							}
-						}
-
-						// now it is time to send a reply back depending of the outcome
-						childId := msg.Src
-						msg.Dst = childId
-						msg.Src = superNode.Id()
-						superNode.sendToChild(msg)
-					}
-
-				} else if msg.Type == Heartbeat {
-					superNode.forwardToChildren(msg)
-
-				} else if msg.Type == Children {
-					superNode.sendChildrenReply(msg.Src)
-
-				} else {
-					superNode.sendToChild(msg)
-				}
-			case remoteNode := <-superNode.remoteNodeChannel:
-				if remoteNode.state == Dead {
+					superNode.childrenLock.Lock()
 					delete(superNode.children, remoteNode.Id())
+					superNode.childrenLock.Unlock()
+					go superNode.withdrawLocation(remoteNode.Id())
 
 					str := fmt.Sprintf("supernode: removing remote node %s, number of remote nodes are now %d", remoteNode.Id(), len(superNode.children))
 					fmt.Println(str)
@@ -207,7 +152,10 @@ func MakeSuperNode(transport Transport, localAddress string, localPort string) (
 					msg := composeChildLeft(superNode.nodeId.String(), remoteNode.Id())
 					superNode.forwardToChildren(*msg)
 				} else {
+					superNode.childrenLock.Lock()
 					superNode.children[remoteNode.Id()] = remoteNode
+					superNode.childrenLock.Unlock()
+					go superNode.publishLocation(remoteNode.Id())
 
 					str := fmt.Sprintf("supernode: adding remote node %s, number of remote nodes are now %d", remoteNode.Id(), len(superNode.children))
 					info(str)
@@ -228,6 +176,52 @@ func (superNode *SuperNode) Id() string {
 	return superNode.nodeId.String()
 }
 
+// Returns the address other super nodes use to reach this super node
+func (superNode *SuperNode) Address() string {
+	return superNode.address
+}
+
+// Lets other super nodes connect using a separate transport listening at
+// localPort, e.g. a TCPTransport while edge nodes keep using WebSockets. Must
+// be called before Join, as the advertised address changes to the new port
+func (superNode *SuperNode) SetPeerTransport(transport Transport, localPort string) {
+	superNode.ringLock.Lock()
+	defer superNode.ringLock.Unlock()
+
+	superNode.address = superNode.localAddr + ":" + localPort
+	superNode.transport.SetLocalAddress(superNode.address)
+
+	superNode.peerTransport = transport
+	superNode.peerTransport.SetIdentity(superNode.identity)
+	superNode.peerTransport.SetLocalAddress(superNode.address)
+	go superNode.peerTransport.Listen(superNode.localAddr, localPort, superNode.remoteNodeChannel, superNode.msgChannel)
+
+	// our vnodes are named after the address, so the ring has to be recreated
+	superNode.ring.Shutdown()
+	superNode.ring, _ = dht.Create(superNode.dhtConfig(), superNode.dhtTransport)
+}
+
+// Joins the bitverse network of the super node at remoteAddress, stabilization
+// of the ring will then make the super nodes discover each other
+func (superNode *SuperNode) Join(remoteAddress string) error {
+	info("supernode: joining super node at " + remoteAddress)
+
+	superNode.ringLock.Lock()
+	defer superNode.ringLock.Unlock()
+
+	// our vnodes will get the same ids in the new ring
+	superNode.ring.Shutdown()
+
+	ring, err := dht.Join(superNode.dhtConfig(), superNode.dhtTransport, remoteAddress)
+	if err != nil {
+		superNode.ring, _ = dht.Create(superNode.dhtConfig(), superNode.dhtTransport)
+		return err
+	}
+
+	superNode.ring = ring
+	return nil
+}
+
 // DEBUG
 
 func (superNode *SuperNode) Debug() {
@@ -236,6 +230,150 @@ func (superNode *SuperNode) Debug() {
 
 /// PRIVATE
 
+// Returns the addresses of the n first distinct super nodes responsible for key
+func (superNode *SuperNode) lookup(key string, n int) ([]string, error) {
+	superNode.ringLock.RLock()
+	vnodes, err := superNode.ring.Lookup(superNode.dhtConfig().NumSuccessors, []byte(key))
+	superNode.ringLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, vnode := range vnodes {
+		if vnode != nil && !seen[vnode.Host] {
+			seen[vnode.Host] = true
+			addresses = append(addresses, vnode.Host)
+			if len(addresses) == n {
+				break
+			}
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, errors.New("no super node responsible for key " + key)
+	}
+	return addresses, nil
+}
+
+func (superNode *SuperNode) dhtConfig() *dht.Config {
+	conf := dht.DefaultConfig(superNode.address)
+	conf.StabilizeMin = time.Second * DHT_STABILIZE_MIN
+	conf.StabilizeMax = time.Second * DHT_STABILIZE_MAX
+	return conf
+}
+
+// A link from a node advertising an address, i.e. claiming to be a super node,
+// whose claim is being verified
+type peerCheckType struct {
+	remoteNode *RemoteNode
+	held       []Msg // messages received while verifying
+	verifying  bool
+	err        error
+	retry      time.Time // when to verify again after failing
+}
+
+// Checks the link msg was received on before handling it. Children may only
+// send messages on their own behalf while super nodes also relay messages from
+// other nodes and make rpc calls. Messages from a node claiming to be a super
+// node are held until the claim has been verified, see rpcType.authenticated.
+func (superNode *SuperNode) receive(msg Msg) {
+	link := msg.link
+	if link.address == "" {
+		if msg.Src != link.Id() {
+			info("supernode: dropping message from " + link.Id() + " claiming to be from " + msg.Src)
+			return
+		}
+		if msg.Type == Rpc || msg.Type == RpcReply {
+			info("supernode: dropping rpc message from child " + link.Id())
+			return
+		}
+		msg.Origin = "" // only set between super nodes
+		superNode.handleMsg(msg)
+		return
+	}
+
+	if superNode.rpc.authenticated(link) {
+		superNode.handleMsg(msg)
+		return
+	}
+
+	check := superNode.peerChecks[link]
+	if check == nil {
+		check = &peerCheckType{remoteNode: link}
+		superNode.peerChecks[link] = check
+	}
+	if !check.verifying {
+		if time.Now().Before(check.retry) {
+			debug("supernode: dropping message from unverified super node " + link.Id())
+			return
+		}
+		check.verifying = true
+		go func() {
+			check.err = superNode.rpc.verify(link)
+			superNode.peerChannel <- check
+		}()
+	}
+
+	if len(check.held) >= PEER_MAX_HELD {
+		info("supernode: dropping message from unverified super node " + link.Id() + ", too many messages held")
+		return
+	}
+	check.held = append(check.held, msg)
+}
+
+// Handles the messages held while verifying a link
+func (superNode *SuperNode) peerChecked(check *peerCheckType) {
+	check.verifying = false
+	if superNode.peerChecks[check.remoteNode] != check {
+		return // the link has died
+	}
+
+	held := check.held
+	check.held = nil
+	if check.err != nil {
+		info(fmt.Sprintf("supernode: dropping %d messages from %s: %s", len(held), check.remoteNode.Id(), check.err.Error()))
+		check.retry = time.Now().Add(time.Second * RPC_TIMEOUT)
+		return
+	}
+
+	delete(superNode.peerChecks, check.remoteNode)
+	for _, msg := range held {
+		superNode.receive(msg)
+	}
+}
+
+// Handles a message received on a link that may send it, called from the main loop
+func (superNode *SuperNode) handleMsg(msg Msg) {
+	if msg.Dst == superNode.Id() && msg.Type == Data {
+		// ignore, not supported
+
+	} else if msg.Type == Data && msg.ServiceType == Repo && msg.RepoCmd == Change {
+		// REPO CHANGE NOTIFICATION, only the super nodes responsible for the repo may send them
+		go superNode.relayChange(msg)
+
+	} else if msg.Type == Data && msg.ServiceType == Repo {
+		// REPO REQUEST, executed by the super node responsible for the repo
+		go superNode.handleRepoRequest(msg)
+
+	} else if msg.Type == Rpc {
+		go superNode.rpc.serve(msg)
+
+	} else if msg.Type == RpcReply {
+		superNode.rpc.deliverReply(msg)
+
+	} else if msg.Type == Heartbeat {
+		superNode.forwardToChildren(msg)
+
+	} else if msg.Type == Children {
+		superNode.sendChildrenReply(msg.Src)
+
+	} else {
+		superNode.sendToChild(msg)
+	}
+}
+
 func (superNode *SuperNode) sendChildrenReply(nodeId string) {
 	debug("supernode: sending children reply to " + nodeId)
 	childrenIds := make([]string, len(superNode.children))
@@ -256,15 +394,44 @@ func (superNode *SuperNode) sendChildrenReply(nodeId string) {
 }
 
 func (superNode *SuperNode) sendToChild(msg Msg) {
-	for _, remoteNode := range superNode.children {
-		if msg.Src != remoteNode.Id() && msg.Dst == remoteNode.Id() { // do not forward messages to a remote node where it came from
-			debug("supernode: forwarding " + msg.String() + " to " + remoteNode.Id())
-			msg.Dst = remoteNode.Id()
-			remoteNode.deliver(&msg)
-		} else {
-			debug("failed to forward message to child")
+	if msg.Origin != "" && msg.Origin == msg.link.address {
+		// remember where the sender is so that replies can go straight back,
+		// the message came from the super node at origin as children cannot
+		// set it and links from super nodes are authenticated, see receive
+		superNode.locations.add(msg.Src, msg.Origin)
+	}
+
+	remoteNode := superNode.children[msg.Dst]
+	if remoteNode != nil && msg.Src != remoteNode.Id() { // do not forward messages to a remote node where it came from
+		debug("supernode: forwarding " + msg.String() + " to " + remoteNode.Id())
+		if err := remoteNode.deliver(&msg); err != nil {
+			// the link died, hold the message until the child connects again
+			go superNode.depositMail(msg)
+		} else if msg.WantReceipt {
+			go superNode.sendReceipt(msg, Delivered)
 		}
+	} else if remoteNode == nil && msg.Origin == "" && (msg.Type == Data || msg.Type == Receipt) {
+		// the destination might be a child of a foreign super node
+		go superNode.forward(msg)
+	} else if remoteNode == nil && msg.Type == Data {
+		// the destination has left since the sending super node looked it up
+		go superNode.depositMail(msg)
+	} else {
+		debug("supernode: failed to forward message to child " + msg.Dst)
+	}
+}
+
+// Same as sendToChild, but may be called outside the main loop
+func (superNode *SuperNode) replyToChild(msg Msg) error {
+	superNode.childrenLock.RLock()
+	remoteNode := superNode.children[msg.Dst]
+	superNode.childrenLock.RUnlock()
+
+	if remoteNode == nil {
+		debug("supernode: failed to reply to child " + msg.Dst + ", no longer connected")
+		return errors.New("child " + msg.Dst + " is no longer connected")
 	}
+	return remoteNode.deliver(&msg)
 }
 
 func (superNode *SuperNode) forwardToChildren(msg Msg) {
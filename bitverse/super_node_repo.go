@@ -0,0 +1,517 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+const REPO_REPLICAS = 2
+const REPO_MIGRATION_RATE time.Duration = 10
+const REPO_SWEEP_RATE time.Duration = 10
+
+// number of keys returned by ListKeys and Scan if no limit is given, and at most
+const REPO_PAGE_SIZE = 100
+const REPO_MAX_PAGE_SIZE = 1000
+
+/// PRIVATE
+
+// Sends a repo request from one of our children to the super node responsible
+// for the repo and passes the reply back to the child. If the responsible super
+// node cannot be reached, reads are sent to its replicas. Writes are not, the
+// responsible super node may only be unreachable from here and would not see
+// them, so replicas would hand out the same versions for different values.
+// Runs in a separate go routine.
+//
+// Repos are placed by the hash of the repo id rather than by the hash of each
+// key on purpose, so that one super node holds the whole repo and can check
+// acls, list keys and apply batches atomically.
+func (superNode *SuperNode) handleRepoRequest(msg Msg) {
+	var reply Msg
+	addresses, err := superNode.lookup(msg.RepoId, REPO_REPLICAS+1)
+	if err == nil {
+		if !isRepoRead(msg.RepoCmd) {
+			addresses = addresses[:1]
+		}
+		for _, address := range addresses {
+			err = superNode.rpc.call(address, "repo.Exec", msg, &reply)
+			if err == nil {
+				break
+			}
+			info("supernode: failed to execute repo request on super node " + address + ": " + err.Error())
+		}
+	}
+
+	if err != nil {
+		reply = msg
+		reply.Status = Error
+		reply.Payload = "failed to reach the super node responsible for repo <" + msg.RepoId + ">"
+	}
+
+	// now it is time to send a reply back depending of the outcome
+	reply.Dst = msg.Src
+	reply.Src = superNode.Id()
+	superNode.replyToChild(reply)
+}
+
+// Returns true for repo commands that do not change the repo. Watches are not
+// reads here, since replicas do not notify watchers.
+func isRepoRead(cmd int) bool {
+	return cmd == Lookup || cmd == ListKeys || cmd == Scan
+}
+
+// Executes a repo request on the repos we are responsible for
+func (superNode *SuperNode) execRepoCmd(msg Msg) Msg {
+	repoId := msg.RepoId
+	repoStore := superNode.repoStore
+
+	if msg.RepoCmd == Claim {
+		// REPO CLAIM REQUEST
+		pubKeyPem := msg.Signature
+		debug("supernode: got a repo claim request for repo " + repoId + " with public key <" + pubKeyPem + ">")
+
+		claimed, acl, err := repoStore.claim(repoId, pubKeyPem)
+		if err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to claim repo: " + err.Error()
+		} else if claimed {
+			msg.Status = Ok
+			superNode.replicate(&repoRecord{RepoId: repoId, Owner: pubKeyPem, Acl: acl})
+		} else {
+			msg.Status = Error
+			msg.Payload = "repo already claimed"
+		}
+
+	} else if msg.RepoCmd == Store || msg.RepoCmd == StoreIf {
+		// REPO STORE REQUEST
+		debug("supernode: got a repo store request repo <" + repoId + "> with key <" + msg.RepoKey + "> value <" + msg.RepoValue + "> with signature <" + msg.Signature + ">")
+
+		key := msg.RepoKey
+		value := msg.RepoValue
+		expectedVersion := anyVersion
+		if msg.RepoCmd == StoreIf {
+			expectedVersion = msg.RepoVersion
+		}
+
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoWrite); err != nil { // the value is aes encrypted
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if oldEntry, newEntry, err := repoStore.putIf(repoId, key, value, expectedVersion, msg.RepoTTL, proof); err == ErrConflict {
+			msg.Status = Error
+			msg.Payload = err.Error()
+			msg.RepoVersion = 0
+			if oldEntry != nil {
+				msg.RepoVersion = oldEntry.Version
+			}
+		} else if err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to store key: " + err.Error()
+		} else {
+			superNode.replicate(&repoRecord{RepoId: repoId, Values: map[string]*RepoEntry{key: newEntry}, Nonces: nonces})
+			superNode.notifyWatchers([]*repoChangeType{{repoId, key, newEntry}})
+
+			msg.RepoVersion = newEntry.Version
+			if msg.RepoCmd == StoreIf {
+				info("supernode: setting key <" + key + "> to value <" + value + "> version " + strconv.FormatInt(newEntry.Version, 10))
+				msg.Status = Ok
+				msg.PayloadType = Nil
+			} else if oldEntry == nil {
+				info("supernode: setting key <" + key + "> to value <" + value + ">")
+				msg.Status = Ok
+				msg.PayloadType = Nil
+			} else {
+				info("supernode: replacing key <" + key + "> with value <" + value + ">, old value was <" + oldEntry.Value + ">")
+				msg.Status = Ok
+				msg.Payload = oldEntry.Value
+			}
+		}
+
+	} else if msg.RepoCmd == Lookup {
+		// REPO LOOKUP REQUEST
+		debug("supernode: got a repo look request repo <" + repoId + "> with key <" + msg.RepoKey + "> with signature <" + msg.Signature + ">")
+
+		key := msg.RepoKey
+		if _, _, err := superNode.verifyRepoRequest(&msg, RepoRead); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if entry, err := repoStore.get(repoId, key); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to look up key: " + err.Error()
+		} else {
+			if entry == nil {
+				msg.Status = Ok
+				msg.PayloadType = Nil
+			} else {
+				msg.Status = Ok
+				msg.Payload = entry.Value
+				msg.RepoVersion = entry.Version
+				if entry.Expires != 0 {
+					// the seconds left, so that the value can be stored again with the same expiry
+					msg.RepoTTL = entry.Expires - time.Now().Unix()
+					if msg.RepoTTL < 1 {
+						msg.RepoTTL = 1
+					}
+				}
+			}
+		}
+
+	} else if msg.RepoCmd == Delete {
+		// REPO DELETE REQUEST
+		debug("supernode: got a repo delete request repo <" + repoId + "> with key <" + msg.RepoKey + "> with signature <" + msg.Signature + ">")
+
+		key := msg.RepoKey
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoWrite); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if oldEntry, tombstone, err := repoStore.delete(repoId, key, proof); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to delete key: " + err.Error()
+		} else if oldEntry == nil {
+			msg.Status = Ok
+			msg.PayloadType = Nil
+		} else {
+			info("supernode: deleting key <" + key + ">, old value was <" + oldEntry.Value + ">")
+			superNode.replicate(&repoRecord{RepoId: repoId, Values: map[string]*RepoEntry{key: tombstone}, Nonces: nonces})
+			superNode.notifyWatchers([]*repoChangeType{{repoId, key, tombstone}})
+			msg.Status = Ok
+			msg.Payload = oldEntry.Value
+		}
+
+	} else if msg.RepoCmd == ListKeys || msg.RepoCmd == Scan {
+		// REPO LIST KEYS OR SCAN REQUEST
+		debug("supernode: got a repo list request repo <" + repoId + "> with prefix <" + msg.RepoKey + "> after <" + msg.RepoAfter + "> with signature <" + msg.Signature + ">")
+
+		limit := msg.RepoLimit
+		if limit <= 0 {
+			limit = REPO_PAGE_SIZE
+		} else if limit > REPO_MAX_PAGE_SIZE {
+			limit = REPO_MAX_PAGE_SIZE
+		}
+
+		if _, _, err := superNode.verifyRepoRequest(&msg, RepoRead); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if keys, entries, next, err := repoStore.scan(repoId, msg.RepoKey, msg.RepoAfter, limit); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to list keys: " + err.Error()
+		} else {
+			page := RepoPage{Keys: keys, Next: next}
+			if msg.RepoCmd == Scan {
+				page.Values = make(map[string]string)
+				for key, entry := range entries {
+					page.Values[key] = entry.Value // aes encrypted
+				}
+			}
+
+			pageJson, err := json.Marshal(page)
+			if err != nil {
+				panic(err)
+			}
+			msg.Status = Ok
+			msg.PayloadType = String
+			msg.Payload = string(pageJson)
+		}
+
+	} else if msg.RepoCmd == Watch {
+		// REPO WATCH REQUEST, subscribes or renews a subscription
+		debug("supernode: got a repo watch request repo <" + repoId + "> with prefix <" + msg.RepoKey + "> since " + strconv.FormatInt(msg.RepoSeq, 10) + " with signature <" + msg.Signature + ">")
+
+		if _, _, err := superNode.verifyRepoRequest(&msg, RepoRead); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else {
+			// remember who subscribed rather than the owner, which may change
+			signer, _ := repoStore.authorize(repoId, msg.RepoSigner, RepoRead)
+
+			// subscribe before reading the changes so that none falls in between
+			superNode.watches.add(&watchType{nodeId: msg.Src, repoId: repoId, prefix: msg.RepoKey, watchId: msg.RepoWatchId, signer: signer})
+
+			if seq, changes, err := repoStore.changes(repoId, msg.RepoKey, msg.RepoSeq); err != nil {
+				msg.Status = Error
+				msg.Payload = "failed to read changes: " + err.Error()
+			} else {
+				if msg.RepoSeq > 0 {
+					// resent to this watch only, other watches have their own tokens
+					var msgs []*Msg
+					for _, change := range changes {
+						msgs = append(msgs, composeRepoChangeMsg(superNode.Id(), msg.Src, repoId, msg.RepoWatchId, change.key, change.entry))
+					}
+					superNode.sendChanges(msgs)
+				}
+				replyJson, err := json.Marshal(&repoWatchReplyType{Seq: seq, SuperNodeId: superNode.Id()})
+				if err != nil {
+					panic(err)
+				}
+				msg.Status = Ok
+				msg.PayloadType = String
+				msg.Payload = string(replyJson)
+			}
+		}
+
+	} else if msg.RepoCmd == Grant {
+		// REPO GRANT REQUEST
+		debug("supernode: got a repo grant request repo <" + repoId + "> for public key <" + msg.RepoValue + "> with signature <" + msg.Signature + ">")
+
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoAdmin); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if _, pub, err := importKeyFromString(msg.RepoValue); err != nil || pub == nil {
+			msg.Status = Error
+			msg.Payload = "invalid public key"
+		} else if acl, err := repoStore.grant(repoId, proof); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to grant right: " + err.Error()
+		} else {
+			info("supernode: granted right " + strconv.Itoa(msg.RepoRight) + " on repo <" + repoId + "> to <" + msg.RepoValue + ">")
+			owner, _ := repoStore.owner(repoId)
+			superNode.replicate(&repoRecord{RepoId: repoId, Owner: owner, Acl: acl, Nonces: nonces})
+			msg.Status = Ok
+			msg.PayloadType = Nil
+		}
+
+	} else if msg.RepoCmd == Batch {
+		// REPO BATCH REQUEST, all writes are applied or none
+		debug("supernode: got a repo batch request repo <" + repoId + "> with batch <" + msg.RepoValue + "> with signature <" + msg.Signature + ">")
+
+		batch := new(repoBatchType)
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoWrite); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if err := json.Unmarshal([]byte(msg.RepoValue), batch); err != nil {
+			msg.Status = Error
+			msg.Payload = "invalid batch: " + err.Error()
+		} else if err := batch.validate(); err != nil {
+			msg.Status = Error
+			msg.Payload = "invalid batch: " + err.Error()
+		} else if changes, err := repoStore.batch(repoId, batch, proof); err == ErrConflict {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to apply batch: " + err.Error()
+		} else {
+			record := &repoRecord{RepoId: repoId, Values: make(map[string]*RepoEntry), Nonces: nonces}
+			versions := make(map[string]int64)
+			for _, change := range changes {
+				record.Values[change.key] = change.entry
+				versions[change.key] = change.entry.Version
+			}
+			info("supernode: applied batch of " + strconv.Itoa(len(batch.Ops)) + " writes to repo <" + repoId + ">")
+			superNode.replicate(record)
+			superNode.notifyWatchers(changes)
+
+			versionsJson, err := json.Marshal(versions)
+			if err != nil {
+				panic(err)
+			}
+			msg.Status = Ok
+			msg.PayloadType = String
+			msg.Payload = string(versionsJson)
+		}
+
+	} else if msg.RepoCmd == Transfer {
+		// REPO TRANSFER REQUEST
+		debug("supernode: got a repo transfer request repo <" + repoId + "> to public key <" + msg.RepoValue + "> with signature <" + msg.Signature + ">")
+
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoAdmin); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if _, pub, err := importKeyFromString(msg.RepoValue); err != nil || pub == nil {
+			msg.Status = Error
+			msg.Payload = "invalid public key"
+		} else if acl, err := repoStore.transfer(repoId, proof); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to transfer repo: " + err.Error()
+		} else {
+			info("supernode: transferred repo <" + repoId + "> to <" + msg.RepoValue + ">")
+			superNode.replicate(&repoRecord{RepoId: repoId, Owner: msg.RepoValue, Acl: acl, Nonces: nonces})
+			msg.Status = Ok
+			msg.PayloadType = Nil
+		}
+
+	} else if msg.RepoCmd == Release {
+		// REPO RELEASE REQUEST
+		debug("supernode: got a repo release request repo <" + repoId + "> with signature <" + msg.Signature + ">")
+
+		if proof, nonces, err := superNode.verifyRepoRequest(&msg, RepoAdmin); err != nil {
+			msg.Status = Error
+			msg.Payload = err.Error()
+		} else if acl, tombstones, err := repoStore.release(repoId, proof); err != nil {
+			msg.Status = Error
+			msg.Payload = "failed to release repo: " + err.Error()
+		} else {
+			record := &repoRecord{RepoId: repoId, Acl: acl, Nonces: nonces, Values: make(map[string]*RepoEntry)}
+			for _, change := range tombstones {
+				record.Values[change.key] = change.entry
+			}
+
+			info("supernode: released repo <" + repoId + ">, wiped " + strconv.Itoa(len(tombstones)) + " keys")
+			superNode.replicate(record)
+			msg.Status = Ok
+			msg.PayloadType = Nil
+		}
+
+	} else {
+		msg.Status = Error
+		msg.Payload = "unknown repo command"
+	}
+
+	return msg
+}
+
+// Verifies that a repo request has been signed by the owner of the repo or by
+// a public key granted right, and is not a replay. Returns the proof that goes
+// with the changes made by the request, and the nonces to replicate.
+func (superNode *SuperNode) verifyRepoRequest(msg *Msg, right RepoRight) (*repoProofType, map[string][]int64, error) {
+	signer, err := superNode.repoStore.authorize(msg.RepoId, msg.RepoSigner, right)
+	if err != nil {
+		info("supernode: rejecting repo request " + msg.Id + ": " + err.Error())
+		return nil, nil, err
+	}
+	if err := superNode.verifyRepoSignature(msg.RepoId, signer, msg.repoSignatureData(), msg.Signature); err != nil {
+		return nil, nil, err
+	}
+
+	nonces, err := superNode.repoStore.useNonce(msg.RepoId, signer, msg.RepoNonce, right == RepoRead)
+	if err != nil {
+		info("supernode: rejecting repo request " + msg.Id + " for repo <" + msg.RepoId + ">: " + err.Error())
+		return nil, nil, errors.New("rejected request for repo <" + msg.RepoId + ">: " + err.Error())
+	}
+	return makeRepoProof(msg, signer), nonces, nil
+}
+
+// Verifies that data has been signed with the pem encoded public key
+func (superNode *SuperNode) verifyRepoSignature(repoId string, pubPemKey string, data string, signature string) error {
+	_, pub, importErr := importKeyFromString(pubPemKey)
+	if importErr != nil || pub == nil {
+		errMsg := "failed to convert pem public key for repo <" + repoId + ">"
+		info("supernode: ERROR " + errMsg)
+		return errors.New(errMsg)
+	}
+
+	if verfErr := verify(pub, data, signature); verfErr != nil {
+		errMsg := "failed to verify signature for repo <" + repoId + ">"
+		info("supernode: ERROR " + errMsg)
+		return errors.New(errMsg)
+	}
+	return nil
+}
+
+// Removes expired keys, every replica sweeps its own copy of a repo
+func (superNode *SuperNode) sweepRepos() {
+	expired, swept, err := superNode.repoStore.sweep()
+	if err != nil {
+		info("supernode: failed to remove expired keys: " + err.Error())
+	}
+	superNode.notifyWatchers(expired)
+	if swept > 0 {
+		debug("supernode: removed " + strconv.Itoa(swept) + " expired keys")
+	}
+}
+
+// Sends changes of a repo to its replicas
+func (superNode *SuperNode) replicate(record *repoRecord) {
+	go func() {
+		addresses, err := superNode.lookup(record.RepoId, REPO_REPLICAS+1)
+		if err != nil {
+			info("supernode: failed to replicate repo <" + record.RepoId + ">: " + err.Error())
+			return
+		}
+
+		for _, address := range addresses {
+			if address == superNode.address {
+				continue
+			}
+			err := superNode.rpc.call(address, "repo.Replicate", []*repoRecord{record}, nil)
+			if err != nil {
+				info("supernode: failed to replicate repo <" + record.RepoId + "> to " + address + ": " + err.Error())
+			}
+		}
+	}()
+}
+
+// Pushes all repos we store to the super nodes responsible for them, and drops
+// the repos we are no longer responsible for. This makes repos move to new
+// super nodes joining the ring, and restores the number of replicas when super
+// nodes leave.
+func (superNode *SuperNode) migrateRepos() {
+	repoIds, err := superNode.repoStore.repoIds()
+	if err != nil {
+		info("supernode: failed to list repos: " + err.Error())
+		return
+	}
+
+	records := make(map[string][]*repoRecord) // address:records
+	for _, repoId := range repoIds {
+		addresses, err := superNode.lookup(repoId, REPO_REPLICAS+1)
+		if err != nil {
+			debug("supernode: failed to look up super nodes responsible for repo <" + repoId + ">: " + err.Error())
+			continue
+		}
+
+		record, err := superNode.repoStore.record(repoId)
+		if err != nil {
+			info("supernode: failed to read repo <" + repoId + ">: " + err.Error())
+			continue
+		}
+
+		responsible := false
+		for _, address := range addresses {
+			if address == superNode.address {
+				responsible = true
+			}
+		}
+
+		if responsible {
+			// batched below with the other repos going to the same super nodes
+			for _, address := range addresses {
+				if address != superNode.address {
+					records[address] = append(records[address], record)
+				}
+			}
+		} else {
+			// only drop the repo if all responsible super nodes got it
+			errs := 0
+			for _, address := range addresses {
+				if err := superNode.rpc.call(address, "repo.Replicate", []*repoRecord{record}, nil); err != nil {
+					errs++
+				}
+			}
+			if errs == 0 {
+				debug("supernode: repo <" + repoId + "> moved to " + addresses[0])
+				if err := superNode.repoStore.drop(repoId); err != nil {
+					info("supernode: failed to drop repo <" + repoId + ">: " + err.Error())
+				}
+			}
+		}
+	}
+
+	for address, addressRecords := range records {
+		if err := superNode.rpc.call(address, "repo.Replicate", addressRecords, nil); err != nil {
+			debug("supernode: failed to replicate repos to " + address + ": " + err.Error())
+		}
+	}
+}
+
+func (superNode *SuperNode) serveRepoExec(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var msg Msg
+	if err := json.Unmarshal(argsJson, &msg); err != nil {
+		return nil, err
+	}
+	return superNode.execRepoCmd(msg), nil
+}
+
+func (superNode *SuperNode) serveRepoReplicate(caller rpcCallerType, argsJson []byte) (interface{}, error) {
+	var records []*repoRecord
+	if err := json.Unmarshal(argsJson, &records); err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		if err := superNode.repoStore.merge(record); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,815 @@
+package bitverse
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+)
+
+func TestRepoReplayProtection(t *testing.T) {
+	network := MakeMemNetwork()
+	superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubPem, _ := generatePublicPem(pub)
+	if reply := superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", pubPem)); reply.Status != Ok {
+		t.Fatalf("failed to claim repo: %s", reply.Payload)
+	}
+
+	repoService := composeRepoService(prv, pub, "repo", nil, nil)
+	signedStore := func(key string, nonce int64) Msg {
+		msg := composeRepoStoreMsg("edge", "super", "repo", key, "value", nonce)
+		repoService.sign(msg)
+		return *msg
+	}
+
+	now := time.Now().UnixNano()
+	msg := signedStore("a", now)
+	if reply := superNode.execRepoCmd(msg); reply.Status != Ok {
+		t.Fatalf("failed to store: %s", reply.Payload)
+	}
+
+	if reply := superNode.execRepoCmd(msg); reply.Status != Error {
+		t.Error("expected replayed request to be rejected")
+	}
+
+	retargeted := signedStore("a", now+1)
+	retargeted.RepoKey = "b"
+	if reply := superNode.execRepoCmd(retargeted); reply.Status != Error {
+		t.Error("expected request with another key to be rejected")
+	}
+
+	spoofed := signedStore("a", now+2)
+	spoofed.Src = "other"
+	if reply := superNode.execRepoCmd(spoofed); reply.Status != Error {
+		t.Error("expected request from another sender to be rejected")
+	}
+
+	// requests may arrive out of order within the window
+	if reply := superNode.execRepoCmd(signedStore("a", now-1)); reply.Status != Ok {
+		t.Errorf("expected reordered request to be accepted: %s", reply.Payload)
+	}
+
+	if reply := superNode.execRepoCmd(signedStore("a", now-int64(time.Second*REPO_NONCE_WINDOW))); reply.Status != Error {
+		t.Error("expected stale request to be rejected")
+	}
+}
+
+func TestRepoNoncesBySigner(t *testing.T) {
+	storage := MakeMemStorage()
+	superNode, _ := MakeSuperNode(MakeMemNetwork().MakeTransport(), nil, storage, "super", "1111")
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerPem, _ := generatePublicPem(pub)
+	superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", ownerPem))
+	owner := composeRepoService(prv, pub, "repo", nil, nil)
+
+	key, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := composeRepoService(key, &key.PublicKey, "repo", nil, nil)
+	member.signer, _ = generatePublicPem(&key.PublicKey)
+
+	exec := func(repoService *RepoService, msg *Msg, nonce int64) Msg {
+		msg.RepoNonce = nonce
+		repoService.sign(msg)
+		return superNode.execRepoCmd(*msg)
+	}
+	exec(owner, composeRepoGrantMsg("edge", "super", "repo", member.signer, RepoWrite, 0), owner.nextNonce())
+
+	// the clock of the owner is ahead, this must not make the requests of the member stale
+	ahead := time.Now().Add(10 * time.Minute).UnixNano()
+	if reply := exec(owner, composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0), ahead); reply.Status != Ok {
+		t.Fatalf("failed to store: %s", reply.Payload)
+	}
+	if reply := exec(member, composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0), member.nextNonce()); reply.Status != Ok {
+		t.Fatalf("expected the store of the member to be accepted: %s", reply.Payload)
+	}
+
+	// nonces of reads are not stored, but replays are still rejected
+	stored, _ := storage.Nonces("repo")
+	lookup := composeRepoLookupMsg("edge", "super", "repo", "key", member.nextNonce())
+	member.sign(lookup)
+	if reply := superNode.execRepoCmd(*lookup); reply.Status != Ok {
+		t.Fatalf("failed to look up: %s", reply.Payload)
+	}
+	if nonces, _ := storage.Nonces("repo"); len(nonces[member.signer]) != len(stored[member.signer]) {
+		t.Error("expected the nonce of a read not to be stored")
+	}
+	if reply := superNode.execRepoCmd(*lookup); reply.Status != Error {
+		t.Error("expected replayed lookup to be rejected")
+	}
+}
+
+func TestRepoAcl(t *testing.T) {
+	network := MakeMemNetwork()
+	superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerPem, _ := generatePublicPem(pub)
+	if reply := superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", ownerPem)); reply.Status != Ok {
+		t.Fatalf("failed to claim repo: %s", reply.Payload)
+	}
+	owner := composeRepoService(prv, pub, "repo", nil, nil)
+
+	var members []*RepoService
+	for i := 0; i < 2; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		member := composeRepoService(key, &key.PublicKey, "repo", nil, nil)
+		member.signer, _ = generatePublicPem(&key.PublicKey)
+		members = append(members, member)
+	}
+	member, other := members[0], members[1]
+
+	exec := func(repoService *RepoService, msg *Msg) Msg {
+		msg.RepoNonce = repoService.nextNonce()
+		repoService.sign(msg)
+		return superNode.execRepoCmd(*msg)
+	}
+	store := func(repoService *RepoService) Msg {
+		return exec(repoService, composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0))
+	}
+	lookup := func(repoService *RepoService) Msg {
+		return exec(repoService, composeRepoLookupMsg("edge", "super", "repo", "key", 0))
+	}
+	grant := func(repoService *RepoService, grantee *RepoService, right RepoRight) Msg {
+		return exec(repoService, composeRepoGrantMsg("edge", "super", "repo", grantee.signer, right, 0))
+	}
+
+	if reply := lookup(member); reply.Status != Error {
+		t.Fatal("expected lookup without rights to be denied")
+	}
+
+	grant(owner, member, RepoRead)
+	if reply := lookup(member); reply.Status != Ok {
+		t.Fatalf("expected lookup with read right to succeed: %s", reply.Payload)
+	}
+	if reply := store(member); reply.Status != Error {
+		t.Fatal("expected store with read right to be denied")
+	}
+
+	grant(owner, member, RepoWrite)
+	if reply := store(member); reply.Status != Ok {
+		t.Fatalf("expected store with write right to succeed: %s", reply.Payload)
+	}
+	if reply := grant(member, other, RepoRead); reply.Status != Error {
+		t.Fatal("expected grant without admin right to be denied")
+	}
+
+	// a member cannot pass itself off as the owner
+	spoofed := composeRepoStoreMsg("edge", "super", "repo", "key", "value", member.nextNonce())
+	member.sign(spoofed)
+	spoofed.RepoSigner = ""
+	if reply := superNode.execRepoCmd(*spoofed); reply.Status != Error {
+		t.Fatal("expected request signed by a member on behalf of the owner to be rejected")
+	}
+
+	grant(owner, member, RepoAdmin)
+	if reply := grant(member, other, RepoWrite); reply.Status != Ok {
+		t.Fatalf("expected admin to grant write right: %s", reply.Payload)
+	}
+	if reply := grant(member, other, RepoAdmin); reply.Status != Error {
+		t.Fatal("expected admin not to grant admin right")
+	}
+	if reply := grant(other, member, RepoNone); reply.Status != Error {
+		t.Fatal("expected writer not to revoke rights")
+	}
+
+	// the acl replicates, revocations included
+	grant(owner, member, RepoNone)
+	replica := makeRepoStore(MakeMemStorage())
+	record, _ := superNode.repoStore.record("repo")
+	replica.merge(record)
+	if _, err := replica.authorize("repo", member.signer, RepoRead); err == nil {
+		t.Error("expected revocation to replicate")
+	}
+	if _, err := replica.authorize("repo", other.signer, RepoWrite); err != nil {
+		t.Errorf("expected granted right to replicate: %v", err)
+	}
+	if reply := lookup(member); reply.Status != Error {
+		t.Fatal("expected lookup after revocation to be denied")
+	}
+}
+
+func TestRepoTransferAndRelease(t *testing.T) {
+	network := MakeMemNetwork()
+	superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+
+	var services []*RepoService
+	var pems []string
+	for i := 0; i < 3; i++ {
+		key, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pem, _ := generatePublicPem(&key.PublicKey)
+		services = append(services, composeRepoService(key, &key.PublicKey, "repo", nil, nil))
+		pems = append(pems, pem)
+	}
+	owner, newOwner, member := services[0], services[1], services[2]
+
+	exec := func(repoService *RepoService, msg *Msg) Msg {
+		msg.RepoNonce = repoService.nextNonce()
+		repoService.sign(msg)
+		return superNode.execRepoCmd(*msg)
+	}
+	store := func(repoService *RepoService) Msg {
+		return exec(repoService, composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0))
+	}
+
+	superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", pems[0]))
+	store(owner)
+	member.signer = pems[2]
+	exec(owner, composeRepoGrantMsg("edge", "super", "repo", pems[2], RepoAdmin, 0))
+	before, _ := superNode.repoStore.record("repo")
+
+	if reply := exec(member, composeRepoTransferMsg("edge", "super", "repo", pems[2], 0)); reply.Status != Error {
+		t.Fatal("expected transfer by an admin to be rejected")
+	}
+	if reply := exec(owner, composeRepoTransferMsg("edge", "super", "repo", pems[1], 0)); reply.Status != Ok {
+		t.Fatalf("failed to transfer repo: %s", reply.Payload)
+	}
+	if reply := store(owner); reply.Status != Error {
+		t.Fatal("expected the old owner to be locked out")
+	}
+	if reply := store(newOwner); reply.Status != Ok {
+		t.Fatalf("expected the new owner to store: %s", reply.Payload)
+	}
+	if reply := store(member); reply.Status != Ok {
+		t.Fatalf("expected granted rights to be kept: %s", reply.Payload)
+	}
+	if reply := superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", pems[1])); reply.Status != Ok {
+		t.Fatalf("expected the new owner to claim the repo: %s", reply.Payload)
+	}
+
+	// replicas follow the newer ownership, in whatever order records arrive
+	after, _ := superNode.repoStore.record("repo")
+	for _, records := range [][]*repoRecord{{before, after}, {after, before}} {
+		replica := makeRepoStore(MakeMemStorage())
+		for _, record := range records {
+			replica.merge(record)
+		}
+		if current, _ := replica.owner("repo"); current != pems[1] {
+			t.Fatal("expected the transfer to replicate")
+		}
+	}
+
+	if reply := exec(newOwner, composeRepoReleaseMsg("edge", "super", "repo", true, 0)); reply.Status != Ok {
+		t.Fatalf("failed to release repo: %s", reply.Payload)
+	}
+	if reply := store(member); reply.Status != Error {
+		t.Fatal("expected grants to be dropped on release")
+	}
+
+	// anyone may claim the released repo, and finds it empty
+	if reply := superNode.execRepoCmd(*composeRepoClaimMsg("edge", "super", "repo", pems[2])); reply.Status != Ok {
+		t.Fatalf("failed to claim released repo: %s", reply.Payload)
+	}
+	member.signer = ""
+	if reply := exec(member, composeRepoLookupMsg("edge", "super", "repo", "key", 0)); reply.Status != Ok || reply.PayloadType != Nil {
+		t.Fatalf("expected the wiped key to be gone, got %v", reply.Payload)
+	}
+
+	released, _ := superNode.repoStore.record("repo")
+	replica := makeRepoStore(MakeMemStorage())
+	replica.merge(after)
+	replica.merge(released)
+	if current, _ := replica.owner("repo"); current != pems[2] {
+		t.Fatal("expected the new claim to replicate")
+	}
+	if entry, _ := replica.get("repo", "key"); entry != nil {
+		t.Fatal("expected the wipe to replicate")
+	}
+}
+
+func TestRepoDeleteListAndScan(t *testing.T) {
+	network := MakeMemNetwork()
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := GenerateAesSecret()
+
+	result := make(chan interface{}, 1)
+	callback := func(err error, data interface{}) {
+		if err != nil {
+			result <- err
+		} else {
+			result <- data
+		}
+	}
+
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode.Connect("super:1111")
+	time.Sleep(300 * time.Millisecond)
+
+	edgeNode.ClaimOwnership("repo", secret, prv, pub, 5, callback)
+	repoService, ok := (<-result).(*RepoService)
+	if !ok {
+		t.Fatal("failed to claim repo")
+	}
+	for _, key := range []string{"user/1", "user/2", "user/3", "group/1"} {
+		repoService.Store(key, "value "+key, 5, callback)
+		<-result
+	}
+
+	repoService.Delete("user/2", 5, callback)
+	if oldValue := <-result; oldValue != "value user/2" {
+		t.Fatalf("expected old value of deleted key, got %v", oldValue)
+	}
+	repoService.Delete("user/2", 5, callback)
+	if oldValue := <-result; oldValue != nil {
+		t.Fatalf("expected nil when deleting a missing key, got %v", oldValue)
+	}
+	repoService.Lookup("user/2", 5, callback)
+	if value := <-result; value != nil {
+		t.Fatalf("expected deleted key to be gone, got %v", value)
+	}
+
+	var keys []string
+	after := ""
+	for pages := 0; ; pages++ {
+		repoService.ListKeys(after, 2, 5, callback)
+		page, ok := (<-result).(*RepoPage)
+		if !ok || pages > 2 {
+			t.Fatal("failed to list keys")
+		}
+		keys = append(keys, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+		after = page.Next
+	}
+	if len(keys) != 3 || keys[0] != "group/1" || keys[1] != "user/1" || keys[2] != "user/3" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	repoService.Scan("user/", "", 0, 5, callback)
+	page, ok := (<-result).(*RepoPage)
+	if !ok || len(page.Keys) != 2 || page.Values["user/1"] != "value user/1" || page.Values["user/3"] != "value user/3" {
+		t.Fatalf("unexpected scan result %v", page)
+	}
+}
+
+// Returns the public key of the test certificate and a function signing repo
+// requests with it, which returns the proof of the request
+func makeRepoSigner(t *testing.T) (string, func(msg *Msg) *repoProofType) {
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerPem, _ := generatePublicPem(pub)
+	repoService := composeRepoService(prv, pub, "repo", nil, nil)
+	return ownerPem, func(msg *Msg) *repoProofType {
+		msg.RepoNonce = repoService.nextNonce()
+		repoService.sign(msg)
+		return makeRepoProof(msg, ownerPem)
+	}
+}
+
+func TestRepoStoreMergeTombstone(t *testing.T) {
+	owner, sign := makeRepoSigner(t)
+	repoStore := makeRepoStore(MakeMemStorage())
+	replica := makeRepoStore(MakeMemStorage())
+	repoStore.claim("repo", owner)
+
+	_, entry, _ := repoStore.put("repo", "key", "value", sign(composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0)))
+	replica.merge(&repoRecord{RepoId: "repo", Owner: owner, Values: map[string]*RepoEntry{"key": entry}})
+
+	_, tombstone, _ := repoStore.delete("repo", "key", sign(composeRepoDeleteMsg("edge", "super", "repo", "key", 0)))
+	replica.merge(&repoRecord{RepoId: "repo", Owner: owner, Values: map[string]*RepoEntry{"key": tombstone}})
+	if entry, _ := replica.get("repo", "key"); entry != nil {
+		t.Fatal("expected delete to replicate")
+	}
+
+	// an older replica must not bring the key back
+	stale := makeRepoStore(MakeMemStorage())
+	stale.merge(&repoRecord{RepoId: "repo", Owner: owner, Values: map[string]*RepoEntry{"key": entry}})
+	record, _ := stale.record("repo")
+	repoStore.merge(record)
+	if entry, _ := repoStore.get("repo", "key"); entry != nil {
+		t.Fatal("expected deleted key to stay deleted")
+	}
+}
+
+func TestRepoCompareAndSwap(t *testing.T) {
+	network := MakeMemNetwork()
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := GenerateAesSecret()
+
+	result := make(chan interface{}, 1)
+	callback := func(err error, data interface{}) {
+		if err != nil {
+			result <- err
+		} else {
+			result <- data
+		}
+	}
+
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode.Connect("super:1111")
+	time.Sleep(300 * time.Millisecond)
+
+	edgeNode.ClaimOwnership("repo", secret, prv, pub, 5, callback)
+	repoService, ok := (<-result).(*RepoService)
+	if !ok {
+		t.Fatal("failed to claim repo")
+	}
+
+	repoService.StoreIf("counter", "1", 0, 5, callback)
+	if version := <-result; version != int64(1) {
+		t.Fatalf("expected version 1, got %v", version)
+	}
+	repoService.StoreIf("counter", "1", 0, 5, callback)
+	if err := <-result; err != ErrConflict {
+		t.Fatalf("expected conflict when the key exists, got %v", err)
+	}
+
+	repoService.LookupVersion("counter", 5, callback)
+	value, ok := (<-result).(*RepoValue)
+	if !ok || value.Value != "1" || value.Version != 1 {
+		t.Fatalf("unexpected value %v", value)
+	}
+
+	// someone else changes the value in between
+	repoService.Store("counter", "5", 5, callback)
+	<-result
+
+	repoService.StoreIf("counter", "2", value.Version, 5, callback)
+	if err := <-result; err != ErrConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	repoService.LookupVersion("counter", 5, callback)
+	value = (<-result).(*RepoValue)
+	repoService.StoreIf("counter", "6", value.Version, 5, callback)
+	if version := <-result; version != int64(3) {
+		t.Fatalf("expected version 3, got %v", version)
+	}
+
+	repoService.LookupVersion("missing", 5, callback)
+	if value := <-result; value != nil {
+		t.Fatalf("expected nil for a missing key, got %v", value)
+	}
+}
+
+func TestRepoBatch(t *testing.T) {
+	network := MakeMemNetwork()
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := GenerateAesSecret()
+
+	result := make(chan interface{}, 1)
+	callback := func(err error, data interface{}) {
+		if err != nil {
+			result <- err
+		} else {
+			result <- data
+		}
+	}
+
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode.Connect("super:1111")
+	time.Sleep(300 * time.Millisecond)
+
+	edgeNode.ClaimOwnership("repo", secret, prv, pub, 5, callback)
+	repoService, ok := (<-result).(*RepoService)
+	if !ok {
+		t.Fatal("failed to claim repo")
+	}
+
+	// a record and its index key are written together
+	repoService.Batch().Require("index/alice", 0).Store("user/1", "alice").Store("index/alice", "user/1").Commit(5, callback)
+	versions, ok := (<-result).(map[string]int64)
+	if !ok || versions["user/1"] != 1 || versions["index/alice"] != 1 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	repoService.Lookup("index/alice", 5, callback)
+	if value := <-result; value != "user/1" {
+		t.Fatalf("expected user/1, got %v", value)
+	}
+
+	// a failed precondition fails the whole batch
+	repoService.Batch().Require("index/alice", 0).Store("user/2", "alice").Store("index/alice", "user/2").Commit(5, callback)
+	if err := <-result; err != ErrConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	repoService.Lookup("user/2", 5, callback)
+	if value := <-result; value != nil {
+		t.Fatalf("expected nothing to be written, got %v", value)
+	}
+
+	repoService.Batch().Require("index/alice", 1).Delete("user/1").Delete("missing").Store("index/alice", "user/3").Commit(5, callback)
+	versions, ok = (<-result).(map[string]int64)
+	if !ok || len(versions) != 2 || versions["user/1"] != 2 || versions["index/alice"] != 2 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+	repoService.Lookup("user/1", 5, callback)
+	if value := <-result; value != nil {
+		t.Fatalf("expected user/1 to be deleted, got %v", value)
+	}
+
+	repoService.Batch().Store("a", "1").Delete("a").Commit(5, callback)
+	if _, ok := (<-result).(error); !ok {
+		t.Fatal("expected a batch writing a key twice to be rejected")
+	}
+}
+
+func TestRepoStoreExpiry(t *testing.T) {
+	owner, sign := makeRepoSigner(t)
+	storage := MakeMemStorage()
+	repoStore := makeRepoStore(storage)
+	repoStore.claim("repo", owner)
+
+	session := composeRepoStoreMsg("edge", "super", "repo", "session", "value", 0)
+	session.RepoTTL = 60
+	_, entry, _ := repoStore.putIf("repo", "session", "value", anyVersion, 60, sign(session))
+	if entry.Expires == 0 {
+		t.Fatal("expected entry to expire")
+	}
+	repoStore.put("repo", "forever", "value", sign(composeRepoStoreMsg("edge", "super", "repo", "forever", "value", 0)))
+
+	// the expiry replicates with the entry
+	replica := makeRepoStore(MakeMemStorage())
+	record, _ := repoStore.record("repo")
+	replica.merge(record)
+	if replicated, _ := replica.get("repo", "session"); replicated == nil || replicated.Expires != entry.Expires {
+		t.Fatal("expected expiry to replicate")
+	}
+
+	if _, swept, _ := repoStore.sweep(); swept != 0 {
+		t.Fatalf("expected nothing to be swept, %d entries were", swept)
+	}
+
+	entry.Expires = time.Now().Unix() - 1
+	storage.Put("repo", "session", entry)
+	if expired, _ := repoStore.get("repo", "session"); expired != nil {
+		t.Fatal("expected expired entry to be hidden before it is swept")
+	}
+	if keys, _, _, _ := repoStore.scan("repo", "", "", 10); len(keys) != 1 || keys[0] != "forever" {
+		t.Fatalf("expected expired entry not to be listed, got %v", keys)
+	}
+
+	// expired entries become tombstones, so that watchers learn about the expiry
+	expired, swept, _ := repoStore.sweep()
+	if swept != 1 || len(expired) != 1 || expired[0].key != "session" || !expired[0].entry.Deleted {
+		t.Fatalf("expected session to be swept into a tombstone, got %d %v", swept, expired)
+	}
+
+	tombstone, _ := storage.Get("repo", "session")
+	tombstone.Expires = time.Now().Unix() - 1
+	storage.Put("repo", "session", tombstone)
+	if _, swept, _ := repoStore.sweep(); swept != 1 {
+		t.Fatalf("expected 1 swept tombstone, got %d", swept)
+	}
+	if keys, _ := storage.Keys("repo"); len(keys) != 1 {
+		t.Fatalf("expected only one key to remain, got %v", keys)
+	}
+}
+
+func TestRepoWatch(t *testing.T) {
+	network := MakeMemNetwork()
+	MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := GenerateAesSecret()
+
+	result := make(chan interface{}, 1)
+	callback := func(err error, data interface{}) {
+		if err != nil {
+			result <- err
+		} else {
+			result <- data
+		}
+	}
+
+	// the watcher and the writer use the same repo on two edge nodes
+	var repoServices []*RepoService
+	for i := 0; i < 2; i++ {
+		edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+		go edgeNode.Connect("super:1111")
+		time.Sleep(300 * time.Millisecond)
+
+		edgeNode.ClaimOwnership("repo", secret, prv, pub, 5, callback)
+		repoService, ok := (<-result).(*RepoService)
+		if !ok {
+			t.Fatal("failed to claim repo")
+		}
+		repoServices = append(repoServices, repoService)
+	}
+	watcher, writer := repoServices[0], repoServices[1]
+
+	changes := make(chan *RepoChange, 10)
+	watchCallback := func(err error, change *RepoChange) {
+		if err != nil {
+			t.Error(err)
+		} else {
+			changes <- change
+		}
+	}
+	nextChange := func() *RepoChange {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for change")
+			return nil
+		}
+	}
+
+	writer.Store("other", "x", 5, callback)
+	<-result
+
+	watch, err := watcher.Watch("user/", "", watchCallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if watch.Token() == "" {
+		t.Fatal("expected a token once subscribed")
+	}
+
+	writer.Store("other", "y", 5, callback)
+	<-result
+	writer.Store("user/alice", "online", 5, callback)
+	<-result
+	if change := nextChange(); change.Key != "user/alice" || change.Value != "online" || change.Version != 1 || change.Deleted {
+		t.Fatalf("unexpected change %v", change)
+	}
+
+	// changes while the watcher is away are sent when it resumes with its token
+	watch.Stop()
+	token := watch.Token()
+	writer.Store("user/bob", "online", 5, callback)
+	<-result
+	writer.Delete("user/alice", 5, callback)
+	<-result
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected change %v after the watch was stopped", change)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if _, err := watcher.Watch("user/", token, watchCallback); err != nil {
+		t.Fatal(err)
+	}
+	if change := nextChange(); change.Key != "user/bob" || change.Value != "online" {
+		t.Fatalf("unexpected change %v", change)
+	}
+	if change := nextChange(); change.Key != "user/alice" || !change.Deleted || change.Version != 2 {
+		t.Fatalf("unexpected change %v", change)
+	}
+
+	if _, err := watcher.Watch("user/", "invalid", watchCallback); err == nil {
+		t.Error("expected invalid token to be rejected")
+	}
+}
+
+func TestRepoMergeRejectsForgeries(t *testing.T) {
+	owner, sign := makeRepoSigner(t)
+	repoStore := makeRepoStore(MakeMemStorage())
+	repoStore.claim("repo", owner)
+	replica := makeRepoStore(MakeMemStorage())
+	replica.claim("repo", owner)
+
+	key, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	member := composeRepoService(key, &key.PublicKey, "repo", nil, nil)
+	member.signer, _ = generatePublicPem(&key.PublicKey)
+	memberStore := func(value string) *RepoEntry {
+		msg := composeRepoStoreMsg("edge", "super", "repo", "key", value, member.nextNonce())
+		member.sign(msg)
+		return &RepoEntry{Value: value, Version: 10, Proof: makeRepoProof(msg, member.signer)}
+	}
+	merge := func(record *repoRecord) string {
+		replica.merge(record)
+		entry, _ := replica.get("repo", "key")
+		if entry == nil {
+			return ""
+		}
+		return entry.Value
+	}
+
+	_, entry, _ := repoStore.put("repo", "key", "value", sign(composeRepoStoreMsg("edge", "super", "repo", "key", "value", 0)))
+	if value := merge(&repoRecord{RepoId: "repo", Values: map[string]*RepoEntry{"key": entry}}); value != "value" {
+		t.Fatalf("expected the signed entry to replicate, got <%s>", value)
+	}
+
+	// values that were not stored by the request, or by nobody
+	forged := *entry
+	forged.Value = "forged"
+	forged.Version = 10
+	unsigned := &RepoEntry{Value: "unsigned", Version: 10}
+	for _, entry := range []*RepoEntry{&forged, unsigned, memberStore("member")} {
+		if value := merge(&repoRecord{RepoId: "repo", Values: map[string]*RepoEntry{"key": entry}}); value != "value" {
+			t.Fatalf("expected forged entry to be rejected, got <%s>", value)
+		}
+	}
+
+	// an acl the owner has not signed, or that has no changes to replay
+	acl := &RepoAcl{Version: 5, Grants: map[string]RepoRight{member.signer: RepoAdmin}, Writers: map[string]bool{member.signer: true}}
+	merge(&repoRecord{RepoId: "repo", Owner: member.signer, Acl: acl})
+	grant := composeRepoGrantMsg("edge", "super", "repo", member.signer, RepoAdmin, member.nextNonce())
+	member.sign(grant)
+	proof := makeRepoProof(grant, member.signer)
+	proof.AclVersion = 1
+	acl = &RepoAcl{Version: 1, Grants: acl.Grants, Writers: acl.Writers, Log: []*repoProofType{proof}}
+	merge(&repoRecord{RepoId: "repo", Owner: owner, Acl: acl})
+	if current, _ := replica.owner("repo"); current != owner {
+		t.Fatal("expected forged ownership to be rejected")
+	}
+	if _, err := replica.authorize("repo", member.signer, RepoRead); err == nil {
+		t.Fatal("expected forged acl to be rejected")
+	}
+
+	// once the owner has granted write access, the member's entries replicate
+	acl, _ = repoStore.grant("repo", sign(composeRepoGrantMsg("edge", "super", "repo", member.signer, RepoWrite, 0)))
+	merge(&repoRecord{RepoId: "repo", Owner: owner, Acl: acl})
+	if value := merge(&repoRecord{RepoId: "repo", Values: map[string]*RepoEntry{"key": memberStore("member")}}); value != "member" {
+		t.Fatalf("expected the entry of a writer to replicate, got <%s>", value)
+	}
+}
+
+func TestRepoWatchOnlyFromSubscribedSuperNode(t *testing.T) {
+	repoService := composeRepoService(nil, nil, "repo", nil, nil)
+	changes := make(chan *RepoChange, 10)
+	watch := &RepoWatch{id: "watch", repoService: repoService, done: make(chan bool)}
+	watch.callback = func(err error, change *RepoChange) {
+		changes <- change
+	}
+	repoService.watches[watch.id] = watch
+
+	change := func(src string, key string, seq int64) {
+		repoService.deliverChange(composeRepoChangeMsg(src, "edge", "repo", watch.id, key, &RepoEntry{Value: "value", Version: 1, Seq: seq}))
+	}
+	expect := func(keys ...string) {
+		for _, key := range keys {
+			select {
+			case change := <-changes:
+				if change.Key != key {
+					t.Fatalf("expected change of %s, got %s", key, change.Key)
+				}
+			default:
+				t.Fatalf("expected change of %s", key)
+			}
+		}
+		if len(changes) > 0 {
+			t.Fatalf("unexpected change of %s", (<-changes).Key)
+		}
+	}
+
+	// missed changes may arrive before the subscription reply
+	change("super", "missed", 5)
+	change("evil", "forged", 9)
+	expect()
+	watch.subscribed(&repoWatchReplyType{Seq: 10, SuperNodeId: "super"})
+	expect("missed")
+
+	change("evil", "forged", 20)
+	change("super", "key", 11)
+	expect("key")
+	if token := watch.Token(); token != "11" {
+		t.Fatalf("expected token 11, got %s", token)
+	}
+
+	// changes from other super nodes are dropped on the next subscription reply
+	watch.subscribed(&repoWatchReplyType{Seq: 11, SuperNodeId: "super"})
+	expect()
+	if len(watch.held) != 0 {
+		t.Fatalf("expected held changes to be dropped, %d left", len(watch.held))
+	}
+}
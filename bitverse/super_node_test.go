@@ -0,0 +1,296 @@
+package bitverse
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Starts n super nodes on the network and joins them into a ring, returns once
+// they agree on who is responsible for a set of keys
+func makeMemRing(t *testing.T, network *MemNetwork, n int) []*SuperNode {
+	var superNodes []*SuperNode
+	for i := 0; i < n; i++ {
+		superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), fmt.Sprintf("super%d", i), "1111")
+		superNodes = append(superNodes, superNode)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, superNode := range superNodes[1:] {
+		if err := superNode.Join(superNodes[0].Address()); err != nil {
+			t.Fatalf("failed to join ring: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(60 * time.Second)
+	for !memRingStable(superNodes) {
+		if time.Now().After(deadline) {
+			t.Fatal("ring did not stabilize")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return superNodes
+}
+
+func memRingStable(superNodes []*SuperNode) bool {
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		var expected []string
+		for _, superNode := range superNodes {
+			addresses, err := superNode.lookup(key, len(superNodes))
+			if err != nil || len(addresses) != len(superNodes) {
+				return false
+			}
+			if expected == nil {
+				expected = addresses
+			} else if fmt.Sprint(addresses) != fmt.Sprint(expected) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestSuperNodeJoin(t *testing.T) {
+	network := MakeMemNetwork()
+	superNodes := makeMemRing(t, network, 3)
+
+	// the super nodes reach each other over authenticated links
+	for _, superNode := range superNodes {
+		for _, other := range superNodes {
+			if other != superNode && !superNode.rpc.authenticated(mustLink(t, superNode, other.Address())) {
+				t.Fatalf("link from %s to %s is not authenticated", superNode.Address(), other.Address())
+			}
+		}
+	}
+}
+
+func mustLink(t *testing.T, superNode *SuperNode, address string) *RemoteNode {
+	remoteNode, err := superNode.rpc.link(address)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", address, err)
+	}
+	return remoteNode
+}
+
+func TestRpcOnlyFromSuperNodes(t *testing.T) {
+	network := MakeMemNetwork()
+	superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	publish := func(address string) {
+		identity, _ := GenerateIdentity()
+		transport := network.MakeTransport()
+		transport.SetIdentity(identity)
+		transport.SetLocalAddress(address)
+		remoteNodeChannel := make(chan *RemoteNode, 10)
+		go transport.ConnectToNode("super:1111", remoteNodeChannel, make(chan Msg, 10))
+
+		record := fmt.Sprintf(`{"NodeId":"victim","Address":"%s","Expires":%d}`, address, time.Now().Unix()+60)
+		(<-remoteNodeChannel).deliver(composeRpcMsg(identity.Id(), address, "registry.Publish", record))
+	}
+
+	// an edge node, and a node advertising an address nobody is listening at
+	publish("")
+	publish("ghost:1111")
+	time.Sleep(500 * time.Millisecond)
+	if record := superNode.registry.lookup("victim"); record != nil {
+		t.Fatalf("published location from a node that is not a super node: %s", record.Address)
+	}
+
+	// a super node can, as it is listening at the address it advertises
+	peer, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "peer", "1111")
+	record := &locationRecord{NodeId: "victim", Address: "peer:1111", Expires: time.Now().Unix() + 60}
+	if err := peer.rpc.call("super:1111", "registry.Publish", record, nil); err != nil {
+		t.Fatalf("failed to publish location: %v", err)
+	}
+	if record := superNode.registry.lookup("victim"); record == nil || record.Address != "peer:1111" {
+		t.Fatal("expected the super node to publish the location")
+	}
+}
+
+func TestLocationRegistry(t *testing.T) {
+	network := MakeMemNetwork()
+	superNodes := makeMemRing(t, network, 3)
+	secret, _ := GenerateAesSecret()
+
+	edgeNode, _ := makeMemEdgeNode(t, network, secret, superNodes[2].Address())
+	waitForLocation := func(expected string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			address := ""
+			record, err := superNodes[0].lookupLocation(edgeNode.Id())
+			if err == nil && record != nil {
+				address = record.Address
+			}
+			if address == expected {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the location of the edge node to be <%s>, got <%s>", expected, address)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	waitForLocation(superNodes[2].Address())
+
+	// the location is withdrawn when the edge node leaves
+	network.Partition(edgeNode.Id(), superNodes[2].Address())
+	network.Disconnect(edgeNode.Id())
+	waitForLocation("")
+}
+
+func TestLocationRecordsHeldByCaller(t *testing.T) {
+	superNode, _ := MakeSuperNode(MakeMemNetwork().MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	host := rpcCallerType{"host", "host:1111"}
+	other := rpcCallerType{"other", "other:1111"}
+
+	// the record is held by the caller, whatever it claims, for one lease
+	forged, _ := json.Marshal(&locationRecord{NodeId: "edge", Address: "elsewhere:1111", Expires: time.Now().Add(time.Hour).Unix()})
+	superNode.servePublishLocation(host, forged)
+	record := superNode.registry.lookup("edge")
+	if record == nil || record.Address != host.address || record.SuperNodeId != host.nodeId {
+		t.Fatalf("expected the record to be held by the caller, got %v", record)
+	}
+	if record.Expires > time.Now().Add(time.Second*REGISTRY_LEASE).Unix() {
+		t.Fatal("expected the lease to be set by the registry")
+	}
+
+	// other super nodes can neither take the mail nor withdraw the record
+	superNode.mailbox.deposit(&mailType{Msg{Id: "1", Dst: "edge", Type: Data}, time.Now().Add(time.Minute).Unix()})
+	ack, _ := json.Marshal(&ackMailArgs{"edge", []string{"1"}})
+	if _, err := superNode.serveAckMail(other, ack); err == nil || len(superNode.mailbox.peek("edge")) != 1 {
+		t.Fatal("expected mail to be acknowledged only by the hosting super node")
+	}
+	withdraw, _ := json.Marshal(&locationRecord{NodeId: "edge", Address: host.address})
+	superNode.serveWithdrawLocation(other, withdraw)
+	if superNode.registry.lookup("edge") == nil {
+		t.Fatal("expected the record to be withdrawn only by the hosting super node")
+	}
+
+	if _, err := superNode.serveAckMail(host, ack); err != nil || len(superNode.mailbox.peek("edge")) != 0 {
+		t.Fatalf("expected the hosting super node to acknowledge mail: %v", err)
+	}
+	superNode.serveWithdrawLocation(host, withdraw)
+	if superNode.registry.lookup("edge") != nil {
+		t.Fatal("expected the hosting super node to withdraw the record")
+	}
+}
+
+func TestRepoPartitioning(t *testing.T) {
+	network := MakeMemNetwork()
+	superNodes := makeMemRing(t, network, REPO_REPLICAS+2)
+	secret, _ := GenerateAesSecret()
+	prv, pub, err := ImportPem("test/cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edgeNode, _ := MakeEdgeNode(network.MakeTransport(), nil, nil)
+	go edgeNode.Connect(superNodes[0].Address())
+	time.Sleep(200 * time.Millisecond)
+
+	done := make(chan error, 1)
+	for i := 0; i < 8; i++ {
+		repoId := fmt.Sprintf("repo%d", i)
+		edgeNode.ClaimOwnership(repoId, secret, prv, pub, 5, func(err error, repoService interface{}) {
+			if err == nil {
+				repoService.(*RepoService).Store("key", "value", 5, func(err error, _ interface{}) {
+					done <- err
+				})
+				return
+			}
+			done <- err
+		})
+		if err := <-done; err != nil {
+			t.Fatalf("failed to store in %s: %v", repoId, err)
+		}
+
+		// the repo is stored by the super node responsible for it and its replicas only
+		addresses, _ := superNodes[0].lookup(repoId, REPO_REPLICAS+1)
+		responsible := make(map[string]bool)
+		for _, address := range addresses {
+			responsible[address] = true
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for _, superNode := range superNodes {
+			for {
+				entry, _ := superNode.repoStore.get(repoId, "key")
+				if (entry != nil) == responsible[superNode.Address()] {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: expected super node at %s to hold the repo: %v", repoId, superNode.Address(), responsible[superNode.Address()])
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestLocationsOnlyFromSuperNodes(t *testing.T) {
+	network := MakeMemNetwork()
+	superNode, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "super", "1111")
+	time.Sleep(100 * time.Millisecond)
+
+	identity, _ := GenerateIdentity()
+	transport := network.MakeTransport()
+	transport.SetIdentity(identity)
+	remoteNodeChannel := make(chan *RemoteNode, 10)
+	go transport.ConnectToNode("super:1111", remoteNodeChannel, make(chan Msg, 10))
+
+	// a child claiming to be hosted by another super node
+	msg := composeMsgServiceMsg(identity.Id(), "dst", "service", "hello")
+	msg.Origin = "evil:1111"
+	(<-remoteNodeChannel).deliver(msg)
+	time.Sleep(200 * time.Millisecond)
+
+	if address := superNode.locations.get(identity.Id()); address != "" {
+		t.Fatalf("learned location <%s> from a child", address)
+	}
+}
+
+func TestChangesOnlyFromResponsibleSuperNodes(t *testing.T) {
+	network := MakeMemNetwork()
+	superNodes := makeMemRing(t, network, 2)
+
+	identity, _ := GenerateIdentity()
+	transport := network.MakeTransport()
+	transport.SetIdentity(identity)
+	msgChannel := make(chan Msg, 10)
+	go transport.ConnectToNode(superNodes[0].Address(), make(chan *RemoteNode, 10), msgChannel)
+	time.Sleep(200 * time.Millisecond)
+
+	entry := &RepoEntry{Value: "value", Version: 1, Seq: 1}
+	nextChange := func() *Msg {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case msg := <-msgChannel:
+				if msg.RepoCmd == Change {
+					return &msg
+				}
+			case <-timeout:
+				return nil
+			}
+		}
+	}
+
+	// a super node outside the ring is not responsible for any repo
+	peer, _ := MakeSuperNode(network.MakeTransport(), nil, MakeMemStorage(), "peer", "1111")
+	peer.locations.add(identity.Id(), superNodes[0].Address())
+	peer.sendChange(*composeRepoChangeMsg(peer.Id(), identity.Id(), "repo", "watch", "key", entry))
+	if msg := nextChange(); msg != nil {
+		t.Fatalf("relayed change notification from %s", msg.Src)
+	}
+
+	// with two super nodes, both are responsible for every repo
+	superNodes[1].locations.add(identity.Id(), superNodes[0].Address())
+	superNodes[1].sendChange(*composeRepoChangeMsg(superNodes[1].Id(), identity.Id(), "repo", "watch", "key", entry))
+	if msg := nextChange(); msg == nil || msg.Src != superNodes[1].Id() {
+		t.Fatal("expected the change notification to be relayed")
+	}
+}
@@ -0,0 +1,111 @@
+package bitverse
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+const TCP_DIAL_TIMEOUT time.Duration = 10
+
+type tcpClientType struct {
+	msgChannel        chan Msg
+	remoteNodeChannel chan *RemoteNode
+	identity          *Identity
+	localAddress      string
+	conn              net.Conn
+	reader            *bufio.Reader
+	writer            *frameWriter
+}
+
+func makeTcpClient(msgChannel chan Msg, remoteNodeChannel chan *RemoteNode, identity *Identity, localAddress string) *tcpClientType {
+	tcpClient := new(tcpClientType)
+	tcpClient.msgChannel = msgChannel
+	tcpClient.remoteNodeChannel = remoteNodeChannel
+	tcpClient.identity = identity
+	tcpClient.localAddress = localAddress
+
+	return tcpClient
+}
+
+func (tcpClient *tcpClientType) connect(ipAddress string) error {
+	var err error
+	tcpClient.conn, err = net.DialTimeout("tcp", ipAddress, time.Second*TCP_DIAL_TIMEOUT)
+	if err != nil {
+		info("failed to connect to supernode at " + ipAddress + ", connection refused")
+		return err
+	}
+	defer tcpClient.conn.Close()
+
+	tcpClient.reader = bufio.NewReader(tcpClient.conn)
+	tcpClient.writer = &frameWriter{tcpClient.conn}
+
+	remoteNode := tcpClient.handshake()
+	if remoteNode == nil {
+		return errors.New("handshake with " + ipAddress + " failed")
+	}
+
+	tcpClient.remoteNodeChannel <- remoteNode
+
+	for {
+		msg := tcpClient.receive()
+
+		if msg == nil {
+			remoteNode.setState(Dead)
+			tcpClient.remoteNodeChannel <- remoteNode
+			return nil
+		}
+		msg.link = remoteNode
+		tcpClient.msgChannel <- *msg
+	}
+}
+
+func (tcpClient *tcpClientType) send(msg *Msg) {
+	enc := json.NewEncoder(tcpClient.writer)
+	err := enc.Encode(msg)
+	if err != nil {
+		info("tcpclient: failed to send message")
+	}
+}
+
+func (tcpClient *tcpClientType) handshake() *RemoteNode {
+	challenge := makeChallenge()
+	msg := composeHandshakeMsg(tcpClient.identity, tcpClient.localAddress, challenge, "")
+
+	tcpClient.send(msg)
+	reply := tcpClient.receive()
+	if reply == nil || reply.Type != Handshake {
+		return nil
+	}
+	proof, err := verifyHandshake(reply, challenge)
+	if err != nil {
+		info("tcpclient: " + err.Error())
+		return nil
+	}
+
+	// answer the challenge of the server, it will not accept any other messages before
+	tcpClient.send(composeHandshakeMsg(tcpClient.identity, tcpClient.localAddress, "", proof.Challenge))
+
+	remoteNodeId := makeNodeIdFromString(reply.Src)
+	remoteNode := makeRemoteNode(tcpClient.remoteNodeChannel, tcpClient.writer, tcpClient.identity.Id(), remoteNodeId.String(), reply.Origin)
+
+	return remoteNode
+}
+
+func (tcpClient *tcpClientType) receive() *Msg {
+	frame, err := readFrame(tcpClient.reader)
+	if err != nil {
+		debug("tcpclient: failed to read message")
+		return nil
+	}
+
+	var msg Msg
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		info("tcpclient: failed to decode message")
+		return nil
+	}
+
+	return &msg
+}
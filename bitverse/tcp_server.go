@@ -0,0 +1,96 @@
+package bitverse
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+)
+
+type tcpServerType struct {
+	msgChannel        chan Msg
+	remoteNodeChannel chan *RemoteNode
+	identity          *Identity
+	localAddress      string
+}
+
+func (tcpServer *tcpServerType) handleConn(conn net.Conn) {
+	var remoteNode *RemoteNode = nil
+	reader := bufio.NewReader(conn)
+	writer := &frameWriter{conn}
+	handshake := makeServerHandshake(tcpServer.identity, tcpServer.localAddress)
+
+	defer conn.Close()
+
+	for {
+		var msg Msg
+		frame, err := readFrame(reader)
+		if err == nil {
+			err = json.Unmarshal(frame, &msg)
+		}
+
+		if err != nil {
+			debug("tcpserver: connection closed")
+			if remoteNode != nil {
+				remoteNode.setState(Dead)
+				tcpServer.remoteNodeChannel <- remoteNode
+			}
+			break
+		}
+
+		if msg.Type == Handshake {
+			reply, err := handshake.receive(&msg)
+			if err != nil {
+				info("tcpserver: rejecting " + msg.Src + ", " + err.Error())
+				if remoteNode != nil {
+					remoteNode.setState(Dead)
+					tcpServer.remoteNodeChannel <- remoteNode
+				}
+				break
+			}
+
+			if reply != nil {
+				// this must be the first message the remote node receives
+				json.NewEncoder(writer).Encode(reply)
+			}
+
+			if handshake.authenticated {
+				remoteNode = makeRemoteNode(tcpServer.remoteNodeChannel, writer, tcpServer.identity.Id(), msg.Src, msg.Origin)
+				tcpServer.remoteNodeChannel <- remoteNode
+			}
+		} else if remoteNode == nil {
+			debug("tcpserver: dropping message from unauthenticated node " + msg.Src)
+		} else {
+			// the super node checks that the link may send messages from msg.Src
+			msg.link = remoteNode
+			tcpServer.msgChannel <- msg
+		}
+	}
+}
+
+func makeTcpServer(identity *Identity, localAddress string, msgChannel chan Msg, remoteNodeChannel chan *RemoteNode) *tcpServerType {
+	tcpServer := new(tcpServerType)
+	tcpServer.msgChannel = msgChannel
+	tcpServer.remoteNodeChannel = remoteNodeChannel
+	tcpServer.identity = identity
+	tcpServer.localAddress = localAddress
+
+	return tcpServer
+}
+
+func (tcpServer *tcpServerType) start(port string) {
+	debug("tcpserver: starting a new server at port " + port)
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		panic("tcpserver.start: " + err.Error())
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			info("tcpserver: failed to accept connection: " + err.Error())
+			continue
+		}
+		go tcpServer.handleConn(conn)
+	}
+}
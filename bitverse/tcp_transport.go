@@ -0,0 +1,82 @@
+package bitverse
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// frames larger than this are considered corrupt
+const TCP_MAX_FRAME_SIZE = 16 * 1024 * 1024
+
+// TCPTransport sends json encoded messages over plain TCP connections, each
+// message is prefixed with its length as a 4 byte big endian integer
+type TCPTransport struct {
+	localPort    string
+	localAddress string
+	tcpServer    *tcpServerType
+	identity     *Identity
+}
+
+func MakeTCPTransport() *TCPTransport {
+	tcpTransport := new(TCPTransport)
+	return tcpTransport
+}
+
+func (tcpTransport *TCPTransport) SetIdentity(identity *Identity) {
+	tcpTransport.identity = identity
+}
+
+func (tcpTransport *TCPTransport) SetLocalAddress(localAddress string) {
+	tcpTransport.localAddress = localAddress
+}
+
+func (tcpTransport *TCPTransport) Listen(localAddress string, localPort string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) {
+	tcpServer := makeTcpServer(tcpTransport.identity, tcpTransport.localAddress, msgChannel, remoteNodeChannel)
+	tcpTransport.localPort = localPort
+	tcpTransport.tcpServer = tcpServer
+	tcpServer.start(tcpTransport.localPort)
+}
+
+func (tcpTransport *TCPTransport) ConnectToNode(remoteAddress string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) error {
+	tcpClient := makeTcpClient(msgChannel, remoteNodeChannel, tcpTransport.identity, tcpTransport.localAddress)
+	return tcpClient.connect(remoteAddress)
+}
+
+/// PRIVATE
+
+// frameWriter prefixes every write with its length, json.Encoder writes each
+// message with a single call to Write
+type frameWriter struct {
+	conn net.Conn
+}
+
+func (writer *frameWriter) Write(data []byte) (int, error) {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+
+	if _, err := writer.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func readFrame(reader io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > TCP_MAX_FRAME_SIZE {
+		return nil, errors.New("tcp: frame too large")
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
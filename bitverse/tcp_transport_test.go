@@ -0,0 +1,45 @@
+package bitverse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestTCPFraming(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		enc := json.NewEncoder(&frameWriter{client})
+		enc.Encode(composeHeartbeatMsg("a", "b"))
+		enc.Encode(composeHeartbeatMsg("c", "d"))
+	}()
+
+	for _, src := range []string{"a", "c"} {
+		frame, err := readFrame(server)
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+
+		var msg Msg
+		if err := json.Unmarshal(frame, &msg); err != nil {
+			t.Fatalf("failed to decode frame: %v", err)
+		}
+		if msg.Src != src {
+			t.Fatalf("expected src %s, got %s", src, msg.Src)
+		}
+	}
+}
+
+func TestTCPFrameTooLarge(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], TCP_MAX_FRAME_SIZE+1)
+
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Fatal("expected an error for an oversized frame")
+	}
+}
@@ -1,7 +1,8 @@
 package bitverse
 
 type Transport interface {
-	SetLocalNodeId(localNodeId NodeId)
+	SetIdentity(identity *Identity)      // the node id is derived from the identity
+	SetLocalAddress(localAddress string) // only set by super nodes, advertised to remote nodes during handshake
 	Listen(localAddress string, localPort string, remoteNodeChannels chan *RemoteNode, msgChannel chan Msg)
-	ConnectToNode(remoteAddress string, remoteNodeChannels chan *RemoteNode, msgChannel chan Msg)
+	ConnectToNode(remoteAddress string, remoteNodeChannels chan *RemoteNode, msgChannel chan Msg) error // blocks until the link is closed
 }
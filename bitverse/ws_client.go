@@ -2,38 +2,56 @@ package bitverse
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
 	"encoding/json"
-	"os"
+	"errors"
 )
 
 type wsClientType struct {
 	msgChannel        chan Msg
 	remoteNodeChannel chan *RemoteNode
-	localNodeId       NodeId
+	identity          *Identity
+	localAddress      string
+	tlsConfig         *tls.Config // nil unless wss:// is used
 	ws                *websocket.Conn
 }
 
-func makeWsClient(msgChannel chan Msg, remoteNodeChannel chan *RemoteNode, localNodeId NodeId) *wsClientType {
+func makeWsClient(msgChannel chan Msg, remoteNodeChannel chan *RemoteNode, identity *Identity, localAddress string, tlsConfig *tls.Config) *wsClientType {
 	wsClient := new(wsClientType)
 	wsClient.msgChannel = msgChannel
 	wsClient.remoteNodeChannel = remoteNodeChannel
-	wsClient.localNodeId = localNodeId
+	wsClient.identity = identity
+	wsClient.localAddress = localAddress
+	wsClient.tlsConfig = tlsConfig
 
 	return wsClient
 }
 
-func (wsClient *wsClientType) connect(ipAddress string) {
+func (wsClient *wsClientType) connect(ipAddress string) error {
 	origin := "http://localhost/"
 	url := "ws://" + ipAddress + "/node"
+	if wsClient.tlsConfig != nil {
+		origin = "https://localhost/"
+		url = "wss://" + ipAddress + "/node"
+	}
 
-	var err error
-	wsClient.ws, err = websocket.Dial(url, "", origin)
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return err
+	}
+	config.TlsConfig = wsClient.tlsConfig
+
+	wsClient.ws, err = websocket.DialConfig(config)
 	if err != nil {
 		info("failed to connect to supernode at " + ipAddress + ", connection refused")
-		os.Exit(0)
+		return err
 	}
 
 	remoteNode := wsClient.handshake()
+	if remoteNode == nil {
+		wsClient.ws.Close()
+		return errors.New("handshake with " + ipAddress + " failed")
+	}
 
 	wsClient.remoteNodeChannel <- remoteNode
 
@@ -41,9 +59,11 @@ func (wsClient *wsClientType) connect(ipAddress string) {
 		msg := wsClient.receive()
 
 		if msg == nil {
-			// TODO: remove the link
-			return
+			remoteNode.setState(Dead)
+			wsClient.remoteNodeChannel <- remoteNode
+			return nil
 		}
+		msg.link = remoteNode
 		wsClient.msgChannel <- *msg
 	}
 }
@@ -57,13 +77,25 @@ func (wsClient *wsClientType) send(msg *Msg) {
 }
 
 func (wsClient *wsClientType) handshake() *RemoteNode {
-	msg := composeHandshakeMsg(wsClient.localNodeId.String())
+	challenge := makeChallenge()
+	msg := composeHandshakeMsg(wsClient.identity, wsClient.localAddress, challenge, "")
 
 	wsClient.send(msg)
 	reply := wsClient.receive()
+	if reply == nil || reply.Type != Handshake {
+		return nil
+	}
+	proof, err := verifyHandshake(reply, challenge)
+	if err != nil {
+		info("wsclient: " + err.Error())
+		return nil
+	}
+
+	// answer the challenge of the server, it will not accept any other messages before
+	wsClient.send(composeHandshakeMsg(wsClient.identity, wsClient.localAddress, "", proof.Challenge))
 
 	remoteNodeId := makeNodeIdFromString(reply.Src)
-	remoteNode := makeRemoteNode(wsClient.remoteNodeChannel, wsClient.ws, wsClient.localNodeId.String(), remoteNodeId.String())
+	remoteNode := makeRemoteNode(wsClient.remoteNodeChannel, wsClient.ws, wsClient.identity.Id(), remoteNodeId.String(), reply.Origin)
 
 	return remoteNode
 }
@@ -2,6 +2,7 @@ package bitverse
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"crypto/tls"
 	"encoding/json"
 	"net/http"
 )
@@ -9,13 +10,16 @@ import (
 type wsServerType struct {
 	msgChannel        chan Msg
 	remoteNodeChannel chan *RemoteNode
-	localNodeId       NodeId
+	identity          *Identity
+	localAddress      string
+	tlsConfig         *tls.Config // nil unless wss:// is used
 }
 
 func (wsServer *wsServerType) WsHandler(ws *websocket.Conn) {
 	var err error
 	var msg Msg
 	var remoteNode *RemoteNode = nil
+	handshake := makeServerHandshake(wsServer.identity, wsServer.localAddress)
 
 	for {
 		dec := json.NewDecoder(ws)
@@ -24,31 +28,49 @@ func (wsServer *wsServerType) WsHandler(ws *websocket.Conn) {
 		if err != nil {
 			debug("wsserver: connection closed")
 			if remoteNode != nil {
-				remoteNode.state = Dead
+				remoteNode.setState(Dead)
 				wsServer.remoteNodeChannel <- remoteNode
 			}
 			break
 		}
 
 		if msg.Type == Handshake {
-			remoteNode = makeRemoteNode(wsServer.remoteNodeChannel, ws, wsServer.localNodeId.String(), msg.Src)
-			wsServer.remoteNodeChannel <- remoteNode
+			reply, err := handshake.receive(&msg)
+			if err != nil {
+				info("wsserver: rejecting " + msg.Src + ", " + err.Error())
+				if remoteNode != nil {
+					remoteNode.setState(Dead)
+					wsServer.remoteNodeChannel <- remoteNode
+				}
+				break
+			}
+
+			if reply != nil {
+				// this must be the first message the remote node receives
+				json.NewEncoder(ws).Encode(reply)
+			}
 
-			// send our node id to the remote node so that it can also create a link
-			reply := composeHandshakeMsg(wsServer.localNodeId.String())
-			enc := json.NewEncoder(ws)
-			enc.Encode(reply)
+			if handshake.authenticated {
+				remoteNode = makeRemoteNode(wsServer.remoteNodeChannel, ws, wsServer.identity.Id(), msg.Src, msg.Origin)
+				wsServer.remoteNodeChannel <- remoteNode
+			}
+		} else if remoteNode == nil {
+			debug("wsserver: dropping message from unauthenticated node " + msg.Src)
 		} else {
+			// the super node checks that the link may send messages from msg.Src
+			msg.link = remoteNode
 			wsServer.msgChannel <- msg
 		}
 	}
 }
 
-func makeWsServer(localNodeId NodeId, msgChannel chan Msg, remoteNodeChannel chan *RemoteNode) *wsServerType {
+func makeWsServer(identity *Identity, localAddress string, tlsConfig *tls.Config, msgChannel chan Msg, remoteNodeChannel chan *RemoteNode) *wsServerType {
 	wsServer := new(wsServerType)
 	wsServer.msgChannel = msgChannel
 	wsServer.remoteNodeChannel = remoteNodeChannel
-	wsServer.localNodeId = localNodeId
+	wsServer.identity = identity
+	wsServer.localAddress = localAddress
+	wsServer.tlsConfig = tlsConfig
 
 	return wsServer
 }
@@ -56,9 +78,18 @@ func makeWsServer(localNodeId NodeId, msgChannel chan Msg, remoteNodeChannel cha
 func (wsServer *wsServerType) start(port string) {
 	debug("wsserver: starting a new server at port " + port)
 
-	http.Handle("/node", websocket.Handler(wsServer.WsHandler))
+	// every server gets its own mux so that several super nodes can run in the same process
+	mux := http.NewServeMux()
+	mux.Handle("/node", websocket.Handler(wsServer.WsHandler))
 
-	err := http.ListenAndServe(":"+port, nil)
+	var err error
+	if wsServer.tlsConfig != nil {
+		// the certificate is part of the tls config
+		server := &http.Server{Addr: ":" + port, Handler: mux, TLSConfig: wsServer.tlsConfig}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = http.ListenAndServe(":"+port, mux)
+	}
 	if err != nil {
 		panic("wsserver.start: " + err.Error())
 	}
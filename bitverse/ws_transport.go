@@ -1,10 +1,16 @@
 package bitverse
 
+import (
+	"crypto/tls"
+)
+
 type WSTransport struct {
-	localPort   string
-	wsServer    *wsServerType
-	wsClient    *wsClientType
-	localNodeId NodeId
+	localPort    string
+	localAddress string
+	wsServer     *wsServerType
+	wsClient     *wsClientType
+	identity     *Identity
+	tlsConfig    *tls.Config
 }
 
 func MakeWSTransport() *WSTransport {
@@ -12,19 +18,29 @@ func MakeWSTransport() *WSTransport {
 	return wsTransport
 }
 
-func (wsTransport *WSTransport) SetLocalNodeId(localNodeId NodeId) {
-	wsTransport.localNodeId = localNodeId
+func (wsTransport *WSTransport) SetIdentity(identity *Identity) {
+	wsTransport.identity = identity
+}
+
+func (wsTransport *WSTransport) SetLocalAddress(localAddress string) {
+	wsTransport.localAddress = localAddress
+}
+
+// Makes the transport use wss:// instead of ws://, see LoadTLSConfig. Must be
+// called before the transport is used
+func (wsTransport *WSTransport) SetTLSConfig(tlsConfig *tls.Config) {
+	wsTransport.tlsConfig = tlsConfig
 }
 
 func (wsTransport *WSTransport) Listen(localAddress string, localPort string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) {
-	wsServer := makeWsServer(wsTransport.localNodeId, msgChannel, remoteNodeChannel)
+	wsServer := makeWsServer(wsTransport.identity, wsTransport.localAddress, wsTransport.tlsConfig, msgChannel, remoteNodeChannel)
 	wsTransport.localPort = localPort
 	wsTransport.wsServer = wsServer
 	wsServer.start(wsTransport.localPort)
 }
 
-func (wsTransport *WSTransport) ConnectToNode(remoteAddress string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) {
-	wsClient := makeWsClient(msgChannel, remoteNodeChannel, wsTransport.localNodeId)
+func (wsTransport *WSTransport) ConnectToNode(remoteAddress string, remoteNodeChannel chan *RemoteNode, msgChannel chan Msg) error {
+	wsClient := makeWsClient(msgChannel, remoteNodeChannel, wsTransport.identity, wsTransport.localAddress, wsTransport.tlsConfig)
 	wsTransport.wsClient = wsClient
-	wsClient.connect(remoteAddress)
+	return wsClient.connect(remoteAddress)
 }
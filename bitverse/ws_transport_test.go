@@ -0,0 +1,122 @@
+package bitverse
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// writes a certificate for localhost and its private key to dir, signed by
+// parent or self-signed if parent is nil
+func writeTestCert(t *testing.T, dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func freePort(t *testing.T) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func connectWithTLS(tlsConfig *tls.Config, address string) error {
+	transport := MakeWSTransport()
+	transport.SetIdentity(identityOrGenerate(nil))
+	transport.SetTLSConfig(tlsConfig)
+
+	remoteNodeChannel := make(chan *RemoteNode, 10)
+	errChannel := make(chan error, 1)
+	go func() {
+		errChannel <- transport.ConnectToNode(address, remoteNodeChannel, make(chan Msg, 10))
+	}()
+
+	select {
+	case <-remoteNodeChannel:
+		return nil
+	case err := <-errChannel:
+		return err
+	}
+}
+
+func TestWSTransportTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bitverse")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "node", ca, caKey)
+	writeTestCert(t, dir, "untrusted", nil, nil)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	serverConfig, err := LoadTLSConfig(path("node"), path("node.key"), path("ca"), true)
+	if err != nil {
+		t.Fatalf("failed to load tls config: %v", err)
+	}
+	transport := MakeWSTransport()
+	transport.SetTLSConfig(serverConfig)
+
+	port := freePort(t)
+	MakeSuperNode(transport, nil, MakeMemStorage(), "localhost", port)
+	time.Sleep(200 * time.Millisecond)
+	address := "localhost:" + port
+
+	clientConfig, _ := LoadTLSConfig(path("node"), path("node.key"), path("ca"), false)
+	if err := connectWithTLS(clientConfig, address); err != nil {
+		t.Fatalf("failed to connect with a trusted certificate: %v", err)
+	}
+
+	untrustedConfig, _ := LoadTLSConfig(path("untrusted"), path("untrusted.key"), path("ca"), false)
+	if err := connectWithTLS(untrustedConfig, address); err == nil {
+		t.Fatal("connected with an untrusted client certificate")
+	}
+
+	if err := connectWithTLS(nil, address); err == nil {
+		t.Fatal("connected without tls")
+	}
+}